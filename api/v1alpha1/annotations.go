@@ -0,0 +1,57 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+// Well-known annotations understood by Proxius
+const (
+	// ProxyDefAnnotation can be set on a Pod to name the ProxyDef, in the Pod's namespace,
+	// that should be injected into it
+	ProxyDefAnnotation = "proxius.igordc.com/proxydef"
+
+	// InjectAnnotation set to "false" on a Pod opts it out of injection altogether
+	InjectAnnotation = "proxius.igordc.com/inject"
+
+	// ExcludeContainersAnnotation can be set on a Pod to a comma-separated list of
+	// container names that must not be injected, on top of the ProxyDef's own exclusions
+	ExcludeContainersAnnotation = "proxius.igordc.com/exclude-containers"
+
+	// InjectedFromAnnotation is set by the Pod webhook to record where the injected
+	// settings came from, as <namespace>/<name>@<generation> for a ProxyDef
+	// or <name>@<generation> for a ClusterProxyDef. The workload webhook sets it on the
+	// workloads whose Pod templates it injected, with generation 0 until the generated
+	// objects are rendered, and the controller bumps it to have them injected again.
+	InjectedFromAnnotation = "proxius.igordc.com/injected-from"
+
+	// DefaultProxyDefAnnotation set to "true" on a ProxyDef marks it as the one to inject
+	// when a namespace has more than one ProxyDef and the Pod does not name any
+	DefaultProxyDefAnnotation = "proxius.igordc.com/default"
+
+	// ConfigHashAnnotation is set by the Pod webhook to the ConfigHash of the configuration
+	// injected into a Pod, and by the controller on the Pod templates of the workloads it
+	// restarts, so that their Pods are recreated with the current configuration
+	ConfigHashAnnotation = "proxius.igordc.com/config-hash"
+
+	// NoProxyFormatAnnotation can be set on a Pod to select the NoProxyFormat of NO_PROXY,
+	// either for every container ("expanded") or per container ("app=expanded,legacy=wildcard").
+	// It only applies when the ProxyDef renders the variants, by setting its noProxyFormat.
+	NoProxyFormatAnnotation = "proxius.igordc.com/no-proxy-format"
+
+	// EnvConflictsAnnotation is set by the Pod webhook to the proxy variables that containers
+	// define themselves, as resolved by the EnvConflictPolicy of the ProxyDef, per container
+	// ("app=HTTP_PROXY,http_proxy;sidecar=NO_PROXY")
+	EnvConflictsAnnotation = "proxius.igordc.com/env-conflicts"
+)
@@ -0,0 +1,105 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ClusterProxyDefSpec defines the desired state of ClusterProxyDef
+type ClusterProxyDefSpec struct {
+	// NamespaceSelector selects the namespaces the proxy settings are rendered into.
+	// An empty or missing selector selects every namespace.
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// The proxy settings themselves are the same as the ones of a ProxyDef
+	ProxyDefSpec `json:",inline"`
+}
+
+// ClusterProxyDefStatus defines the observed state of ClusterProxyDef
+type ClusterProxyDefStatus struct {
+	// Conditions store the status conditions of the ClusterProxyDef instances,
+	// using the same "Ready", "Syncing" and "Degraded" types as ProxyDef
+	// +operator-sdk:csv:customresourcedefinitions:type=status
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type" protobuf:"bytes,1,rep,name=conditions"`
+
+	// ConfigMapName is the name of the ConfigMap generated in every selected namespace
+	// +operator-sdk:csv:customresourcedefinitions:type=status
+	ConfigMapName string `json:"configMapName,omitempty"`
+
+	// SecretName is the name of the Secret generated in every selected namespace
+	// when the ClusterProxyDef has credentials
+	// +operator-sdk:csv:customresourcedefinitions:type=status
+	SecretName string `json:"secretName,omitempty"`
+
+	// ConfigHash identifies the current proxy configuration, including the revision
+	// of the referenced credentials. Injected Pods are annotated with it.
+	// +operator-sdk:csv:customresourcedefinitions:type=status
+	ConfigHash string `json:"configHash,omitempty"`
+
+	// PACURL is where the proxy auto-config file of this ClusterProxyDef is served
+	// when autoDetect is set
+	// +operator-sdk:csv:customresourcedefinitions:type=status
+	PACURL string `json:"pacURL,omitempty"`
+
+	// TrustedCAConfigMapName is the name of the ConfigMap generated in each namespace
+	// with the trusted CA bundle, which the pod webhook mounts into containers
+	// +operator-sdk:csv:customresourcedefinitions:type=status
+	TrustedCAConfigMapName string `json:"trustedCAConfigMapName,omitempty"`
+
+	// ConfigFilesConfigMapName is the name of the ConfigMap generated in each namespace
+	// with the tool configuration files, which the pod webhook mounts into containers
+	// +operator-sdk:csv:customresourcedefinitions:type=status
+	ConfigFilesConfigMapName string `json:"configFilesConfigMapName,omitempty"`
+
+	// VariantsConfigMapName is the name of the ConfigMap generated in each namespace
+	// with the helper variables the pod webhook references for noProxyFormat and injectJavaToolOptions
+	// +operator-sdk:csv:customresourcedefinitions:type=status
+	VariantsConfigMapName string `json:"variantsConfigMapName,omitempty"`
+
+	// Namespaces lists the namespaces the ConfigMap is currently rendered into
+	// +operator-sdk:csv:customresourcedefinitions:type=status
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+
+// ClusterProxyDef is the Schema for the clusterproxydefs API.
+// It renders proxy settings into every namespace matched by its namespace selector,
+// and is used for Pods whose namespace has no applicable ProxyDef of its own.
+type ClusterProxyDef struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ClusterProxyDefSpec   `json:"spec,omitempty"`
+	Status ClusterProxyDefStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ClusterProxyDefList contains a list of ClusterProxyDef
+type ClusterProxyDefList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterProxyDef `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ClusterProxyDef{}, &ClusterProxyDefList{})
+}
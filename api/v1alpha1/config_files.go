@@ -0,0 +1,66 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+// ConfigFileProfile names a tool whose proxy configuration file is rendered by the controller,
+// for the tools that ignore the proxy environment variables
+// +kubebuilder:validation:Enum=apt;pip;npm;git;maven
+type ConfigFileProfile string
+
+const (
+	// ConfigFileProfileApt renders an apt.conf snippet with Acquire::http::Proxy and friends
+	ConfigFileProfileApt ConfigFileProfile = "apt"
+	// ConfigFileProfilePip renders a pip.conf with the global proxy
+	ConfigFileProfilePip ConfigFileProfile = "pip"
+	// ConfigFileProfileNpm renders a global npmrc with proxy, https-proxy and noproxy
+	ConfigFileProfileNpm ConfigFileProfile = "npm"
+	// ConfigFileProfileGit renders a system gitconfig with http.proxy
+	ConfigFileProfileGit ConfigFileProfile = "git"
+	// ConfigFileProfileMaven renders a global Maven settings.xml with the proxies
+	ConfigFileProfileMaven ConfigFileProfile = "maven"
+)
+
+// ConfigFileProfiles lists every supported profile, in the order they are rendered
+var ConfigFileProfiles = []ConfigFileProfile{
+	ConfigFileProfileApt,
+	ConfigFileProfilePip,
+	ConfigFileProfileNpm,
+	ConfigFileProfileGit,
+	ConfigFileProfileMaven,
+}
+
+// configFileLocations are the keys the profiles are rendered under in the generated ConfigMap,
+// and the conventional paths the files are mounted at
+var configFileLocations = map[ConfigFileProfile]struct{ key, path string }{
+	ConfigFileProfileApt:   {"apt.conf", "/etc/apt/apt.conf.d/99proxius-proxy"},
+	ConfigFileProfilePip:   {"pip.conf", "/etc/pip.conf"},
+	ConfigFileProfileNpm:   {"npmrc", "/usr/local/etc/npmrc"},
+	ConfigFileProfileGit:   {"gitconfig", "/etc/gitconfig"},
+	ConfigFileProfileMaven: {"settings.xml", "/usr/share/maven/conf/settings.xml"},
+}
+
+// Key returns the key the profile is rendered under in the generated ConfigMap,
+// or an empty string for an unknown profile
+func (p ConfigFileProfile) Key() string {
+	return configFileLocations[p].key
+}
+
+// MountPath returns the path the file of the profile is mounted at in containers,
+// or an empty string for an unknown profile
+func (p ConfigFileProfile) MountPath() string {
+	return configFileLocations[p].path
+}
@@ -0,0 +1,30 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+const (
+	// VariantKeyPrefix prefixes the keys of the helper variables rendered into the generated
+	// variants ConfigMap. They are kept apart from the proxy variables, which are injected
+	// whole through envFrom, so that containers only see the ones they are given explicitly.
+	VariantKeyPrefix = "PROXIUS_"
+
+	// JavaToolOptionsKey is the key under which the JVM system properties are rendered
+	// into the generated variants ConfigMap. The pod webhook defines it on the containers
+	// and appends "$(PROXIUS_JAVA_TOOL_OPTIONS)" to JAVA_TOOL_OPTIONS, so that Kubernetes
+	// expands it when starting the container.
+	JavaToolOptionsKey = VariantKeyPrefix + "JAVA_TOOL_OPTIONS"
+)
@@ -0,0 +1,41 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+// DeletionPolicy is what happens to the generated ConfigMap and Secret
+// when their ProxyDef is deleted while Pods still reference them
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyOrphan keeps the generated objects as they are, no longer owned by the ProxyDef
+	DeletionPolicyOrphan DeletionPolicy = "Orphan"
+	// DeletionPolicyBlockWhileInUse keeps the ProxyDef from going away until no Pod
+	// references the generated objects anymore
+	DeletionPolicyBlockWhileInUse DeletionPolicy = "BlockWhileInUse"
+	// DeletionPolicyCleanup deletes the generated objects, or empties them while Pods still reference them
+	DeletionPolicyCleanup DeletionPolicy = "Cleanup"
+)
+
+// DeletionPolicyOrDefault returns the DeletionPolicy of the spec, Cleanup by default
+func (s *ProxyDefSpec) DeletionPolicyOrDefault() DeletionPolicy {
+	switch s.DeletionPolicy {
+	case DeletionPolicyOrphan, DeletionPolicyBlockWhileInUse:
+		return s.DeletionPolicy
+	default:
+		return DeletionPolicyCleanup
+	}
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+// EnvConflictPolicy is how the proxy variables that a container defines itself in env
+// are resolved against the ones injected by Proxius
+type EnvConflictPolicy string
+
+const (
+	// EnvConflictPolicyRespectExisting keeps the container's own definition of a variable,
+	// and applies it to both its upper- and lower-case forms
+	EnvConflictPolicyRespectExisting EnvConflictPolicy = "respect-existing"
+	// EnvConflictPolicyOverride replaces the container's own definitions with the injected ones
+	EnvConflictPolicyOverride EnvConflictPolicy = "override"
+	// EnvConflictPolicyReject denies the admission of Pods with conflicting containers
+	EnvConflictPolicyReject EnvConflictPolicy = "reject"
+)
+
+// EnvConflictPolicyOrDefault returns the EnvConflictPolicy of the spec, respect-existing by default
+func (s *ProxyDefSpec) EnvConflictPolicyOrDefault() EnvConflictPolicy {
+	switch s.EnvConflictPolicy {
+	case EnvConflictPolicyOverride, EnvConflictPolicyReject:
+		return s.EnvConflictPolicy
+	default:
+		return EnvConflictPolicyRespectExisting
+	}
+}
+
+// ProxyVariables returns the upper-case names of the proxy variables rendered from the spec,
+// each of which is also rendered in lower case
+func (s *ProxyDefSpec) ProxyVariables() []string {
+	names := []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"}
+	if s.AllProxy != "" {
+		names = append(names, "ALL_PROXY")
+	}
+	if s.SocksProxy != "" {
+		names = append(names, "SOCKS_PROXY")
+	}
+	if s.FTPProxy != "" {
+		names = append(names, "FTP_PROXY")
+	}
+	return names
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+// InjectionFailureMode is how Pods depend on the objects generated for them, and so
+// what happens to Pods starting while those objects are missing
+type InjectionFailureMode string
+
+const (
+	// InjectionFailureModeRequired references the generated objects, so that containers
+	// do not start without them
+	InjectionFailureModeRequired InjectionFailureMode = "Required"
+	// InjectionFailureModeOptional references the generated objects as optional, so that
+	// containers start without a proxy when they are missing
+	InjectionFailureModeOptional InjectionFailureMode = "Optional"
+	// InjectionFailureModeInline copies the values of the generated ConfigMap into the Pod
+	// as literal environment variables when it is admitted, so that it no longer depends
+	// on the ConfigMap at all. Credentials are still referenced, as optional.
+	InjectionFailureModeInline InjectionFailureMode = "Inline"
+)
+
+// InjectionFailureModeOrDefault returns the InjectionFailureMode of the spec, Required by default
+func (s *ProxyDefSpec) InjectionFailureModeOrDefault() InjectionFailureMode {
+	switch s.InjectionFailureMode {
+	case InjectionFailureModeOptional, InjectionFailureModeInline:
+		return s.InjectionFailureMode
+	default:
+		return InjectionFailureModeRequired
+	}
+}
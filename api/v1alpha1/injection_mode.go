@@ -0,0 +1,36 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+// InjectionMode is where the proxy settings are injected: into Pods as they are created,
+// or into the Pod templates of the workloads creating them
+type InjectionMode string
+
+const (
+	// InjectionModePod injects Pods as they are created, leaving the workloads untouched
+	InjectionModePod InjectionMode = "Pod"
+	// InjectionModeWorkload injects the Pod templates of workloads, and keeps them in sync with the ProxyDef
+	InjectionModeWorkload InjectionMode = "Workload"
+)
+
+// InjectionModeOrDefault returns the InjectionMode of the spec, Pod by default
+func (s *ProxyDefSpec) InjectionModeOrDefault() InjectionMode {
+	if s.InjectionMode == InjectionModeWorkload {
+		return InjectionModeWorkload
+	}
+	return InjectionModePod
+}
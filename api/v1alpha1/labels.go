@@ -0,0 +1,24 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+const (
+	// GeneratedLabel is set to "true" on every ConfigMap and Secret generated by the controller.
+	// The manager only caches the ConfigMaps and Secrets carrying it, and reads the ones
+	// referenced by ProxyDefs and ClusterProxyDefs straight from the API server instead.
+	GeneratedLabel = "proxius.igordc.com/generated"
+)
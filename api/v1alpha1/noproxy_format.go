@@ -0,0 +1,53 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import "strings"
+
+// NoProxyFormat is a way of writing the NO_PROXY entries
+type NoProxyFormat string
+
+const (
+	// NoProxyFormatCIDR keeps CIDRs as-is, as understood by Go programs and recent curl
+	NoProxyFormatCIDR NoProxyFormat = "cidr"
+	// NoProxyFormatExpanded replaces the CIDRs of up to NoProxyExpansionLimit addresses
+	// with the individual addresses, for tools that only match exact IPs
+	NoProxyFormatExpanded NoProxyFormat = "expanded"
+	// NoProxyFormatWildcard adds a "*.example.com" form for every domain,
+	// for tools that only match wildcard patterns
+	NoProxyFormatWildcard NoProxyFormat = "wildcard"
+)
+
+// DefaultNoProxyExpansionLimit is the default of NoProxyExpansionLimit
+const DefaultNoProxyExpansionLimit = 256
+
+// NoProxyFormats lists every NoProxyFormat
+var NoProxyFormats = []NoProxyFormat{NoProxyFormatCIDR, NoProxyFormatExpanded, NoProxyFormatWildcard}
+
+// NoProxyVariantKey is the key under which the NO_PROXY variant of a format
+// is rendered into the generated variants ConfigMap
+func NoProxyVariantKey(format NoProxyFormat) string {
+	return VariantKeyPrefix + "NO_PROXY_" + strings.ToUpper(string(format))
+}
+
+// ExpansionLimit returns the largest number of addresses a CIDR is expanded into
+func (s *ProxyDefSpec) ExpansionLimit() int {
+	if s.NoProxyExpansionLimit < 1 {
+		return DefaultNoProxyExpansionLimit
+	}
+	return int(s.NoProxyExpansionLimit)
+}
@@ -0,0 +1,39 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+const (
+	// DefaultOpenShiftProxyName is the name of the Proxy holding the cluster-wide proxy of OpenShift
+	DefaultOpenShiftProxyName = "cluster"
+	// OpenShiftConfigNamespace is the namespace the trusted CA bundle of the Proxy is read from
+	OpenShiftConfigNamespace = "openshift-config"
+)
+
+// OpenShiftProxySource references the config.openshift.io/v1 Proxy that OpenShift
+// configures the cluster-wide proxy in
+type OpenShiftProxySource struct {
+	// Name of the Proxy. Defaults to "cluster", the only one OpenShift reads.
+	Name string `json:"name,omitempty"`
+}
+
+// NameOrDefault returns the name of the Proxy, defaulting to DefaultOpenShiftProxyName
+func (s *OpenShiftProxySource) NameOrDefault() string {
+	if s.Name == "" {
+		return DefaultOpenShiftProxyName
+	}
+	return s.Name
+}
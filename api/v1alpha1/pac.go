@@ -0,0 +1,33 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import "path"
+
+// PACFileName is the name proxy auto-config files are served under. WPAD clients
+// look for this name, and accept it from any URL they are given.
+const PACFileName = "wpad.dat"
+
+// ProxyDefPACPath returns the path the proxy auto-config file of a ProxyDef is served at
+func ProxyDefPACPath(namespace, name string) string {
+	return path.Join("/proxydefs", namespace, name, PACFileName)
+}
+
+// ClusterProxyDefPACPath returns the path the proxy auto-config file of a ClusterProxyDef is served at
+func ClusterProxyDefPACPath(name string) string {
+	return path.Join("/clusterproxydefs", name, PACFileName)
+}
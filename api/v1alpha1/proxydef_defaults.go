@@ -0,0 +1,87 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"net/url"
+	"strings"
+)
+
+// NoProxyBaseline lists the NO_PROXY entries that must never go through a proxy:
+// the loopback addresses and the in-cluster service domains
+var NoProxyBaseline = []string{"localhost", "127.0.0.1", "::1", ".svc", ".cluster.local"}
+
+// Default completes the spec: HTTPSProxy is filled from HTTPProxy when unset, the entries
+// of the given baseline missing from NoProxy are prepended to it, and proxy URLs are normalised.
+// Applying it more than once yields the same spec.
+func (s *ProxyDefSpec) Default(baseline []string) {
+	// Most proxies tunnel HTTPS through CONNECT on the same address, so it is a safe default.
+	// The proxies of a PAC source, or of the cluster-wide proxy of OpenShift, come from it instead.
+	if s.PACSource == nil && s.OpenShiftProxy == nil && s.HTTPSProxy == "" {
+		s.HTTPSProxy = s.HTTPProxy
+	}
+
+	// Proxies without a scheme are left for the validation to reject, unless ProxyProtocol tells it
+	s.HTTPProxy = normalizeProxyURL(s.HTTPProxy, s.ProxyProtocol)
+	s.HTTPSProxy = normalizeProxyURL(s.HTTPSProxy, s.ProxyProtocol)
+	s.AllProxy = normalizeProxyURL(s.AllProxy, "")
+	s.FTPProxy = normalizeProxyURL(s.FTPProxy, "")
+	s.SocksProxy = normalizeProxyURL(s.SocksProxy, "")
+
+	// The entries of the user are kept as written, and host names are case-insensitive
+	entries := SplitList(s.NoProxy)
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		seen[strings.ToLower(entry)] = true
+	}
+	missing := []string{}
+	for _, entry := range baseline {
+		if !seen[strings.ToLower(entry)] {
+			seen[strings.ToLower(entry)] = true
+			missing = append(missing, entry)
+		}
+	}
+	s.NoProxy = strings.Join(append(missing, entries...), ",")
+	s.NoProxyCIDRs = strings.Join(SplitList(s.NoProxyCIDRs), ",")
+}
+
+// normalizeProxyURL trims a proxy URL, lower-cases its scheme and host, and drops an empty
+// path. A URL without a scheme is given the default one, unless the default is empty.
+// Values that cannot be parsed are left for the validation to reject.
+func normalizeProxyURL(value, defaultScheme string) string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return ""
+	}
+	raw := value
+	if !strings.Contains(value, "://") {
+		if defaultScheme == "" {
+			return value
+		}
+		raw = defaultScheme + "://" + value
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return value
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if u.Path == "/" && u.RawQuery == "" && u.Fragment == "" {
+		u.Path = ""
+	}
+	return u.String()
+}
@@ -31,26 +31,124 @@ type ProxyDefSpec struct {
 	HTTPSProxy string `json:"httpsProxy,omitempty"`
 	NoProxy    string `json:"noProxy,omitempty"`
 
-	// TODO: Not implemented yet
+	// PodSelector restricts injection to the Pods matching it.
+	// An empty or missing selector selects every Pod.
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+	// IncludeContainers lists the names of the only containers to inject into.
+	// When empty, every container of a selected Pod is injected.
+	IncludeContainers []string `json:"includeContainers,omitempty"`
+	// ExcludeContainers lists the names of containers never to inject into,
+	// such as sidecars or the proxy itself. It takes precedence over IncludeContainers.
+	ExcludeContainers []string `json:"excludeContainers,omitempty"`
+	// InjectEphemeralContainers opts into injecting ephemeral containers too,
+	// such as the ones added by "kubectl debug". Init containers are always injected.
+	InjectEphemeralContainers bool `json:"injectEphemeralContainers,omitempty"`
+
+	// AllProxy is the proxy used for every protocol that has no proxy of its own,
+	// rendered as ALL_PROXY/all_proxy. Its scheme may be http, https or any SOCKS variant.
 	AllProxy string `json:"allProxy,omitempty"`
-	// TODO: Not implemented yet
+	// NoProxyCIDRs is a comma-separated list of CIDRs that bypass the proxy,
+	// merged into NO_PROXY/no_proxy after NoProxy.
 	NoProxyCIDRs string `json:"noProxyCidrs,omitempty"`
-	// TODO: Not implemented yet
+	// DiscoverNoProxy merges the cluster's own networking into NO_PROXY/no_proxy:
+	// the ClusterIP of the "kubernetes" Service, the service subnet and DNS domain
+	// (read from the kubeadm-config ConfigMap when available), and the pod CIDRs
+	// and internal IPs of every node, kept up to date as nodes join or leave.
+	DiscoverNoProxy bool `json:"discoverNoProxy,omitempty"`
+	// NoProxyFormat is how NO_PROXY/no_proxy is written for the tools reading it.
+	// When set, every format is also rendered as a variant that Pods can select per
+	// container with the no-proxy-format annotation. Defaults to leaving CIDRs as-is.
+	// +kubebuilder:validation:Enum=cidr;expanded;wildcard
+	NoProxyFormat NoProxyFormat `json:"noProxyFormat,omitempty"`
+	// NoProxyExpansionLimit is the largest number of addresses a CIDR is expanded into
+	// by the "expanded" format; larger CIDRs are kept as-is. Defaults to 256.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=4096
+	NoProxyExpansionLimit int32 `json:"noProxyExpansionLimit,omitempty"`
+	// SocksProxy is the SOCKS proxy, rendered as SOCKS_PROXY/socks_proxy.
+	// A value without a scheme is rendered as socks5h://, so that names are resolved by the proxy.
 	SocksProxy string `json:"socksProxy,omitempty"`
-	// TODO: Not implemented yet
+	// FTPProxy is the proxy used for FTP, rendered as FTP_PROXY/ftp_proxy.
+	// Its scheme may be http, https or ftp.
 	FTPProxy string `json:"ftpProxy,omitempty"`
-	// TODO: Not implemented yet
+	// CredentialsSecretRef references a Secret holding the "username" and "password"
+	// used to authenticate against the proxies. The credentials are embedded into the
+	// proxy URLs of a generated Secret, never into the generated ConfigMap.
+	CredentialsSecretRef *CredentialsSecretReference `json:"credentialsSecretRef,omitempty"`
+	// RolloutPolicy opts into restarting the workloads whose Pods were injected
+	// whenever the rendered proxy configuration or the referenced credentials change,
+	// since Pods only read their environment when they start.
+	RolloutPolicy *RolloutPolicy `json:"rolloutPolicy,omitempty"`
+	// PACSource is an existing proxy auto-config (PAC) file to derive the proxies from.
+	// Its rules are evaluated by the controller, and the proxies they choose take
+	// precedence over HTTPProxy and HTTPSProxy, while the hosts and networks they
+	// send DIRECT are appended to NO_PROXY.
+	PACSource *PACSource `json:"pacSource,omitempty"`
+	// OpenShiftProxy mirrors the cluster-wide proxy that OpenShift configures in a
+	// config.openshift.io/v1 Proxy. Its proxies take precedence over HTTPProxy and HTTPSProxy,
+	// and its effective NO_PROXY is appended to NoProxy. Its trusted CA bundle is distributed
+	// unless TrustedCA is set, and the credentials embedded into its proxy URLs go to the
+	// generated Secret unless CredentialsSecretRef is set.
+	OpenShiftProxy *OpenShiftProxySource `json:"openShiftProxy,omitempty"`
+	// Deprecated: plaintext credentials are never rendered, use CredentialsSecretRef instead.
 	ProxyUser string `json:"proxyUser,omitempty"`
-	// TODO: Not implemented yet
+	// Deprecated: plaintext credentials are never rendered, use CredentialsSecretRef instead.
 	ProxyPassword string `json:"proxyPassword,omitempty"`
-	// TODO: Not implemented yet
+	// InjectJavaToolOptions opts into rendering the proxy as JVM system properties,
+	// which the pod webhook appends to the JAVA_TOOL_OPTIONS of every injected container.
+	InjectJavaToolOptions bool `json:"injectJavaToolOptions,omitempty"`
+	// ProxyProtocol is the scheme assumed for HTTPProxy and HTTPSProxy when they have none,
+	// when deriving the JVM system properties. Defaults to http.
+	// +kubebuilder:validation:Enum=http;https
 	ProxyProtocol string `json:"proxyProtocol,omitempty"`
-	// TODO: Not implemented yet
+	// ProxyPort is the port assumed for HTTPProxy and HTTPSProxy when they have none,
+	// when deriving the JVM system properties. Defaults to the port of the scheme.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
 	ProxyPort int `json:"proxyPort,omitempty"`
-	// TODO: Not implemented yet
+	// NonProxyHosts lists further hosts that bypass the proxy in the JVM, in the
+	// pipe-separated, wildcard syntax of http.nonProxyHosts (e.g. "*.internal|10.*").
+	// They are appended to the translation of NO_PROXY.
 	NonProxyHosts string `json:"nonProxyHosts,omitempty"`
-	// TODO: Not implemented yet
+	// AutoDetect serves a proxy auto-config (PAC) file derived from the proxies and
+	// NO_PROXY, for browsers and other PAC-aware clients. Its URL, which is also
+	// suitable as a WPAD URL, is published in the status as pacURL.
 	AutoDetect bool `json:"autoDetect,omitempty"`
+	// DeletionPolicy is what happens to the generated ConfigMap and Secret when the ProxyDef
+	// is deleted while Pods still reference them: Orphan keeps them, BlockWhileInUse holds
+	// the deletion back until no Pod does, and Cleanup leaves them behind with every value
+	// emptied. Defaults to Cleanup. A ClusterProxyDef applies it namespace by namespace.
+	// +kubebuilder:validation:Enum=Orphan;BlockWhileInUse;Cleanup
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+	// InjectionFailureMode is how injected Pods depend on the generated ConfigMap and Secret:
+	// Required references them, so that containers do not start while they are missing,
+	// Optional references them as optional, and Inline copies the values of the ConfigMap
+	// into the Pod when it is admitted. Defaults to Required.
+	// +kubebuilder:validation:Enum=Required;Optional;Inline
+	InjectionFailureMode InjectionFailureMode `json:"injectionFailureMode,omitempty"`
+	// InjectionMode is where the proxy settings are injected: Pod injects Pods as they are
+	// created, and Workload injects the Pod templates of Deployments, StatefulSets, DaemonSets,
+	// Jobs and CronJobs instead, keeping them in sync as the ProxyDef changes. It cannot be
+	// combined with the Inline InjectionFailureMode. Defaults to Pod.
+	// +kubebuilder:validation:Enum=Pod;Workload
+	InjectionMode InjectionMode `json:"injectionMode,omitempty"`
+	// EnvConflictPolicy is how the proxy variables that a container defines itself in env are
+	// resolved: respect-existing keeps the container's own value for both the upper- and
+	// lower-case forms, override replaces it with the injected one, and reject denies the Pod.
+	// Conflicts are reported as admission warnings and in the env-conflicts annotation of the
+	// Pod. Defaults to respect-existing.
+	// +kubebuilder:validation:Enum=respect-existing;override;reject
+	EnvConflictPolicy EnvConflictPolicy `json:"envConflictPolicy,omitempty"`
+	// TrustedCA is a bundle of CA certificates that injected containers must trust, such as
+	// the root CA of a TLS-intercepting proxy. It is copied into a generated ConfigMap,
+	// mounted into containers, and pointed at by SSL_CERT_FILE and the like.
+	TrustedCA *TrustedCA `json:"trustedCA,omitempty"`
+	// ConfigFiles lists the tools whose proxy configuration files are rendered into a
+	// generated ConfigMap and mounted at their conventional paths, for the tools that
+	// ignore the proxy environment variables. Files that containers already mount
+	// are left alone. It cannot be combined with credentials.
+	// +listType=set
+	ConfigFiles []ConfigFileProfile `json:"configFiles,omitempty"`
 }
 
 // ProxyDefStatus defines the observed state of ProxyDef
@@ -67,6 +165,106 @@ type ProxyDefStatus struct {
 	// Conditions store the status conditions of the ProxyDef instances
 	// +operator-sdk:csv:customresourcedefinitions:type=status
 	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type" protobuf:"bytes,1,rep,name=conditions"`
+
+	// ConfigMapName is the name of the ConfigMap generated from this ProxyDef,
+	// which is what the pod webhook injects into containers
+	// +operator-sdk:csv:customresourcedefinitions:type=status
+	ConfigMapName string `json:"configMapName,omitempty"`
+
+	// SecretName is the name of the Secret generated from this ProxyDef when it has
+	// credentials, which the pod webhook injects into containers next to the ConfigMap
+	// +operator-sdk:csv:customresourcedefinitions:type=status
+	SecretName string `json:"secretName,omitempty"`
+
+	// ConfigHash identifies the current proxy configuration, including the revision
+	// of the referenced credentials. Injected Pods are annotated with it.
+	// +operator-sdk:csv:customresourcedefinitions:type=status
+	ConfigHash string `json:"configHash,omitempty"`
+
+	// PACURL is where the proxy auto-config file of this ProxyDef is served
+	// when autoDetect is set
+	// +operator-sdk:csv:customresourcedefinitions:type=status
+	PACURL string `json:"pacURL,omitempty"`
+
+	// TrustedCAConfigMapName is the name of the ConfigMap generated from this ProxyDef
+	// with the trusted CA bundle, which the pod webhook mounts into containers
+	// +operator-sdk:csv:customresourcedefinitions:type=status
+	TrustedCAConfigMapName string `json:"trustedCAConfigMapName,omitempty"`
+
+	// ConfigFilesConfigMapName is the name of the ConfigMap generated from this ProxyDef
+	// with the tool configuration files, which the pod webhook mounts into containers
+	// +operator-sdk:csv:customresourcedefinitions:type=status
+	ConfigFilesConfigMapName string `json:"configFilesConfigMapName,omitempty"`
+
+	// VariantsConfigMapName is the name of the ConfigMap generated from this ProxyDef
+	// with the helper variables the pod webhook references for noProxyFormat and injectJavaToolOptions
+	// +operator-sdk:csv:customresourcedefinitions:type=status
+	VariantsConfigMapName string `json:"variantsConfigMapName,omitempty"`
+}
+
+// RolloutPolicy configures the rolling restart of workloads on configuration changes
+type RolloutPolicy struct {
+	// Enabled restarts the Deployments, StatefulSets and DaemonSets whose Pods were
+	// injected with an outdated configuration, by stamping the configuration hash
+	// onto their Pod templates.
+	Enabled bool `json:"enabled,omitempty"`
+	// MaxConcurrency is the maximum number of workloads restarting at the same time.
+	// Defaults to 1.
+	// +kubebuilder:validation:Minimum=1
+	MaxConcurrency int32 `json:"maxConcurrency,omitempty"`
+}
+
+// MaxConcurrentRollouts returns the maximum number of workloads restarting at the same time
+func (p *RolloutPolicy) MaxConcurrentRollouts() int {
+	if p == nil || p.MaxConcurrency < 1 {
+		return 1
+	}
+	return int(p.MaxConcurrency)
+}
+
+// CredentialsSecretReference references a Secret with "username" and "password" keys
+type CredentialsSecretReference struct {
+	// Name of the Secret.
+	Name string `json:"name"`
+	// Namespace of the Secret. It is required by ClusterProxyDef and ignored by ProxyDef,
+	// which can only reference Secrets of its own namespace.
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// PACSource locates a proxy auto-config file. Exactly one of its fields must be set.
+type PACSource struct {
+	// Inline is the content of the PAC file.
+	Inline string `json:"inline,omitempty"`
+	// ConfigMapRef selects the key of a ConfigMap holding the PAC file.
+	ConfigMapRef *PACConfigMapReference `json:"configMapRef,omitempty"`
+	// URL is where the PAC file is downloaded from, over https, and again periodically.
+	// Since the controller downloads it from within the cluster on behalf of whoever can
+	// create a ProxyDef, loopback and link-local addresses, such as the metadata endpoints
+	// of cloud providers, are refused, and the manager can restrict the hosts allowed.
+	// +kubebuilder:validation:Pattern=`^https://`
+	URL string `json:"url,omitempty"`
+}
+
+// PACConfigMapReference references the key of a ConfigMap holding a PAC file
+type PACConfigMapReference struct {
+	// Name of the ConfigMap.
+	Name string `json:"name"`
+	// Namespace of the ConfigMap. It is required by ClusterProxyDef and ignored by ProxyDef,
+	// which can only reference ConfigMaps of its own namespace.
+	Namespace string `json:"namespace,omitempty"`
+	// Key of the ConfigMap holding the PAC file, "proxy.pac" by default.
+	Key string `json:"key,omitempty"`
+}
+
+// DefaultPACConfigMapKey is the ConfigMap key read when a PACConfigMapReference sets none
+const DefaultPACConfigMapKey = "proxy.pac"
+
+// KeyOrDefault returns the key of the ConfigMap holding the PAC file
+func (r *PACConfigMapReference) KeyOrDefault() string {
+	if r.Key == "" {
+		return DefaultPACConfigMapKey
+	}
+	return r.Key
 }
 
 //+kubebuilder:object:root=true
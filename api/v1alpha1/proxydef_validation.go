@@ -0,0 +1,400 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	metav1validation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// DefaultSocksScheme is assumed for SOCKS proxies given without a scheme.
+// socks5h makes the proxy resolve host names, which is what clusters behind a proxy need.
+const DefaultSocksScheme = "socks5h"
+
+var (
+	// socksSchemes are the schemes understood by SOCKS-aware tools such as curl
+	socksSchemes = []string{"socks4", "socks4a", "socks5", "socks5h"}
+	// allProxySchemes are the schemes accepted for ALL_PROXY
+	allProxySchemes = append([]string{"http", "https"}, socksSchemes...)
+	// ftpProxySchemes are the schemes accepted for FTP_PROXY
+	ftpProxySchemes = []string{"http", "https", "ftp"}
+	// proxySchemes are the schemes accepted for HTTP_PROXY and HTTPS_PROXY
+	proxySchemes = allProxySchemes
+)
+
+// SocksProxyURL returns the SOCKS proxy URL, defaulting its scheme to DefaultSocksScheme
+func (s *ProxyDefSpec) SocksProxyURL() string {
+	if s.SocksProxy == "" || strings.Contains(s.SocksProxy, "://") {
+		return s.SocksProxy
+	}
+	return DefaultSocksScheme + "://" + s.SocksProxy
+}
+
+// ValidateProxySchemes checks that the scheme of every protocol-specific proxy URL
+// of the spec matches the field it was set on
+func (s *ProxyDefSpec) ValidateProxySchemes(path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	allErrs = append(allErrs, validateProxyScheme(path.Child("allProxy"), s.AllProxy, allProxySchemes)...)
+	allErrs = append(allErrs, validateProxyScheme(path.Child("socksProxy"), s.SocksProxyURL(), socksSchemes)...)
+	allErrs = append(allErrs, validateProxyScheme(path.Child("ftpProxy"), s.FTPProxy, ftpProxySchemes)...)
+	return allErrs
+}
+
+// Validate checks the parts of the spec that the controller cannot render when invalid
+func (s *ProxyDefSpec) Validate(path *field.Path) field.ErrorList {
+	allErrs := s.ValidateProxySchemes(path)
+	allErrs = append(allErrs, s.ValidateNoProxyCIDRs(path)...)
+	allErrs = append(allErrs, s.ValidateNoProxyFormat(path)...)
+	allErrs = append(allErrs, s.ValidatePACSource(path)...)
+	allErrs = append(allErrs, s.ValidateTrustedCA(path)...)
+	allErrs = append(allErrs, s.ValidateConfigFiles(path)...)
+	return allErrs
+}
+
+// ValidatePACSource checks that PACSource, when set, locates the PAC file in exactly one way
+func (s *ProxyDefSpec) ValidatePACSource(path *field.Path) field.ErrorList {
+	if s.PACSource == nil {
+		return nil
+	}
+	path = path.Child("pacSource")
+	set := []string{}
+	if s.PACSource.Inline != "" {
+		set = append(set, "inline")
+	}
+	if s.PACSource.ConfigMapRef != nil {
+		set = append(set, "configMapRef")
+	}
+	if s.PACSource.URL != "" {
+		set = append(set, "url")
+	}
+	switch len(set) {
+	case 0:
+		return field.ErrorList{field.Required(path, "one of inline, configMapRef or url must be set")}
+	case 1:
+	default:
+		return field.ErrorList{field.Invalid(path, strings.Join(set, ", "), "only one of inline, configMapRef or url may be set")}
+	}
+	if s.PACSource.URL == "" {
+		return nil
+	}
+	if u, err := url.Parse(s.PACSource.URL); err != nil || u.Scheme != "https" || u.Host == "" {
+		return field.ErrorList{field.Invalid(path.Child("url"), s.PACSource.URL, "must be an https:// URL")}
+	}
+	return nil
+}
+
+// ValidateTrustedCA checks that TrustedCA, when set, references exactly one named object
+func (s *ProxyDefSpec) ValidateTrustedCA(path *field.Path) field.ErrorList {
+	if s.TrustedCA == nil {
+		return nil
+	}
+	path = path.Child("trustedCA")
+	switch {
+	case s.TrustedCA.ConfigMapRef == nil && s.TrustedCA.SecretRef == nil:
+		return field.ErrorList{field.Required(path, "one of configMapRef or secretRef must be set")}
+	case s.TrustedCA.ConfigMapRef != nil && s.TrustedCA.SecretRef != nil:
+		return field.ErrorList{field.Invalid(path, "configMapRef, secretRef", "only one of configMapRef or secretRef may be set")}
+	}
+	ref, _, secret := s.TrustedCA.Reference()
+	if ref.Name == "" {
+		child := "configMapRef"
+		if secret {
+			child = "secretRef"
+		}
+		return field.ErrorList{field.Required(path.Child(child, "name"), "")}
+	}
+	return nil
+}
+
+// ValidateConfigFiles checks that every profile of ConfigFiles is supported, and that the
+// spec has no credentials, which the generated ConfigMap must not hold
+func (s *ProxyDefSpec) ValidateConfigFiles(path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	supported := make([]string, 0, len(ConfigFileProfiles))
+	for _, profile := range ConfigFileProfiles {
+		supported = append(supported, string(profile))
+	}
+	for i, profile := range s.ConfigFiles {
+		if profile.Key() == "" {
+			allErrs = append(allErrs, field.NotSupported(path.Child("configFiles").Index(i), profile, supported))
+		}
+	}
+	if len(s.ConfigFiles) > 0 && s.CredentialsSecretRef != nil {
+		allErrs = append(allErrs, field.Forbidden(path.Child("configFiles"), "may not be combined with credentialsSecretRef, since the files are rendered into a ConfigMap"))
+	}
+	return allErrs
+}
+
+// ValidateNoProxyFormat checks that NoProxyFormat, when set, is one of NoProxyFormats
+func (s *ProxyDefSpec) ValidateNoProxyFormat(path *field.Path) field.ErrorList {
+	if s.NoProxyFormat == "" {
+		return nil
+	}
+	supported := make([]string, 0, len(NoProxyFormats))
+	for _, format := range NoProxyFormats {
+		if s.NoProxyFormat == format {
+			return nil
+		}
+		supported = append(supported, string(format))
+	}
+	return field.ErrorList{field.NotSupported(path.Child("noProxyFormat"), s.NoProxyFormat, supported)}
+}
+
+// ValidateNoProxyCIDRs checks that every entry of NoProxyCIDRs is a CIDR
+func (s *ProxyDefSpec) ValidateNoProxyCIDRs(path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	for _, cidr := range SplitList(s.NoProxyCIDRs) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			allErrs = append(allErrs, field.Invalid(path.Child("noProxyCidrs"), cidr, "must be a CIDR such as 10.0.0.0/8"))
+		}
+	}
+	return allErrs
+}
+
+// SplitList splits a comma-separated list, such as NoProxy, dropping blank entries
+func SplitList(list string) []string {
+	entries := []string{}
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// validateProxyScheme checks that a proxy URL, when set, has a host and one of the given schemes
+func validateProxyScheme(path *field.Path, value string, schemes []string) field.ErrorList {
+	if value == "" {
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return field.ErrorList{field.Invalid(path, value, err.Error())}
+	}
+	if u.Host == "" {
+		return field.ErrorList{field.Invalid(path, value, "must be a URL of the form <scheme>://<host>[:<port>]")}
+	}
+	for _, scheme := range schemes {
+		if strings.EqualFold(u.Scheme, scheme) {
+			return nil
+		}
+	}
+	return field.ErrorList{field.NotSupported(path, u.Scheme, schemes)}
+}
+
+// noProxyHost matches the host names, domains (".example.com") and wildcard domains
+// ("*.example.com") of NO_PROXY entries
+var noProxyHost = regexp.MustCompile(`^(\*?\.)?[A-Za-z0-9_]([A-Za-z0-9_-]*[A-Za-z0-9_])?(\.[A-Za-z0-9_]([A-Za-z0-9_-]*[A-Za-z0-9_])?)*\.?$`)
+
+// nonProxyHost matches the wildcard host patterns of http.nonProxyHosts, such as "*.internal" or "10.*"
+var nonProxyHost = regexp.MustCompile(`^[A-Za-z0-9_.*:\[\]-]+$`)
+
+// ValidateAdmission checks every field of the spec, returning the errors that make it
+// unusable along with warnings about settings that are accepted but have no effect or
+// are likely mistakes. It is stricter than Validate, which the controller keeps using
+// so that the objects admitted before the webhook was installed are still rendered.
+func (s *ProxyDefSpec) ValidateAdmission(path *field.Path) (field.ErrorList, []string) {
+	allErrs := s.Validate(path)
+	warnings := []string{}
+
+	// An explicit proxyProtocol is what tells which scheme a proxy without one was meant to have
+	allErrs = append(allErrs, validateProxyURL(path.Child("httpProxy"), s.HTTPProxy, s.ProxyProtocol != "", proxySchemes)...)
+	allErrs = append(allErrs, validateProxyURL(path.Child("httpsProxy"), s.HTTPSProxy, s.ProxyProtocol != "", proxySchemes)...)
+	// The schemes of the other proxies are checked by Validate already
+	allErrs = append(allErrs, validateProxyURL(path.Child("allProxy"), s.AllProxy, true, nil)...)
+	allErrs = append(allErrs, validateProxyURL(path.Child("socksProxy"), s.SocksProxyURL(), true, nil)...)
+	allErrs = append(allErrs, validateProxyURL(path.Child("ftpProxy"), s.FTPProxy, true, nil)...)
+
+	for _, entry := range SplitList(s.NoProxy) {
+		if !validNoProxyEntry(entry) {
+			allErrs = append(allErrs, field.Invalid(path.Child("noProxy"), entry, "must be *, a host name, a domain such as .example.com, an IP address or a CIDR, optionally followed by :<port>"))
+		}
+	}
+	for _, host := range strings.Split(s.NonProxyHosts, "|") {
+		if host != "" && !nonProxyHost.MatchString(host) {
+			allErrs = append(allErrs, field.Invalid(path.Child("nonProxyHosts"), host, "must be a host pattern such as *.internal or 10.*, separated from the others by |"))
+		}
+	}
+
+	if s.ProxyPort < 0 || s.ProxyPort > 65535 {
+		allErrs = append(allErrs, field.Invalid(path.Child("proxyPort"), s.ProxyPort, "must be between 1 and 65535"))
+	}
+	if s.ProxyProtocol != "" && s.ProxyProtocol != "http" && s.ProxyProtocol != "https" {
+		allErrs = append(allErrs, field.NotSupported(path.Child("proxyProtocol"), s.ProxyProtocol, []string{"http", "https"}))
+	}
+	if s.NoProxyExpansionLimit < 0 {
+		allErrs = append(allErrs, field.Invalid(path.Child("noProxyExpansionLimit"), s.NoProxyExpansionLimit, "must be positive"))
+	}
+
+	if s.PodSelector != nil {
+		allErrs = append(allErrs, metav1validation.ValidateLabelSelector(s.PodSelector, metav1validation.LabelSelectorValidationOptions{}, path.Child("podSelector"))...)
+	}
+	excluded := map[string]bool{}
+	for i, name := range s.ExcludeContainers {
+		allErrs = append(allErrs, validateContainerName(path.Child("excludeContainers").Index(i), name)...)
+		excluded[name] = true
+	}
+	for i, name := range s.IncludeContainers {
+		allErrs = append(allErrs, validateContainerName(path.Child("includeContainers").Index(i), name)...)
+		if excluded[name] {
+			warnings = append(warnings, fmt.Sprintf("%s: container %q is also excluded, so it is never injected", path.Child("includeContainers").Index(i), name))
+		}
+	}
+
+	if s.ProxyPassword != "" && s.ProxyUser == "" {
+		allErrs = append(allErrs, field.Required(path.Child("proxyUser"), "must be set along with proxyPassword"))
+	}
+	if s.CredentialsSecretRef != nil {
+		if s.CredentialsSecretRef.Name == "" {
+			allErrs = append(allErrs, field.Required(path.Child("credentialsSecretRef", "name"), ""))
+		}
+		for _, deprecated := range []struct{ name, value string }{{"proxyUser", s.ProxyUser}, {"proxyPassword", s.ProxyPassword}} {
+			if deprecated.value != "" {
+				allErrs = append(allErrs, field.Forbidden(path.Child(deprecated.name), "must not be set along with credentialsSecretRef"))
+			}
+		}
+	} else if s.ProxyUser != "" || s.ProxyPassword != "" {
+		warnings = append(warnings, fmt.Sprintf("%s, %s: deprecated and ignored, use %s instead", path.Child("proxyUser"), path.Child("proxyPassword"), path.Child("credentialsSecretRef")))
+	}
+
+	if s.PACSource != nil {
+		// The proxies of a PAC source take precedence, so setting them as well is ambiguous
+		for _, proxy := range []struct{ name, value string }{{"httpProxy", s.HTTPProxy}, {"httpsProxy", s.HTTPSProxy}} {
+			if proxy.value != "" {
+				allErrs = append(allErrs, field.Forbidden(path.Child(proxy.name), "must not be set along with pacSource, which the proxies are derived from"))
+			}
+		}
+		if ref := s.PACSource.ConfigMapRef; ref != nil && ref.Name == "" {
+			allErrs = append(allErrs, field.Required(path.Child("pacSource", "configMapRef", "name"), ""))
+		}
+		if s.OpenShiftProxy != nil {
+			allErrs = append(allErrs, field.Forbidden(path.Child("openShiftProxy"), "must not be set along with pacSource"))
+		}
+	} else if s.OpenShiftProxy != nil {
+		// Likewise for the proxies mirrored from the cluster-wide proxy of OpenShift
+		for _, proxy := range []struct{ name, value string }{{"httpProxy", s.HTTPProxy}, {"httpsProxy", s.HTTPSProxy}} {
+			if proxy.value != "" {
+				allErrs = append(allErrs, field.Forbidden(path.Child(proxy.name), "must not be set along with openShiftProxy, which the proxies are mirrored from"))
+			}
+		}
+	} else if s.HTTPProxy == "" && s.HTTPSProxy == "" && s.AllProxy == "" && s.SocksProxy == "" && s.FTPProxy == "" {
+		warnings = append(warnings, fmt.Sprintf("%s: no proxy is set, so only NO_PROXY is injected", path))
+	}
+
+	// Literal values copied into Pod templates could not be told apart from the workload's own
+	// ones anymore, and so could not be kept in sync with the ProxyDef
+	if s.InjectionModeOrDefault() == InjectionModeWorkload && s.InjectionFailureMode == InjectionFailureModeInline {
+		allErrs = append(allErrs, field.Forbidden(path.Child("injectionFailureMode"), "Inline may not be combined with the Workload injectionMode"))
+	}
+
+	if s.NoProxyExpansionLimit != 0 && s.NoProxyFormat == "" {
+		warnings = append(warnings, fmt.Sprintf("%s: has no effect unless %s is set", path.Child("noProxyExpansionLimit"), path.Child("noProxyFormat")))
+	}
+	if !s.InjectJavaToolOptions && s.NonProxyHosts != "" {
+		warnings = append(warnings, fmt.Sprintf("%s: has no effect unless %s is set", path.Child("nonProxyHosts"), path.Child("injectJavaToolOptions")))
+	}
+	if p := s.RolloutPolicy; p != nil && !p.Enabled && p.MaxConcurrency != 0 {
+		warnings = append(warnings, fmt.Sprintf("%s: has no effect unless %s is set", path.Child("rolloutPolicy", "maxConcurrency"), path.Child("rolloutPolicy", "enabled")))
+	}
+	return allErrs, warnings
+}
+
+// validateProxyURL checks that a proxy URL, when set, is made of a host and an optional
+// port and scheme only. A scheme is required unless schemeless is set, and must be one
+// of the given schemes, unless none are given.
+func validateProxyURL(path *field.Path, value string, schemeless bool, schemes []string) field.ErrorList {
+	if value == "" {
+		return nil
+	}
+	raw := value
+	if !strings.Contains(value, "://") {
+		if !schemeless {
+			return field.ErrorList{field.Invalid(path, value, "must include a scheme such as http://, unless proxyProtocol is set")}
+		}
+		raw = "http://" + value
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return field.ErrorList{field.Invalid(path, value, err.Error())}
+	}
+	allErrs := field.ErrorList{}
+	if schemes != nil && !containsFold(schemes, u.Scheme) {
+		allErrs = append(allErrs, field.NotSupported(path, u.Scheme, schemes))
+	}
+	if u.User != nil {
+		allErrs = append(allErrs, field.Forbidden(path, "must not embed credentials, which would be rendered into a ConfigMap; use credentialsSecretRef instead"))
+	}
+	if u.Hostname() == "" {
+		allErrs = append(allErrs, field.Invalid(path, value, "must be a URL of the form <scheme>://<host>[:<port>]"))
+	}
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			allErrs = append(allErrs, field.Invalid(path, value, "port must be between 1 and 65535"))
+		}
+	} else if strings.HasSuffix(u.Host, ":") {
+		allErrs = append(allErrs, field.Invalid(path, value, "port must not be empty"))
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		allErrs = append(allErrs, field.Invalid(path, value, "must not have a path, query or fragment"))
+	}
+	return allErrs
+}
+
+// validNoProxyEntry reports whether a NO_PROXY entry is one that tools understand
+func validNoProxyEntry(entry string) bool {
+	if entry == "*" {
+		return true
+	}
+	if _, _, err := net.ParseCIDR(entry); err == nil {
+		return true
+	}
+	host := entry
+	if h, port, err := net.SplitHostPort(entry); err == nil {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return false
+		}
+		host = h
+	}
+	return net.ParseIP(host) != nil || noProxyHost.MatchString(host)
+}
+
+// validateContainerName checks that a container name is a DNS label, as Kubernetes requires
+func validateContainerName(path *field.Path, name string) field.ErrorList {
+	allErrs := field.ErrorList{}
+	for _, msg := range validation.IsDNS1123Label(name) {
+		allErrs = append(allErrs, field.Invalid(path, name, msg))
+	}
+	return allErrs
+}
+
+// containsFold reports whether a list contains a value, ignoring case
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
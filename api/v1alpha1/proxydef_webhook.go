@@ -0,0 +1,134 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// log is for logging in this package.
+var proxydeflog = logf.Log.WithName("proxydef-resource")
+
+// SetupWebhookWithManager registers the ProxyDef webhooks with the Manager
+func (r *ProxyDef) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		WithDefaulter(&ProxyDefDefaulter{Client: mgr.GetAPIReader()}).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-proxy-igordc-com-v1alpha1-proxydef,mutating=true,failurePolicy=fail,sideEffects=None,groups=proxy.igordc.com,resources=proxydefs,verbs=create,versions=v1alpha1,name=mproxydef.kb.io,admissionReviewVersions=v1
+
+// ProxyDefDefaulter completes the ProxyDefs users create: it fills HTTPSProxy from HTTPProxy,
+// prepends the entries that must never go through a proxy to NoProxy, and normalises URLs.
+// Updates are left alone, so that users can undo any of it.
+// It needs a client to look up the ClusterIP of the kubernetes Service.
+type ProxyDefDefaulter struct {
+	Client client.Reader
+}
+
+var _ admission.CustomDefaulter = &ProxyDefDefaulter{}
+
+// Default implements admission.CustomDefaulter so a webhook will be registered for the type
+func (d *ProxyDefDefaulter) Default(ctx context.Context, obj runtime.Object) error {
+	proxydef, ok := obj.(*ProxyDef)
+	if !ok {
+		return fmt.Errorf("expected a ProxyDef but got a %T", obj)
+	}
+	if req, err := admission.RequestFromContext(ctx); err == nil && req.Operation != admissionv1.Create {
+		return nil
+	}
+	proxydeflog.Info("default", "name", proxydef.Name)
+
+	// Without the ClusterIP of the kubernetes Service, the rest of the baseline still applies
+	baseline := NoProxyBaseline
+	service := &corev1.Service{}
+	if err := d.Client.Get(ctx, client.ObjectKey{Namespace: metav1.NamespaceDefault, Name: "kubernetes"}, service); err == nil {
+		baseline = append(append([]string{}, baseline...), service.Spec.ClusterIPs...)
+	} else {
+		proxydeflog.Info("Failed to get the kubernetes Service, leaving its ClusterIP out of noProxy", "err", err)
+	}
+
+	proxydef.Spec.Default(baseline)
+	return nil
+}
+
+//+kubebuilder:webhook:path=/validate-proxy-igordc-com-v1alpha1-proxydef,mutating=false,failurePolicy=fail,sideEffects=None,groups=proxy.igordc.com,resources=proxydefs,verbs=create;update,versions=v1alpha1,name=vproxydef.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Validator = &ProxyDef{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *ProxyDef) ValidateCreate() (admission.Warnings, error) {
+	proxydeflog.Info("validate create", "name", r.Name)
+
+	return r.validateProxyDef()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *ProxyDef) ValidateUpdate(old runtime.Object) (admission.Warnings, error) {
+	proxydeflog.Info("validate update", "name", r.Name)
+
+	// Adding or removing the finalizer must not be held back by a spec that was stored before
+	// it became invalid, or the ProxyDef could never be deleted
+	if r.DeletionTimestamp != nil {
+		return nil, nil
+	}
+	if oldProxyDef, ok := old.(*ProxyDef); ok && equality.Semantic.DeepEqual(r.Spec, oldProxyDef.Spec) {
+		return nil, nil
+	}
+	return r.validateProxyDef()
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *ProxyDef) ValidateDelete() (admission.Warnings, error) {
+	// Deletions are not validated, the webhook is not even called for them
+	return nil, nil
+}
+
+// validateProxyDef validates the spec of a ProxyDef, adding the checks that only apply
+// to ProxyDefs, such as the namespaces of references that are ignored
+func (r *ProxyDef) validateProxyDef() (admission.Warnings, error) {
+	path := field.NewPath("spec")
+	allErrs, warnings := r.Spec.ValidateAdmission(path)
+
+	// A ProxyDef only reads Secrets and ConfigMaps of its own namespace
+	if ref := r.Spec.CredentialsSecretRef; ref != nil && ref.Namespace != "" && ref.Namespace != r.Namespace {
+		warnings = append(warnings, fmt.Sprintf("%s: ignored, the Secret is read from the namespace of the ProxyDef", path.Child("credentialsSecretRef", "namespace")))
+	}
+	if source := r.Spec.PACSource; source != nil && source.ConfigMapRef != nil && source.ConfigMapRef.Namespace != "" && source.ConfigMapRef.Namespace != r.Namespace {
+		warnings = append(warnings, fmt.Sprintf("%s: ignored, the ConfigMap is read from the namespace of the ProxyDef", path.Child("pacSource", "configMapRef", "namespace")))
+	}
+
+	if len(allErrs) == 0 {
+		return warnings, nil
+	}
+	return warnings, apierrors.NewInvalid(GroupVersion.WithKind("ProxyDef").GroupKind(), r.Name, allErrs)
+}
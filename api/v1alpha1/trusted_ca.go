@@ -0,0 +1,76 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+const (
+	// TrustedCAMountPath is where the pod webhook mounts the trusted CA bundle into containers
+	TrustedCAMountPath = "/etc/proxius/ca"
+	// TrustedCAKey is the key of the generated ConfigMap holding the trusted CA bundle,
+	// and so the name of the file mounted into containers
+	TrustedCAKey = "ca-bundle.crt"
+	// TrustedCAFile is the path of the trusted CA bundle within containers
+	TrustedCAFile = TrustedCAMountPath + "/" + TrustedCAKey
+
+	// DefaultTrustedCAConfigMapKey is the ConfigMap key read when a TrustedCA sets none
+	DefaultTrustedCAConfigMapKey = "ca-bundle.crt"
+	// DefaultTrustedCASecretKey is the Secret key read when a TrustedCA sets none
+	DefaultTrustedCASecretKey = "ca.crt"
+)
+
+// TrustedCAVariables are the environment variables pointed at the trusted CA bundle,
+// as read by OpenSSL and Go, Python requests, curl, Node.js, git and pip
+var TrustedCAVariables = []string{
+	"SSL_CERT_FILE",
+	"REQUESTS_CA_BUNDLE",
+	"CURL_CA_BUNDLE",
+	"NODE_EXTRA_CA_CERTS",
+	"GIT_SSL_CAINFO",
+	"PIP_CERT",
+}
+
+// TrustedCA locates a bundle of PEM-encoded CA certificates.
+// Exactly one of its fields must be set.
+type TrustedCA struct {
+	// ConfigMapRef selects the key of a ConfigMap holding the bundle, "ca-bundle.crt" by default.
+	ConfigMapRef *CABundleReference `json:"configMapRef,omitempty"`
+	// SecretRef selects the key of a Secret holding the bundle, "ca.crt" by default.
+	SecretRef *CABundleReference `json:"secretRef,omitempty"`
+}
+
+// CABundleReference references the key of a ConfigMap or Secret holding a CA bundle
+type CABundleReference struct {
+	// Name of the ConfigMap or Secret.
+	Name string `json:"name"`
+	// Namespace of the ConfigMap or Secret. It is required by ClusterProxyDef and ignored
+	// by ProxyDef, which can only reference objects of its own namespace.
+	Namespace string `json:"namespace,omitempty"`
+	// Key holding the bundle.
+	Key string `json:"key,omitempty"`
+}
+
+// Reference returns the reference to the object holding the bundle, the key to read from it,
+// and whether that object is a Secret
+func (t *TrustedCA) Reference() (ref *CABundleReference, key string, secret bool) {
+	ref, key = t.ConfigMapRef, DefaultTrustedCAConfigMapKey
+	if t.SecretRef != nil {
+		ref, key, secret = t.SecretRef, DefaultTrustedCASecretKey, true
+	}
+	if ref != nil && ref.Key != "" {
+		key = ref.Key
+	}
+	return ref, key, secret
+}
@@ -113,8 +113,8 @@ var _ = BeforeSuite(func() {
 	})
 	Expect(err).NotTo(HaveOccurred())
 
-	// err = (&ProxyDef{}).SetupWebhookWithManager(mgr)
-	// Expect(err).NotTo(HaveOccurred())
+	err = (&ProxyDef{}).SetupWebhookWithManager(mgr)
+	Expect(err).NotTo(HaveOccurred())
 
 	// TODO: test for Pod webhook
 
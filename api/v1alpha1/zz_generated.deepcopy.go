@@ -25,12 +25,199 @@ import (
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CABundleReference) DeepCopyInto(out *CABundleReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CABundleReference.
+func (in *CABundleReference) DeepCopy() *CABundleReference {
+	if in == nil {
+		return nil
+	}
+	out := new(CABundleReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterProxyDef) DeepCopyInto(out *ClusterProxyDef) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterProxyDef.
+func (in *ClusterProxyDef) DeepCopy() *ClusterProxyDef {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterProxyDef)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClusterProxyDef) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterProxyDefList) DeepCopyInto(out *ClusterProxyDefList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ClusterProxyDef, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterProxyDefList.
+func (in *ClusterProxyDefList) DeepCopy() *ClusterProxyDefList {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterProxyDefList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClusterProxyDefList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterProxyDefSpec) DeepCopyInto(out *ClusterProxyDefSpec) {
+	*out = *in
+	if in.NamespaceSelector != nil {
+		in, out := &in.NamespaceSelector, &out.NamespaceSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	in.ProxyDefSpec.DeepCopyInto(&out.ProxyDefSpec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterProxyDefSpec.
+func (in *ClusterProxyDefSpec) DeepCopy() *ClusterProxyDefSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterProxyDefSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterProxyDefStatus) DeepCopyInto(out *ClusterProxyDefStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Namespaces != nil {
+		in, out := &in.Namespaces, &out.Namespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterProxyDefStatus.
+func (in *ClusterProxyDefStatus) DeepCopy() *ClusterProxyDefStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterProxyDefStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CredentialsSecretReference) DeepCopyInto(out *CredentialsSecretReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CredentialsSecretReference.
+func (in *CredentialsSecretReference) DeepCopy() *CredentialsSecretReference {
+	if in == nil {
+		return nil
+	}
+	out := new(CredentialsSecretReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OpenShiftProxySource) DeepCopyInto(out *OpenShiftProxySource) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OpenShiftProxySource.
+func (in *OpenShiftProxySource) DeepCopy() *OpenShiftProxySource {
+	if in == nil {
+		return nil
+	}
+	out := new(OpenShiftProxySource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PACConfigMapReference) DeepCopyInto(out *PACConfigMapReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PACConfigMapReference.
+func (in *PACConfigMapReference) DeepCopy() *PACConfigMapReference {
+	if in == nil {
+		return nil
+	}
+	out := new(PACConfigMapReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PACSource) DeepCopyInto(out *PACSource) {
+	*out = *in
+	if in.ConfigMapRef != nil {
+		in, out := &in.ConfigMapRef, &out.ConfigMapRef
+		*out = new(PACConfigMapReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PACSource.
+func (in *PACSource) DeepCopy() *PACSource {
+	if in == nil {
+		return nil
+	}
+	out := new(PACSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ProxyDef) DeepCopyInto(out *ProxyDef) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
+	in.Spec.DeepCopyInto(&out.Spec)
 	in.Status.DeepCopyInto(&out.Status)
 }
 
@@ -87,6 +274,51 @@ func (in *ProxyDefList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ProxyDefSpec) DeepCopyInto(out *ProxyDefSpec) {
 	*out = *in
+	if in.PodSelector != nil {
+		in, out := &in.PodSelector, &out.PodSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.IncludeContainers != nil {
+		in, out := &in.IncludeContainers, &out.IncludeContainers
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ExcludeContainers != nil {
+		in, out := &in.ExcludeContainers, &out.ExcludeContainers
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.CredentialsSecretRef != nil {
+		in, out := &in.CredentialsSecretRef, &out.CredentialsSecretRef
+		*out = new(CredentialsSecretReference)
+		**out = **in
+	}
+	if in.RolloutPolicy != nil {
+		in, out := &in.RolloutPolicy, &out.RolloutPolicy
+		*out = new(RolloutPolicy)
+		**out = **in
+	}
+	if in.PACSource != nil {
+		in, out := &in.PACSource, &out.PACSource
+		*out = new(PACSource)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.OpenShiftProxy != nil {
+		in, out := &in.OpenShiftProxy, &out.OpenShiftProxy
+		*out = new(OpenShiftProxySource)
+		**out = **in
+	}
+	if in.TrustedCA != nil {
+		in, out := &in.TrustedCA, &out.TrustedCA
+		*out = new(TrustedCA)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ConfigFiles != nil {
+		in, out := &in.ConfigFiles, &out.ConfigFiles
+		*out = make([]ConfigFileProfile, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProxyDefSpec.
@@ -120,3 +352,43 @@ func (in *ProxyDefStatus) DeepCopy() *ProxyDefStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RolloutPolicy) DeepCopyInto(out *RolloutPolicy) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RolloutPolicy.
+func (in *RolloutPolicy) DeepCopy() *RolloutPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(RolloutPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TrustedCA) DeepCopyInto(out *TrustedCA) {
+	*out = *in
+	if in.ConfigMapRef != nil {
+		in, out := &in.ConfigMapRef, &out.ConfigMapRef
+		*out = new(CABundleReference)
+		**out = **in
+	}
+	if in.SecretRef != nil {
+		in, out := &in.SecretRef, &out.SecretRef
+		*out = new(CABundleReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TrustedCA.
+func (in *TrustedCA) DeepCopy() *TrustedCA {
+	if in == nil {
+		return nil
+	}
+	out := new(TrustedCA)
+	in.DeepCopyInto(out)
+	return out
+}
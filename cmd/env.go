@@ -0,0 +1,78 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// envConflict is a proxy variable that a container defines itself
+type envConflict struct {
+	// variable is the upper-case name of the variable
+	variable string
+	// names are the forms of the variable that the container defines in env
+	names []string
+	// own is the first definition of the variable in the env of the container
+	own corev1.EnvVar
+}
+
+// variableForms returns the upper- and lower-case forms of a proxy variable
+func variableForms(variable string) []string {
+	return []string{variable, strings.ToLower(variable)}
+}
+
+// generatedRef reports whether an env entry reads its value from an object generated by Proxius
+func generatedRef(env corev1.EnvVar, generated func(name string) bool) bool {
+	ref := env.ValueFrom
+	return ref != nil && (ref.ConfigMapKeyRef != nil && generated(ref.ConfigMapKeyRef.Name) ||
+		ref.SecretKeyRef != nil && generated(ref.SecretKeyRef.Name))
+}
+
+// envConflicts returns the proxy variables that a container defines itself in env, leaving out
+// the definitions that refer to the objects generated by Proxius, as found on Pods created from
+// an already injected spec. The ConfigMaps and Secrets that the container loads with envFrom are
+// not read, since the generated ones are loaded after them, or in env, and so take precedence.
+func envConflicts(container *corev1.Container, variables []string, generated func(name string) bool) []envConflict {
+	var conflicts []envConflict
+	for _, variable := range variables {
+		conflict := envConflict{variable: variable}
+		defined := map[string]bool{}
+		for _, env := range container.Env {
+			if env.Name != variable && env.Name != strings.ToLower(variable) {
+				continue
+			}
+			if generatedRef(env, generated) {
+				continue
+			}
+			if len(defined) == 0 {
+				conflict.own = env
+			}
+			defined[env.Name] = true
+		}
+		for _, name := range variableForms(variable) {
+			if defined[name] {
+				conflict.names = append(conflict.names, name)
+			}
+		}
+		if len(conflict.names) > 0 {
+			conflicts = append(conflicts, conflict)
+		}
+	}
+	return conflicts
+}
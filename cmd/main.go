@@ -26,10 +26,14 @@ import (
 
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
@@ -59,6 +63,9 @@ func main() {
 	var probeAddr string
 	var secureMetrics bool
 	var enableHTTP2 bool
+	var pacAddr string
+	var pacBaseURL string
+	var pacSourceHosts string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
@@ -68,6 +75,15 @@ func main() {
 		"If set the metrics endpoint is served securely")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	flag.StringVar(&pacAddr, "pac-bind-address", ":8082", "The address the proxy auto-config (PAC) files are served on. "+
+		"Set this to '0' to disable serving them.")
+	flag.StringVar(&pacBaseURL, "pac-base-url", "",
+		"The URL clients reach the PAC files under, e.g. http://proxius-pac-service.proxius-system.svc:8082. "+
+			"It is published in the status of the ProxyDefs and ClusterProxyDefs that set autoDetect.")
+	flag.StringVar(&pacSourceHosts, "pac-source-allowed-hosts", "",
+		"A comma-separated list of the only hosts the PAC files of pacSource URLs may be downloaded from. "+
+			"By default, any host but loopback, link-local and private addresses is allowed, "+
+			"while the listed hosts may resolve to private addresses.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -96,8 +112,15 @@ func main() {
 		TLSOpts: tlsOpts,
 	})
 
+	generated := labels.SelectorFromSet(labels.Set{proxyv1alpha1.GeneratedLabel: "true"})
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme: scheme,
+		// Only the generated ConfigMaps and Secrets are cached, the ones referenced
+		// by ProxyDefs are read straight from the API server
+		Cache: cache.Options{ByObject: map[client.Object]cache.ByObject{
+			&corev1.ConfigMap{}: {Label: generated},
+			&corev1.Secret{}:    {Label: generated},
+		}},
 		Metrics: metricsserver.Options{
 			BindAddress:   metricsAddr,
 			SecureServing: secureMetrics,
@@ -125,19 +148,35 @@ func main() {
 	}
 
 	if err = (&controller.ProxyDefReconciler{
-		Client:   mgr.GetClient(),
-		Scheme:   mgr.GetScheme(),
-		Recorder: mgr.GetEventRecorderFor("proxydef-controller"),
+		Client:     mgr.GetClient(),
+		APIReader:  mgr.GetAPIReader(),
+		Scheme:     mgr.GetScheme(),
+		Recorder:   mgr.GetEventRecorderFor("proxydef-controller"),
+		PACBaseURL: pacBaseURL,
+
+		PACSourceHosts: proxyv1alpha1.SplitList(pacSourceHosts),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "ProxyDef")
 		os.Exit(1)
 	}
-	// if os.Getenv("ENABLE_WEBHOOKS") != "false" {
-	// 	if err = (&proxyv1alpha1.ProxyDef{}).SetupWebhookWithManager(mgr); err != nil {
-	// 		setupLog.Error(err, "unable to create webhook", "webhook", "ProxyDef")
-	// 		os.Exit(1)
-	// 	}
-	// }
+	if err = (&controller.ClusterProxyDefReconciler{
+		Client:     mgr.GetClient(),
+		APIReader:  mgr.GetAPIReader(),
+		Scheme:     mgr.GetScheme(),
+		Recorder:   mgr.GetEventRecorderFor("clusterproxydef-controller"),
+		PACBaseURL: pacBaseURL,
+
+		PACSourceHosts: proxyv1alpha1.SplitList(pacSourceHosts),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ClusterProxyDef")
+		os.Exit(1)
+	}
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&proxyv1alpha1.ProxyDef{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "ProxyDef")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -167,6 +206,20 @@ func main() {
 		},
 	})
 
+	mgr.GetWebhookServer().Register("/mutate-workloads", &webhook.Admission{
+		Handler: &WorkloadMutator{PodMutator{
+			Client:  mgr.GetClient(),
+			decoder: admission.NewDecoder(mgr.GetScheme()),
+		}},
+	})
+
+	if pacAddr != "0" {
+		if err := mgr.Add(&PACServer{Client: mgr.GetClient(), BindAddress: pacAddr}); err != nil {
+			setupLog.Error(err, "unable to set up PAC server")
+			os.Exit(1)
+		}
+	}
+
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
 		setupLog.Error(err, "problem running manager")
@@ -0,0 +1,188 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	proxyv1alpha1 "github.com/igordcard/proxius/api/v1alpha1"
+	"github.com/igordcard/proxius/internal/controller"
+)
+
+// pacContentType is the media type browsers expect proxy auto-config files to be served with
+const pacContentType = "application/x-ns-proxy-autoconfig"
+
+// errPACNotRendered is returned while the ConfigMap a PAC file is derived from does not exist yet
+var errPACNotRendered = errors.New("the proxy configuration has not been rendered yet")
+
+// PACServer serves the proxy auto-config files of the ProxyDefs and ClusterProxyDefs
+// that set autoDetect, at the paths published in their status
+type PACServer struct {
+	Client      client.Reader
+	BindAddress string
+}
+
+// Start serves the PAC files until the context is cancelled
+func (s *PACServer) Start(ctx context.Context) error {
+	server := &http.Server{
+		Addr:              s.BindAddress,
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// NeedLeaderElection lets every replica of the manager serve PAC files
+func (s *PACServer) NeedLeaderElection() bool {
+	return false
+}
+
+func (s *PACServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := logf.FromContext(r.Context()).WithValues("path", r.URL.Path)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	pac, err := s.pacFile(r.Context(), r.URL.Path)
+	switch {
+	case apierrors.IsNotFound(err):
+		http.NotFound(w, r)
+		return
+	case errors.Is(err, errPACNotRendered):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		log.Error(err, "Failed to render PAC file")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", pacContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write([]byte(pac))
+}
+
+// pacFile renders the PAC file served at the given path, or returns a NotFound error
+func (s *PACServer) pacFile(ctx context.Context, path string) (string, error) {
+	notFound := apierrors.NewNotFound(proxyv1alpha1.GroupVersion.WithResource("proxydefs").GroupResource(), path)
+
+	var spec *proxyv1alpha1.ProxyDefSpec
+	var configMapKey client.ObjectKey
+	var secretName, variantsName string
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	switch {
+	case len(parts) == 4 && parts[0] == "proxydefs" && parts[3] == proxyv1alpha1.PACFileName:
+		proxyDef := &proxyv1alpha1.ProxyDef{}
+		if err := s.Client.Get(ctx, client.ObjectKey{Namespace: parts[1], Name: parts[2]}, proxyDef); err != nil {
+			return "", err
+		}
+		spec = &proxyDef.Spec
+		configMapKey = client.ObjectKey{Namespace: proxyDef.Namespace, Name: proxyDef.Status.ConfigMapName}
+		secretName = proxyDef.Status.SecretName
+		variantsName = proxyDef.Status.VariantsConfigMapName
+	case len(parts) == 3 && parts[0] == "clusterproxydefs" && parts[2] == proxyv1alpha1.PACFileName:
+		clusterProxyDef := &proxyv1alpha1.ClusterProxyDef{}
+		if err := s.Client.Get(ctx, client.ObjectKey{Name: parts[1]}, clusterProxyDef); err != nil {
+			return "", err
+		}
+		spec = &clusterProxyDef.Spec.ProxyDefSpec
+		secretName = clusterProxyDef.Status.SecretName
+		variantsName = clusterProxyDef.Status.VariantsConfigMapName
+		// The ConfigMaps of every selected namespace are identical, so any of them will do
+		if len(clusterProxyDef.Status.Namespaces) > 0 {
+			configMapKey = client.ObjectKey{Namespace: clusterProxyDef.Status.Namespaces[0], Name: clusterProxyDef.Status.ConfigMapName}
+		}
+	default:
+		return "", notFound
+	}
+	if !spec.AutoDetect {
+		return "", notFound
+	}
+
+	// NO_PROXY is read back from the ConfigMap, since it includes the discovered entries
+	if configMapKey.Name == "" || configMapKey.Namespace == "" {
+		return "", errPACNotRendered
+	}
+	configMap := &corev1.ConfigMap{}
+	if err := s.Client.Get(ctx, configMapKey, configMap); err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", errPACNotRendered
+		}
+		return "", err
+	}
+	noProxy := configMap.Data["NO_PROXY"]
+	if variantsName != "" {
+		variants := &corev1.ConfigMap{}
+		if err := s.Client.Get(ctx, client.ObjectKey{Namespace: configMapKey.Namespace, Name: variantsName}, variants); err != nil {
+			if apierrors.IsNotFound(err) {
+				return "", errPACNotRendered
+			}
+			return "", err
+		}
+		if cidr, ok := variants.Data[proxyv1alpha1.NoProxyVariantKey(proxyv1alpha1.NoProxyFormatCIDR)]; ok {
+			noProxy = cidr
+		}
+	}
+
+	// The proxies derived from a PAC source are only known from what was rendered
+	if spec.PACSource != nil {
+		spec = spec.DeepCopy()
+		spec.HTTPProxy = configMap.Data["HTTP_PROXY"]
+		spec.HTTPSProxy = configMap.Data["HTTPS_PROXY"]
+		if secretName != "" {
+			secret := &corev1.Secret{}
+			if err := s.Client.Get(ctx, client.ObjectKey{Namespace: configMapKey.Namespace, Name: secretName}, secret); err != nil {
+				if apierrors.IsNotFound(err) {
+					return "", errPACNotRendered
+				}
+				return "", err
+			}
+			spec.HTTPProxy = withoutCredentials(string(secret.Data["HTTP_PROXY"]))
+			spec.HTTPSProxy = withoutCredentials(string(secret.Data["HTTPS_PROXY"]))
+		}
+	}
+	return controller.PACFile(spec, noProxy), nil
+}
+
+// withoutCredentials strips the credentials off a proxy URL, since PAC files are public
+func withoutCredentials(proxy string) string {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return ""
+	}
+	u.User = nil
+	return u.String()
+}
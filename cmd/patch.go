@@ -0,0 +1,89 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gomodules.xyz/jsonpatch/v2"
+)
+
+// podPatch accumulates the JSON patch operations applied to a Pod by the webhook.
+// Only the fields that are actually injected are patched, instead of re-marshalling
+// the whole Pod, so that fields unknown to this version of the API are left untouched.
+type podPatch struct {
+	operations []jsonpatch.JsonPatchOperation
+	// created tracks the lists and maps that were missing and have been added by this patch
+	created map[string]bool
+}
+
+// newPodPatch returns an empty podPatch
+func newPodPatch() *podPatch {
+	return &podPatch{created: map[string]bool{}}
+}
+
+// appendToList appends a value to the list at path, which currently holds length items
+func (p *podPatch) appendToList(path string, length int, value interface{}) {
+	if length == 0 && !p.created[path] {
+		p.created[path] = true
+		p.operations = append(p.operations, jsonpatch.NewOperation("add", path, []interface{}{value}))
+		return
+	}
+	p.operations = append(p.operations, jsonpatch.NewOperation("add", path+"/-", value))
+}
+
+// setMapKey sets a key of the string map at path, which may currently be missing
+func (p *podPatch) setMapKey(path string, current map[string]string, key, value string) {
+	if current == nil && !p.created[path] {
+		p.created[path] = true
+		p.operations = append(p.operations, jsonpatch.NewOperation("add", path, map[string]string{key: value}))
+		return
+	}
+	p.operations = append(p.operations, jsonpatch.NewOperation("add", path+"/"+escapePathToken(key), value))
+}
+
+// setValue sets the value at path, which may currently be missing
+// (an "add" operation replaces the members of objects that already exist)
+func (p *podPatch) setValue(path string, value interface{}) {
+	p.operations = append(p.operations, jsonpatch.NewOperation("add", path, value))
+}
+
+// removeMapKey removes a key of the string map at path, which must currently hold it
+func (p *podPatch) removeMapKey(path, key string) {
+	p.operations = append(p.operations, jsonpatch.NewOperation("remove", path+"/"+escapePathToken(key), nil))
+}
+
+// replaceInList replaces the item at index of the list at path
+func (p *podPatch) replaceInList(path string, index int, value interface{}) {
+	p.operations = append(p.operations, jsonpatch.NewOperation("replace", fmt.Sprintf("%s/%d", path, index), value))
+}
+
+// removeFromList removes the item at index of the list at path
+func (p *podPatch) removeFromList(path string, index int) {
+	p.operations = append(p.operations, jsonpatch.NewOperation("remove", fmt.Sprintf("%s/%d", path, index), nil))
+}
+
+// empty reports whether the patch has no operations
+func (p *podPatch) empty() bool {
+	return len(p.operations) == 0
+}
+
+// escapePathToken escapes a JSON pointer token as per RFC 6901
+func escapePathToken(token string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+}
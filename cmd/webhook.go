@@ -18,11 +18,18 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 
+	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
@@ -30,7 +37,7 @@ import (
 	proxyv1alpha1 "github.com/igordcard/proxius/api/v1alpha1"
 )
 
-//+kubebuilder:webhook:path=/mutate-v1-pod,mutating=true,failurePolicy=fail,groups="",resources=pods,verbs=create;update,versions=v1,name=mpod.kb.io,admissionReviewVersions=v1,sideEffects=NoneOnDryRun
+//+kubebuilder:webhook:path=/mutate-v1-pod,mutating=true,failurePolicy=fail,groups="",resources=pods;pods/ephemeralcontainers,verbs=create;update,versions=v1,name=mpod.kb.io,admissionReviewVersions=v1,sideEffects=NoneOnDryRun
 
 type PodMutator struct {
 	Client  client.Client
@@ -45,39 +52,894 @@ func (a *PodMutator) Handle(ctx context.Context, req admission.Request) admissio
 		return admission.Errored(http.StatusBadRequest, err)
 	}
 
-	// Get the ProxyDef resource
-	proxyDef := &proxyv1alpha1.ProxyDef{}
-	if err := a.Client.Get(ctx, client.ObjectKey{Namespace: req.Namespace, Name: "proxydef"}, proxyDef); err != nil {
+	// Containers cannot be changed once a Pod exists, and anything injected at creation
+	// is already there, so updates are let through untouched. The only exception are
+	// ephemeral containers, which are added to running Pods through their own subresource.
+	ephemeral := req.Operation == admissionv1.Update && req.SubResource == "ephemeralcontainers"
+	if req.Operation != admissionv1.Create && !ephemeral {
+		return admission.Allowed("Only Pod creations are mutated")
+	}
+
+	// Application teams can opt their Pods out of injection altogether
+	if optOut, err := strconv.ParseBool(pod.Annotations[proxyv1alpha1.InjectAnnotation]); err == nil && !optOut {
+		log.Info("Pod opted out of injection, skipping")
+		return admission.Allowed("Pod opted out of injection")
+	}
+
+	// Find out which ProxyDef, or ClusterProxyDef, applies to this Pod
+	source, err := a.resolveProxySource(ctx, pod, req.Namespace)
+	if err != nil {
 		if errors.IsNotFound(err) {
-			// The ProxyDef resource does not exist, handle it here
-			log.Info("ProxyDef resource does not exist, skipping")
+			// The ProxyDef named by the Pod does not exist, handle it here
+			log.Info("ProxyDef resource does not exist, skipping", "err", err)
 			return admission.Allowed("ProxyDef resource does not exist")
+		}
+		// Some other error occurred when trying to get the ProxyDef resource
+		log.Info("Failed to get ProxyDef resource", "err", err)
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if source == nil {
+		log.Info("No ProxyDef applies to the Pod, skipping")
+		return admission.Allowed("No ProxyDef applies to the Pod")
+	}
+
+	// The ConfigMap name is published by the controller once it has been generated
+	if source.ConfigMapName == "" {
+		log.Info("ProxyDef has not generated its ConfigMap yet, skipping", "kind", source.Kind, "name", source.Name)
+		return admission.Allowed("ProxyDef has not generated its ConfigMap yet")
+	}
+
+	// The ProxyDef may be scoped to only some of the Pods of the namespace
+	selected, err := podSelected(source.Spec, pod)
+	if err != nil {
+		log.Info("Invalid pod selector, skipping", "kind", source.Kind, "name", source.Name, "err", err)
+		return admission.Allowed("ProxyDef has an invalid pod selector")
+	}
+	if !selected {
+		log.Info("Pod is not selected by the ProxyDef, skipping", "kind", source.Kind, "name", source.Name)
+		return admission.Allowed("Pod is not selected by the ProxyDef")
+	}
+
+	target := &injectionTarget{pod: pod}
+	if ephemeral {
+		if !source.Spec.InjectEphemeralContainers {
+			return admission.Allowed("Injection of ephemeral containers is not enabled")
+		}
+		// Ephemeral containers that already exist cannot be changed, so only the new ones are injected
+		oldPod := &corev1.Pod{}
+		if err := a.decoder.DecodeRaw(req.OldObject, oldPod); err != nil {
+			log.Info("Failed to decode old Pod", "err", err)
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		target.ephemeral = true
+		target.existingEphemeral = map[string]bool{}
+		for _, container := range oldPod.Spec.EphemeralContainers {
+			target.existingEphemeral[container.Name] = true
+		}
+	}
+
+	patch := newPodPatch()
+	result := a.inject(ctx, req.Namespace, source, target, patch)
+	warnings := result.warnings
+	conflictPolicy := source.Spec.EnvConflictPolicyOrDefault()
+	if len(result.conflicts) > 0 {
+		log.Info("Containers define proxy variables themselves", "kind", source.Kind, "name", source.Name, "conflicts", result.conflicts, "envConflictPolicy", conflictPolicy)
+		if conflictPolicy == proxyv1alpha1.EnvConflictPolicyReject {
+			return admission.Denied(fmt.Sprintf("Containers define proxy variables injected from %s %s themselves: %s", source.Kind, source.Name, strings.Join(result.conflicts, "; ")))
+		}
+		warnings = append(warnings, fmt.Sprintf("Containers define proxy variables injected from %s %s themselves, resolved by the %s policy: %s", source.Kind, source.Name, conflictPolicy, strings.Join(result.conflicts, "; ")))
+	}
+
+	// Pods created from a Pod template injected by the workload webhook already carry everything,
+	// but are still annotated below, so that they can be rolled out once the configuration changes
+	fromTemplate := result.carried && source.Spec.InjectionModeOrDefault() == proxyv1alpha1.InjectionModeWorkload
+	if patch.empty() && !fromTemplate {
+		log.Info("No container of the Pod needs injection, skipping", "kind", source.Kind, "name", source.Name)
+		return admission.Allowed("No container of the Pod needs injection").WithWarnings(warnings...)
+	}
+
+	// Record where the injected settings came from so that they can be audited later on.
+	// The configuration hash lets the controller find the Pods to restart once it changes.
+	// The ephemeralcontainers subresource only accepts changes to ephemeral containers.
+	if !ephemeral {
+		patch.setMapKey("/metadata/annotations", pod.Annotations, proxyv1alpha1.InjectedFromAnnotation, source.String())
+		if source.ConfigHash != "" {
+			patch.setMapKey("/metadata/annotations", pod.Annotations, proxyv1alpha1.ConfigHashAnnotation, source.ConfigHash)
+		}
+		if len(result.conflicts) > 0 {
+			patch.setMapKey("/metadata/annotations", pod.Annotations, proxyv1alpha1.EnvConflictsAnnotation, strings.Join(result.conflicts, ";"))
+		}
+	}
+
+	log.Info("Patching Pod with proxy environment", "kind", source.Kind, "name", source.Name, "injectionFailureMode", source.Spec.InjectionFailureModeOrDefault())
+	return admission.Patched("Injected proxy environment", patch.operations...).WithWarnings(warnings...)
+}
+
+// injectionTarget is what the proxy settings are injected into: a Pod being admitted,
+// or the Pod template of a workload
+type injectionTarget struct {
+	// pod holds the metadata and spec to inject, which are the ones of the Pod template for a workload
+	pod *corev1.Pod
+	// prefix is the JSON pointer of the Pod template within a workload, and empty for a Pod
+	prefix string
+	// ephemeral restricts the injection to the ephemeral containers added to a running Pod,
+	// leaving out the ones in existingEphemeral, which can no longer be changed
+	ephemeral         bool
+	existingEphemeral map[string]bool
+}
+
+// injectionResult sums up the injection of a Pod or Pod template
+type injectionResult struct {
+	warnings []string
+	// conflicts lists the proxy variables that containers define themselves, per container,
+	// as in the env-conflicts annotation. When the EnvConflictPolicy rejects them, nothing
+	// was injected into the conflicting containers.
+	conflicts []string
+	// carried reports whether a selected container already loads the generated ConfigMap,
+	// e.g. when created from an already injected spec
+	carried bool
+}
+
+// inject adds the proxy settings of a source to the containers of a target, recording the
+// changes in the patch. The annotations recording the injection are left to the caller,
+// since they do not go into the Pod template of a workload.
+func (a *PodMutator) inject(ctx context.Context, namespace string, source *proxySource, target *injectionTarget, patch *podPatch) *injectionResult {
+	log := logf.FromContext(ctx)
+	pod, prefix, ephemeral := target.pod, target.prefix, target.ephemeral
+	proxydefConfigmap := source.ConfigMapName
+	result := &injectionResult{}
+
+	// Unless the generated objects are required, Pods must start even when they are missing,
+	// so the values of the ConfigMap are read now for those that cannot be referenced as optional.
+	// Values copied into Pod templates would no longer follow the ProxyDef, so these are
+	// only referenced as optional.
+	failureMode := source.Spec.InjectionFailureModeOrDefault()
+	if prefix != "" && failureMode == proxyv1alpha1.InjectionFailureModeInline {
+		failureMode = proxyv1alpha1.InjectionFailureModeOptional
+	}
+	var optional *bool
+	var configData, variants map[string]string
+	if failureMode != proxyv1alpha1.InjectionFailureModeRequired {
+		optional = new(bool)
+		*optional = true
+		configMap := &corev1.ConfigMap{}
+		if err := a.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: proxydefConfigmap}, configMap); err != nil {
+			log.Info("Failed to get the generated ConfigMap", "kind", source.Kind, "name", source.Name, "err", err)
+			if failureMode == proxyv1alpha1.InjectionFailureModeInline {
+				result.warnings = append(result.warnings, fmt.Sprintf("ConfigMap %s could not be read, so it is referenced as optional instead of inlined", proxydefConfigmap))
+			}
+		} else {
+			configData = configMap.Data
+		}
+		// The helper variables are only ever copied, so they are simply left out when missing
+		if source.VariantsConfigMapName != "" {
+			variantsConfigMap := &corev1.ConfigMap{}
+			if err := a.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: source.VariantsConfigMapName}, variantsConfigMap); err != nil {
+				log.Info("Failed to get the generated variants ConfigMap", "kind", source.Kind, "name", source.Name, "err", err)
+			} else {
+				variants = variantsConfigMap.Data
+			}
+		}
+	}
+	inline := failureMode == proxyv1alpha1.InjectionFailureModeInline && configData != nil
+
+	// Proxy variables that containers define themselves are resolved by the conflict policy
+	conflictPolicy := source.Spec.EnvConflictPolicyOrDefault()
+	variables := source.Spec.ProxyVariables()
+	generated := func(name string) bool {
+		return name == proxydefConfigmap || name != "" && (name == source.SecretName || name == source.VariantsConfigMapName)
+	}
+
+	// The trusted CA bundle is mounted from a volume of the Pod, which is reused when the Pod
+	// already has one for the bundle, e.g. when created from an already injected spec
+	trustedCAVolume, addTrustedCAVolume := "", false
+	if source.TrustedCAConfigMapName != "" {
+		trustedCAVolume, addTrustedCAVolume = configMapVolumeFor(pod, trustedCAVolumeName, source.TrustedCAConfigMapName)
+		switch {
+		case trustedCAVolume == "":
+			result.warnings = append(result.warnings, fmt.Sprintf("Volume %s is already defined by the Pod, so the trusted CA bundle is not mounted", trustedCAVolumeName))
+		case addTrustedCAVolume && ephemeral:
+			// Volumes cannot be added to running Pods
+			trustedCAVolume = ""
+			result.warnings = append(result.warnings, "The Pod does not mount the trusted CA bundle, so it is not mounted into ephemeral containers either")
+		}
+	}
+	mountedTrustedCA := false
+
+	// The configuration files are mounted one by one through subPath, so that the rest of the
+	// directories they go into is kept. Ephemeral containers cannot use subPath, and a file
+	// missing from an optional volume would keep the container from starting, so unless the
+	// ConfigMap is required, the files are only mounted when it could be read.
+	configFilesVolume, addConfigFilesVolume := "", false
+	if source.ConfigFilesConfigMapName != "" && !ephemeral {
+		configFilesVolume, addConfigFilesVolume = configMapVolumeFor(pod, configFilesVolumeName, source.ConfigFilesConfigMapName)
+		if configFilesVolume == "" {
+			result.warnings = append(result.warnings, fmt.Sprintf("Volume %s is already defined by the Pod, so the configuration files are not mounted", configFilesVolumeName))
+		} else if failureMode != proxyv1alpha1.InjectionFailureModeRequired {
+			if err := a.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: source.ConfigFilesConfigMapName}, &corev1.ConfigMap{}); err != nil {
+				log.Info("Failed to get the generated config files ConfigMap", "kind", source.Kind, "name", source.Name, "err", err)
+				configFilesVolume = ""
+				result.warnings = append(result.warnings, fmt.Sprintf("ConfigMap %s could not be read, so the configuration files are not mounted", source.ConfigFilesConfigMapName))
+			}
+		}
+	}
+	mountedConfigFiles := false
+
+	excluded := excludedContainers(pod)
+	noProxyFormats := selectedNoProxyFormats(pod)
+	injectContainer := func(path string, container *corev1.Container) {
+		if !containerSelected(source.Spec, container.Name) || excluded[container.Name] {
+			return
+		}
+		if hasConfigMapEnvFrom(container, proxydefConfigmap) {
+			result.carried = true
+		}
+
+		// defined tracks the variables that the env of the container ends up defining
+		defined := map[string]bool{}
+		for _, env := range container.Env {
+			defined[env.Name] = true
+		}
+		var removed []int
+		conflicts := envConflicts(container, variables, generated)
+		if len(conflicts) > 0 {
+			names := []string{}
+			for _, conflict := range conflicts {
+				names = append(names, conflict.names...)
+			}
+			result.conflicts = append(result.conflicts, container.Name+"="+strings.Join(names, ","))
+		}
+		switch conflictPolicy {
+		case proxyv1alpha1.EnvConflictPolicyReject:
+			// The Pod is denied as a whole, once every container has been checked
+			if len(conflicts) > 0 {
+				return
+			}
+		case proxyv1alpha1.EnvConflictPolicyOverride:
+			// The container's own entries are removed last, so that the indices of the
+			// other operations still apply, and the injected envFrom sources take over
+			for _, conflict := range conflicts {
+				for i, env := range container.Env {
+					if containsString(conflict.names, env.Name) && !generatedRef(env, generated) {
+						removed = append(removed, i)
+						delete(defined, env.Name)
+					}
+				}
+			}
+			sort.Ints(removed)
+		default:
+			// Kubernetes lets env take precedence over envFrom, so the container's own definition
+			// is given to every form of the variable, instead of mixing it with the injected ones
+			for _, conflict := range conflicts {
+				for _, name := range variableForms(conflict.variable) {
+					if !defined[name] {
+						patch.appendToList(path+"/env", len(container.Env), corev1.EnvVar{Name: name, Value: conflict.own.Value, ValueFrom: conflict.own.ValueFrom})
+						defined[name] = true
+					}
+				}
+			}
+		}
+
+		format := noProxyFormats.forContainer(container.Name)
+		if source.Spec.NoProxyFormat == "" || format == source.Spec.NoProxyFormat {
+			format = ""
+		}
+		if inline {
+			appendLiteralEnv(patch, path, container, configData, variants, format, defined)
 		} else {
-			// Some other error occurred when trying to get the ProxyDef resource
-			log.Info("Failed to get ProxyDef resource", "err", err)
-			return admission.Errored(http.StatusInternalServerError, err)
+			// Reinvocations, or Pods created from an already injected spec, must not stack references
+			if !hasConfigMapEnvFrom(container, proxydefConfigmap) {
+				patch.appendToList(path+"/envFrom", len(container.EnvFrom), corev1.EnvFromSource{
+					ConfigMapRef: &corev1.ConfigMapEnvSource{
+						LocalObjectReference: corev1.LocalObjectReference{
+							Name: proxydefConfigmap,
+						},
+						Optional: optional,
+					},
+				})
+			}
+			// A NO_PROXY variant is selected by overriding the variables loaded by envFrom,
+			// unless the container defines them itself
+			if format != "" && source.VariantsConfigMapName != "" && !defined["NO_PROXY"] && !defined["no_proxy"] {
+				for _, name := range []string{"NO_PROXY", "no_proxy"} {
+					patch.appendToList(path+"/env", len(container.Env), corev1.EnvVar{
+						Name: name,
+						ValueFrom: &corev1.EnvVarSource{
+							ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+								LocalObjectReference: corev1.LocalObjectReference{
+									Name: source.VariantsConfigMapName,
+								},
+								Key:      proxyv1alpha1.NoProxyVariantKey(format),
+								Optional: optional,
+							},
+						},
+					})
+				}
+			}
+		}
+		// An unexpanded reference would make the JVM refuse to start, so the options are
+		// only referenced once the controller has rendered them into the variants ConfigMap,
+		// and copied as they are when the ConfigMap may go missing. The copy is left to the
+		// Pods created from a Pod template, where it would no longer follow the ProxyDef.
+		if source.Spec.InjectJavaToolOptions && source.Current && source.VariantsConfigMapName != "" {
+			if failureMode == proxyv1alpha1.InjectionFailureModeRequired {
+				referenceJavaToolOptions(patch, path, container, source.VariantsConfigMapName)
+			} else if options := variants[proxyv1alpha1.JavaToolOptionsKey]; options != "" && prefix == "" {
+				appendJavaToolOptions(patch, path, container, options)
+			}
+		}
+		// The proxy URLs with embedded credentials are only ever kept in the generated Secret,
+		// and never copied into the Pod
+		if source.SecretName != "" && !hasSecretEnvFrom(container, source.SecretName) {
+			patch.appendToList(path+"/envFrom", len(container.EnvFrom), corev1.EnvFromSource{
+				SecretRef: &corev1.SecretEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: source.SecretName,
+					},
+					Optional: optional,
+				},
+			})
+		}
+		if trustedCAVolume != "" && mountTrustedCA(patch, path, container, trustedCAVolume) {
+			mountedTrustedCA = true
+		}
+		if configFilesVolume != "" && mountConfigFiles(patch, path, container, configFilesVolume, source.Spec.ConfigFiles) {
+			mountedConfigFiles = true
+		}
+		for i := len(removed) - 1; i >= 0; i-- {
+			patch.removeFromList(path+"/env", removed[i])
+		}
+	}
+
+	if ephemeral {
+		for i := range pod.Spec.EphemeralContainers {
+			if target.existingEphemeral[pod.Spec.EphemeralContainers[i].Name] {
+				continue
+			}
+			container := corev1.Container(pod.Spec.EphemeralContainers[i].EphemeralContainerCommon)
+			injectContainer(fmt.Sprintf("%s/spec/ephemeralContainers/%d", prefix, i), &container)
+		}
+	} else {
+		// Init containers, including native sidecars, often need the proxy the most,
+		// e.g. to clone repositories or download artifacts before the app starts
+		for i := range pod.Spec.InitContainers {
+			injectContainer(fmt.Sprintf("%s/spec/initContainers/%d", prefix, i), &pod.Spec.InitContainers[i])
+		}
+		for i := range pod.Spec.Containers {
+			injectContainer(fmt.Sprintf("%s/spec/containers/%d", prefix, i), &pod.Spec.Containers[i])
+		}
+	}
+
+	if mountedTrustedCA && addTrustedCAVolume {
+		patch.appendToList(prefix+"/spec/volumes", len(pod.Spec.Volumes), corev1.Volume{
+			Name: trustedCAVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: source.TrustedCAConfigMapName,
+					},
+					Optional: optional,
+				},
+			},
+		})
+	}
+	if mountedConfigFiles && addConfigFilesVolume {
+		patch.appendToList(prefix+"/spec/volumes", len(pod.Spec.Volumes), corev1.Volume{
+			Name: configFilesVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: source.ConfigFilesConfigMapName,
+					},
+					Optional: optional,
+				},
+			},
+		})
+	}
+	return result
+}
+
+// hasConfigMapEnvFrom reports whether a container already loads its environment from the given ConfigMap
+func hasConfigMapEnvFrom(container *corev1.Container, name string) bool {
+	for _, envFrom := range container.EnvFrom {
+		if envFrom.ConfigMapRef != nil && envFrom.ConfigMapRef.Name == name {
+			return true
 		}
 	}
+	return false
+}
+
+// hasSecretEnvFrom reports whether a container already loads its environment from the given Secret
+func hasSecretEnvFrom(container *corev1.Container, name string) bool {
+	for _, envFrom := range container.EnvFrom {
+		if envFrom.SecretRef != nil && envFrom.SecretRef.Name == name {
+			return true
+		}
+	}
+	return false
+}
 
-	// TODO: figure out configmap name dynamically from proxydef
-	proxydefConfigmap := "proxydef-config"
+// proxySource is the ProxyDef or ClusterProxyDef whose settings are injected into a Pod
+type proxySource struct {
+	// Kind is either ProxyDef or ClusterProxyDef
+	Kind string
+	// Namespace is empty for a ClusterProxyDef
+	Namespace  string
+	Name       string
+	Generation int64
+	Spec       *proxyv1alpha1.ProxyDefSpec
+	// ConfigMapName is the ConfigMap generated in the Pod's namespace
+	ConfigMapName string
+	// SecretName is the Secret generated in the Pod's namespace, if the source has credentials
+	SecretName string
+	// TrustedCAConfigMapName is the ConfigMap generated in the Pod's namespace with the
+	// trusted CA bundle, if the source has one
+	TrustedCAConfigMapName string
+	// ConfigFilesConfigMapName is the ConfigMap generated in the Pod's namespace with the
+	// tool configuration files, if the source has any
+	ConfigFilesConfigMapName string
+	// VariantsConfigMapName is the ConfigMap generated in the Pod's namespace with the
+	// helper variables, if the source has any
+	VariantsConfigMapName string
+	// ConfigHash identifies the configuration being injected
+	ConfigHash string
+	// Current reports whether the generated objects were rendered from the current spec
+	Current bool
+}
+
+// renderedCurrentGeneration reports whether the controller reported Ready for the given generation
+func renderedCurrentGeneration(conditions []metav1.Condition, generation int64) bool {
+	ready := meta.FindStatusCondition(conditions, "Ready")
+	return ready != nil && ready.Status == metav1.ConditionTrue && ready.ObservedGeneration == generation
+}
 
-	for i := range pod.Spec.Containers {
-		pod.Spec.Containers[i].EnvFrom = append(pod.Spec.Containers[i].EnvFrom, corev1.EnvFromSource{
-			ConfigMapRef: &corev1.ConfigMapEnvSource{
+// ID identifies the source, as <namespace>/<name> for a ProxyDef or <name> for a ClusterProxyDef
+func (s *proxySource) ID() string {
+	if s.Namespace == "" {
+		return s.Name
+	}
+	return s.Namespace + "/" + s.Name
+}
+
+// String identifies the exact revision of the source, as recorded in the injected-from annotation
+func (s *proxySource) String() string {
+	return fmt.Sprintf("%s@%d", s.ID(), s.Generation)
+}
+
+// excludedContainers returns the set of containers excluded by the Pod's own annotation
+func excludedContainers(pod *corev1.Pod) map[string]bool {
+	excluded := map[string]bool{}
+	for _, name := range strings.Split(pod.Annotations[proxyv1alpha1.ExcludeContainersAnnotation], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			excluded[name] = true
+		}
+	}
+	return excluded
+}
+
+// noProxyFormatSelection is the NoProxyFormat selected by a Pod for all or some of its containers
+type noProxyFormatSelection struct {
+	pod        proxyv1alpha1.NoProxyFormat
+	containers map[string]proxyv1alpha1.NoProxyFormat
+}
+
+// selectedNoProxyFormats parses the no-proxy-format annotation of a Pod,
+// ignoring the formats it does not know of
+func selectedNoProxyFormats(pod *corev1.Pod) *noProxyFormatSelection {
+	selection := &noProxyFormatSelection{containers: map[string]proxyv1alpha1.NoProxyFormat{}}
+	for _, entry := range proxyv1alpha1.SplitList(pod.Annotations[proxyv1alpha1.NoProxyFormatAnnotation]) {
+		container, format, perContainer := strings.Cut(entry, "=")
+		if !perContainer {
+			container, format = "", entry
+		}
+		selected := proxyv1alpha1.NoProxyFormat(strings.TrimSpace(format))
+		if !knownNoProxyFormat(selected) {
+			continue
+		}
+		if perContainer {
+			selection.containers[strings.TrimSpace(container)] = selected
+		} else {
+			selection.pod = selected
+		}
+	}
+	return selection
+}
+
+// forContainer returns the NoProxyFormat selected for a container, if any
+func (s *noProxyFormatSelection) forContainer(name string) proxyv1alpha1.NoProxyFormat {
+	if format, ok := s.containers[name]; ok {
+		return format
+	}
+	return s.pod
+}
+
+// knownNoProxyFormat reports whether a format is one of NoProxyFormats
+func knownNoProxyFormat(format proxyv1alpha1.NoProxyFormat) bool {
+	for _, known := range proxyv1alpha1.NoProxyFormats {
+		if format == known {
+			return true
+		}
+	}
+	return false
+}
+
+// javaToolOptionsReference is expanded by Kubernetes into the JVM system properties
+// of the helper variable defined by referenceJavaToolOptions, when starting the container
+const javaToolOptionsReference = "$(" + proxyv1alpha1.JavaToolOptionsKey + ")"
+
+// referenceJavaToolOptions appends the reference to the JVM system properties to the
+// JAVA_TOOL_OPTIONS of a container, along with the helper variable it refers to, which is
+// read from the given ConfigMap. Kubernetes only expands references to the variables defined
+// before, so when the container sets JAVA_TOOL_OPTIONS itself, the helper variable takes its
+// place and JAVA_TOOL_OPTIONS moves after it. The indices of the env are kept as they are.
+func referenceJavaToolOptions(patch *podPatch, path string, container *corev1.Container, configMapName string) {
+	helper := corev1.EnvVar{
+		Name: proxyv1alpha1.JavaToolOptionsKey,
+		ValueFrom: &corev1.EnvVarSource{
+			ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
 				LocalObjectReference: corev1.LocalObjectReference{
-					Name: proxydefConfigmap,
+					Name: configMapName,
 				},
+				Key: proxyv1alpha1.JavaToolOptionsKey,
 			},
+		},
+	}
+	helperIndex, optionsIndex := -1, -1
+	for i, env := range container.Env {
+		switch env.Name {
+		case proxyv1alpha1.JavaToolOptionsKey:
+			helperIndex = i
+		case "JAVA_TOOL_OPTIONS":
+			optionsIndex = i
+		}
+	}
+	if optionsIndex == -1 {
+		if helperIndex == -1 {
+			patch.appendToList(path+"/env", len(container.Env), helper)
+		}
+		patch.appendToList(path+"/env", len(container.Env), corev1.EnvVar{Name: "JAVA_TOOL_OPTIONS", Value: javaToolOptionsReference})
+		return
+	}
+
+	own := container.Env[optionsIndex]
+	// Options read from a ConfigMap or Secret of their own cannot be merged with
+	if own.ValueFrom != nil {
+		return
+	}
+	options := own.Value
+	if !strings.Contains(options, javaToolOptionsReference) {
+		options = strings.TrimSpace(options + " " + javaToolOptionsReference)
+	}
+	switch {
+	case helperIndex == -1:
+		patch.replaceInList(path+"/env", optionsIndex, helper)
+		patch.appendToList(path+"/env", len(container.Env), corev1.EnvVar{Name: "JAVA_TOOL_OPTIONS", Value: options})
+	case helperIndex > optionsIndex:
+		patch.replaceInList(path+"/env", optionsIndex, helper)
+		patch.replaceInList(path+"/env", helperIndex, corev1.EnvVar{Name: "JAVA_TOOL_OPTIONS", Value: options})
+	case options != own.Value:
+		patch.setValue(fmt.Sprintf("%s/env/%d/value", path, optionsIndex), options)
+	}
+}
+
+// appendJavaToolOptions appends the JVM system properties to the JAVA_TOOL_OPTIONS
+// of a container, keeping the options the container sets itself
+func appendJavaToolOptions(patch *podPatch, path string, container *corev1.Container, options string) {
+	for i, env := range container.Env {
+		if env.Name != "JAVA_TOOL_OPTIONS" {
+			continue
+		}
+		// Options read from a ConfigMap or Secret of their own cannot be merged with
+		if env.ValueFrom != nil || strings.Contains(env.Value, options) {
+			return
+		}
+		patch.setValue(fmt.Sprintf("%s/env/%d/value", path, i), strings.TrimSpace(env.Value+" "+options))
+		return
+	}
+	patch.appendToList(path+"/env", len(container.Env), corev1.EnvVar{
+		Name:  "JAVA_TOOL_OPTIONS",
+		Value: options,
+	})
+}
+
+// appendLiteralEnv copies the proxy variables of the generated ConfigMap into the env of a
+// container, taking NO_PROXY from the given variant when set and found among the variants.
+// The helper variables are left out, as rendered by older versions into the same ConfigMap,
+// and so are the variables already defined in the env of the container.
+func appendLiteralEnv(patch *podPatch, path string, container *corev1.Container, data, variants map[string]string, format proxyv1alpha1.NoProxyFormat, defined map[string]bool) {
+	names := make([]string, 0, len(data))
+	for name := range data {
+		if !strings.HasPrefix(name, proxyv1alpha1.VariantKeyPrefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if defined[name] {
+			continue
+		}
+		value := data[name]
+		if format != "" && (name == "NO_PROXY" || name == "no_proxy") {
+			if variant, ok := variants[proxyv1alpha1.NoProxyVariantKey(format)]; ok {
+				value = variant
+			}
+		}
+		patch.appendToList(path+"/env", len(container.Env), corev1.EnvVar{Name: name, Value: value})
+	}
+}
+
+const (
+	// trustedCAVolumeName is the name of the Pod volume holding the trusted CA bundle
+	trustedCAVolumeName = "proxius-trusted-ca"
+	// configFilesVolumeName is the name of the Pod volume holding the tool configuration files
+	configFilesVolumeName = "proxius-config-files"
+)
+
+// configMapVolumeFor returns the name of the Pod volume to mount a generated ConfigMap from,
+// and whether that volume, named volumeName, still has to be added to the Pod. The name is
+// empty when the volume would clash with another one of the Pod.
+func configMapVolumeFor(pod *corev1.Pod, volumeName, configMapName string) (string, bool) {
+	add := true
+	for _, volume := range pod.Spec.Volumes {
+		if volume.ConfigMap != nil && volume.ConfigMap.Name == configMapName {
+			return volume.Name, false
+		}
+		if volume.Name == volumeName {
+			add = false
+		}
+	}
+	if !add {
+		return "", false
+	}
+	return volumeName, true
+}
+
+// mountTrustedCA mounts the trusted CA bundle into a container, unless the container already
+// mounts it or something else at its path, and reports whether a mount was added
+func mountTrustedCA(patch *podPatch, path string, container *corev1.Container, volume string) bool {
+	for _, mount := range container.VolumeMounts {
+		if mount.Name == volume || mount.MountPath == proxyv1alpha1.TrustedCAMountPath {
+			return false
+		}
+	}
+	patch.appendToList(path+"/volumeMounts", len(container.VolumeMounts), corev1.VolumeMount{
+		Name:      volume,
+		MountPath: proxyv1alpha1.TrustedCAMountPath,
+		ReadOnly:  true,
+	})
+	return true
+}
+
+// mountConfigFiles mounts the configuration file of every profile into a container, except
+// where the container already mounts something at its path or at a directory above it,
+// and reports whether any mount was added
+func mountConfigFiles(patch *podPatch, path string, container *corev1.Container, volume string, profiles []proxyv1alpha1.ConfigFileProfile) bool {
+	mounted := false
+	for _, profile := range profiles {
+		target := profile.MountPath()
+		if target == "" || mountsPath(container, target) {
+			continue
+		}
+		patch.appendToList(path+"/volumeMounts", len(container.VolumeMounts), corev1.VolumeMount{
+			Name:      volume,
+			MountPath: target,
+			SubPath:   profile.Key(),
+			ReadOnly:  true,
 		})
+		mounted = true
 	}
+	return mounted
+}
+
+// mountsPath reports whether a container mounts a volume at the given path or at a directory above it
+func mountsPath(container *corev1.Container, target string) bool {
+	for _, mount := range container.VolumeMounts {
+		dir := strings.TrimSuffix(mount.MountPath, "/")
+		if mount.MountPath == target || strings.HasPrefix(target, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// containsString reports whether a list contains the given string
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
 
-	marshaledPod, err := json.Marshal(pod)
+// podSelected reports whether a Pod is matched by the pod selector of a ProxyDef
+func podSelected(spec *proxyv1alpha1.ProxyDefSpec, pod *corev1.Pod) (bool, error) {
+	if spec.PodSelector == nil {
+		return true, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(spec.PodSelector)
+	if err != nil {
+		return false, err
+	}
+	return selector.Matches(labels.Set(pod.Labels)), nil
+}
+
+// containerSelected reports whether a container should be injected according to
+// the include and exclude lists of a ProxyDef, exclusions taking precedence
+func containerSelected(spec *proxyv1alpha1.ProxyDefSpec, name string) bool {
+	for _, excluded := range spec.ExcludeContainers {
+		if excluded == name {
+			return false
+		}
+	}
+	if len(spec.IncludeContainers) == 0 {
+		return true
+	}
+	for _, included := range spec.IncludeContainers {
+		if included == name {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveProxySource figures out where the proxy settings of a Pod come from.
+// ProxyDefs of the Pod's namespace take precedence over ClusterProxyDefs,
+// which are only considered when no ProxyDef applies and the Pod does not name one.
+func (a *PodMutator) resolveProxySource(ctx context.Context, pod *corev1.Pod, namespace string) (*proxySource, error) {
+	proxyDef, err := a.resolveProxyDef(ctx, pod, namespace)
 	if err != nil {
-		log.Info("Failed to encode Pod", "err", err)
-		return admission.Errored(http.StatusConflict, err)
+		return nil, err
+	}
+	if proxyDef != nil {
+		return &proxySource{
+			Kind:          "ProxyDef",
+			Namespace:     proxyDef.Namespace,
+			Name:          proxyDef.Name,
+			Generation:    proxyDef.Generation,
+			Current:       renderedCurrentGeneration(proxyDef.Status.Conditions, proxyDef.Generation),
+			Spec:          &proxyDef.Spec,
+			ConfigMapName: proxyDef.Status.ConfigMapName,
+			SecretName:    proxyDef.Status.SecretName,
+			ConfigHash:    proxyDef.Status.ConfigHash,
+
+			TrustedCAConfigMapName:   proxyDef.Status.TrustedCAConfigMapName,
+			ConfigFilesConfigMapName: proxyDef.Status.ConfigFilesConfigMapName,
+			VariantsConfigMapName:    proxyDef.Status.VariantsConfigMapName,
+		}, nil
+	}
+	if pod.Annotations[proxyv1alpha1.ProxyDefAnnotation] != "" {
+		return nil, nil
+	}
+
+	clusterProxyDef, err := a.resolveClusterProxyDef(ctx, namespace)
+	if err != nil || clusterProxyDef == nil {
+		return nil, err
+	}
+	return &proxySource{
+		Kind:          "ClusterProxyDef",
+		Name:          clusterProxyDef.Name,
+		Generation:    clusterProxyDef.Generation,
+		Current:       renderedCurrentGeneration(clusterProxyDef.Status.Conditions, clusterProxyDef.Generation),
+		Spec:          &clusterProxyDef.Spec.ProxyDefSpec,
+		ConfigMapName: clusterProxyDef.Status.ConfigMapName,
+		SecretName:    clusterProxyDef.Status.SecretName,
+		ConfigHash:    clusterProxyDef.Status.ConfigHash,
+
+		TrustedCAConfigMapName:   clusterProxyDef.Status.TrustedCAConfigMapName,
+		ConfigFilesConfigMapName: clusterProxyDef.Status.ConfigFilesConfigMapName,
+		VariantsConfigMapName:    clusterProxyDef.Status.VariantsConfigMapName,
+	}, nil
+}
+
+// resolveProxyDef figures out which ProxyDef applies to a Pod in the given namespace.
+// A ProxyDef named by the Pod's annotation always wins; otherwise the ProxyDef marked
+// as the namespace default is used, or the only ProxyDef in the namespace if there is
+// exactly one. ProxyDefs being deleted are ignored, and a nil ProxyDef is returned
+// when none applies.
+func (a *PodMutator) resolveProxyDef(ctx context.Context, pod *corev1.Pod, namespace string) (*proxyv1alpha1.ProxyDef, error) {
+	log := logf.FromContext(ctx)
+
+	if name, ok := pod.Annotations[proxyv1alpha1.ProxyDefAnnotation]; ok && name != "" {
+		proxyDef := &proxyv1alpha1.ProxyDef{}
+		if err := a.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, proxyDef); err != nil {
+			return nil, err
+		}
+		if proxyDef.DeletionTimestamp != nil {
+			log.Info("ProxyDef named by the Pod is being deleted", "namespace", namespace, "name", name)
+			return nil, nil
+		}
+		return proxyDef, nil
+	}
+
+	proxyDefs := &proxyv1alpha1.ProxyDefList{}
+	if err := a.Client.List(ctx, proxyDefs, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	// ProxyDefs being deleted no longer apply, so that no new Pod starts depending on them
+	live := proxyDefs.Items[:0]
+	for _, proxyDef := range proxyDefs.Items {
+		if proxyDef.DeletionTimestamp == nil {
+			live = append(live, proxyDef)
+		}
+	}
+	proxyDefs.Items = live
+	if len(proxyDefs.Items) == 0 {
+		return nil, nil
+	}
+
+	// Sort by name so that the choice is stable if more than one default was marked
+	sort.Slice(proxyDefs.Items, func(i, j int) bool {
+		return proxyDefs.Items[i].Name < proxyDefs.Items[j].Name
+	})
+	for i := range proxyDefs.Items {
+		if proxyDefs.Items[i].Annotations[proxyv1alpha1.DefaultProxyDefAnnotation] == "true" {
+			return &proxyDefs.Items[i], nil
+		}
+	}
+	if len(proxyDefs.Items) == 1 {
+		return &proxyDefs.Items[0], nil
+	}
+
+	log.Info("Multiple ProxyDefs found but none is marked as default", "namespace", namespace, "count", len(proxyDefs.Items))
+	return nil, nil
+}
+
+// resolveClusterProxyDef figures out which ClusterProxyDef selects the given namespace.
+// As with ProxyDefs, the one marked as default wins when several match, or the only
+// matching one is used, and ClusterProxyDefs being deleted are ignored. A nil
+// ClusterProxyDef is returned when none applies.
+func (a *PodMutator) resolveClusterProxyDef(ctx context.Context, namespace string) (*proxyv1alpha1.ClusterProxyDef, error) {
+	log := logf.FromContext(ctx)
+
+	clusterProxyDefs := &proxyv1alpha1.ClusterProxyDefList{}
+	if err := a.Client.List(ctx, clusterProxyDefs); err != nil {
+		return nil, err
+	}
+	if len(clusterProxyDefs.Items) == 0 {
+		return nil, nil
+	}
+
+	ns := &corev1.Namespace{}
+	if err := a.Client.Get(ctx, client.ObjectKey{Name: namespace}, ns); err != nil {
+		return nil, err
+	}
+
+	matching := []proxyv1alpha1.ClusterProxyDef{}
+	for _, clusterProxyDef := range clusterProxyDefs.Items {
+		if clusterProxyDef.DeletionTimestamp != nil {
+			continue
+		}
+		selector := labels.Everything()
+		if clusterProxyDef.Spec.NamespaceSelector != nil {
+			var err error
+			selector, err = metav1.LabelSelectorAsSelector(clusterProxyDef.Spec.NamespaceSelector)
+			if err != nil {
+				log.Info("Ignoring ClusterProxyDef with an invalid namespace selector", "name", clusterProxyDef.Name, "err", err)
+				continue
+			}
+		}
+		if selector.Matches(labels.Set(ns.Labels)) {
+			matching = append(matching, clusterProxyDef)
+		}
+	}
+	if len(matching) == 0 {
+		return nil, nil
+	}
+
+	// Sort by name so that the choice is stable if more than one default was marked
+	sort.Slice(matching, func(i, j int) bool {
+		return matching[i].Name < matching[j].Name
+	})
+	for i := range matching {
+		if matching[i].Annotations[proxyv1alpha1.DefaultProxyDefAnnotation] == "true" {
+			return &matching[i], nil
+		}
+	}
+	if len(matching) == 1 {
+		return &matching[0], nil
 	}
 
-	log.Info("Patching Pod with proxy environment", "err", nil)
-	return admission.PatchResponseFromRaw(req.Object.Raw, marshaledPod)
+	log.Info("Multiple ClusterProxyDefs select the namespace but none is marked as default", "namespace", namespace, "count", len(matching))
+	return nil, nil
 }
@@ -0,0 +1,949 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	proxyv1alpha1 "github.com/igordcard/proxius/api/v1alpha1"
+)
+
+// newProxyDef returns a ProxyDef that already has its ConfigMap generated
+func newProxyDef(name string, annotations map[string]string) *proxyv1alpha1.ProxyDef {
+	return &proxyv1alpha1.ProxyDef{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "default",
+			Annotations: annotations,
+		},
+		Spec: proxyv1alpha1.ProxyDefSpec{
+			HTTPProxy: "http://proxy.example.com:3128",
+		},
+		Status: proxyv1alpha1.ProxyDefStatus{
+			ConfigMapName: name + "-config",
+		},
+	}
+}
+
+// newClusterProxyDef returns a ClusterProxyDef selecting namespaces with the given labels
+// that already has its ConfigMaps generated
+func newClusterProxyDef(name string, matchLabels map[string]string) *proxyv1alpha1.ClusterProxyDef {
+	return &proxyv1alpha1.ClusterProxyDef{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: proxyv1alpha1.ClusterProxyDefSpec{
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: matchLabels},
+			ProxyDefSpec: proxyv1alpha1.ProxyDefSpec{
+				HTTPProxy: "http://cluster-proxy.example.com:3128",
+			},
+		},
+		Status: proxyv1alpha1.ClusterProxyDefStatus{
+			ConfigMapName: name + "-cluster-config",
+		},
+	}
+}
+
+// newNamespace returns the default namespace with the given labels
+func newNamespace(namespaceLabels map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "default",
+			Labels: namespaceLabels,
+		},
+	}
+}
+
+// newPod returns a Pod with a single container in the default namespace
+func newPod(annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "app",
+			Namespace:   "default",
+			Annotations: annotations,
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "busybox"}},
+		},
+	}
+}
+
+// normalizedValue round-trips a patch value through JSON, as the API server would see it
+func normalizedValue(value interface{}) interface{} {
+	raw, err := json.Marshal(value)
+	Expect(err).NotTo(HaveOccurred())
+	var normalized interface{}
+	Expect(json.Unmarshal(raw, &normalized)).To(Succeed())
+	return normalized
+}
+
+// patchedConfigMaps returns the ConfigMap names referenced by the JSON patch of a response
+func patchedConfigMaps(resp admission.Response) []string {
+	return patchedRefs(resp, "configMapRef")
+}
+
+// patchedSecrets returns the Secret names referenced by the JSON patch of a response
+func patchedSecrets(resp admission.Response) []string {
+	return patchedRefs(resp, "secretRef")
+}
+
+// patchedRefs returns the names of the envFrom references of the given kind in the JSON patch of a response
+func patchedRefs(resp admission.Response, kind string) []string {
+	names := []string{}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			if ref, ok := t[kind].(map[string]interface{}); ok {
+				names = append(names, ref["name"].(string))
+			}
+			for _, child := range t {
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range t {
+				walk(child)
+			}
+		}
+	}
+	for _, patch := range resp.Patches {
+		walk(normalizedValue(patch.Value))
+	}
+	return names
+}
+
+// patchedAnnotation returns the value given to a Pod annotation by the JSON patch of a response
+func patchedAnnotation(resp admission.Response, key string) string {
+	escaped := strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+	for _, patch := range resp.Patches {
+		switch patch.Path {
+		case "/metadata/annotations":
+			if annotations, ok := normalizedValue(patch.Value).(map[string]interface{}); ok {
+				if value, ok := annotations[key].(string); ok {
+					return value
+				}
+			}
+		case "/metadata/annotations/" + escaped:
+			if value, ok := normalizedValue(patch.Value).(string); ok {
+				return value
+			}
+		}
+	}
+	return ""
+}
+
+var _ = Describe("Pod Webhook", func() {
+	ctx := context.Background()
+
+	Context("When resolving the ProxyDef of a Pod", func() {
+		It("should skip Pods in namespaces without ProxyDefs", func() {
+			mutator := newPodMutator()
+
+			resp := mutator.Handle(ctx, podAdmissionRequest(newPod(nil), admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patches).To(BeEmpty())
+		})
+
+		It("should use the only ProxyDef of the namespace regardless of its name", func() {
+			mutator := newPodMutator(newProxyDef("corporate", nil))
+
+			resp := mutator.Handle(ctx, podAdmissionRequest(newPod(nil), admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(patchedConfigMaps(resp)).To(ConsistOf("corporate-config"))
+		})
+
+		It("should prefer the ProxyDef marked as default", func() {
+			mutator := newPodMutator(
+				newProxyDef("a", nil),
+				newProxyDef("b", map[string]string{proxyv1alpha1.DefaultProxyDefAnnotation: "true"}),
+			)
+
+			resp := mutator.Handle(ctx, podAdmissionRequest(newPod(nil), admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(patchedConfigMaps(resp)).To(ConsistOf("b-config"))
+		})
+
+		It("should not guess between several ProxyDefs without a default", func() {
+			mutator := newPodMutator(newProxyDef("a", nil), newProxyDef("b", nil))
+
+			resp := mutator.Handle(ctx, podAdmissionRequest(newPod(nil), admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patches).To(BeEmpty())
+		})
+
+		It("should honour the ProxyDef named by the Pod annotation", func() {
+			mutator := newPodMutator(
+				newProxyDef("a", map[string]string{proxyv1alpha1.DefaultProxyDefAnnotation: "true"}),
+				newProxyDef("b", nil),
+			)
+
+			pod := newPod(map[string]string{proxyv1alpha1.ProxyDefAnnotation: "b"})
+			resp := mutator.Handle(ctx, podAdmissionRequest(pod, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(patchedConfigMaps(resp)).To(ConsistOf("b-config"))
+		})
+
+		It("should skip ProxyDefs whose ConfigMap has not been generated yet", func() {
+			proxyDef := newProxyDef("corporate", nil)
+			proxyDef.Status.ConfigMapName = ""
+			mutator := newPodMutator(proxyDef)
+
+			resp := mutator.Handle(ctx, podAdmissionRequest(newPod(nil), admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patches).To(BeEmpty())
+		})
+
+		It("should ignore ProxyDefs being deleted", func() {
+			deleting := newProxyDef("deleting", map[string]string{proxyv1alpha1.DefaultProxyDefAnnotation: "true"})
+			deleting.Finalizers = []string{"proxy.igordc.com/finalizer"}
+			deleting.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+			mutator := newPodMutator(deleting, newProxyDef("corporate", nil))
+
+			resp := mutator.Handle(ctx, podAdmissionRequest(newPod(nil), admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(patchedConfigMaps(resp)).To(ConsistOf("corporate-config"))
+
+			pod := newPod(map[string]string{proxyv1alpha1.ProxyDefAnnotation: "deleting"})
+			resp = mutator.Handle(ctx, podAdmissionRequest(pod, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patches).To(BeEmpty())
+		})
+	})
+
+	Context("When falling back to ClusterProxyDefs", func() {
+		It("should use a ClusterProxyDef selecting the namespace", func() {
+			mutator := newPodMutator(
+				newNamespace(map[string]string{"proxy": "corporate"}),
+				newClusterProxyDef("corporate", map[string]string{"proxy": "corporate"}),
+				newClusterProxyDef("other", map[string]string{"proxy": "other"}),
+			)
+
+			resp := mutator.Handle(ctx, podAdmissionRequest(newPod(nil), admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(patchedConfigMaps(resp)).To(ConsistOf("corporate-cluster-config"))
+		})
+
+		It("should skip namespaces not selected by any ClusterProxyDef", func() {
+			mutator := newPodMutator(
+				newNamespace(nil),
+				newClusterProxyDef("corporate", map[string]string{"proxy": "corporate"}),
+			)
+
+			resp := mutator.Handle(ctx, podAdmissionRequest(newPod(nil), admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patches).To(BeEmpty())
+		})
+
+		It("should ignore ClusterProxyDefs being deleted", func() {
+			deleting := newClusterProxyDef("deleting", nil)
+			deleting.Annotations = map[string]string{proxyv1alpha1.DefaultProxyDefAnnotation: "true"}
+			deleting.Finalizers = []string{"proxy.igordc.com/finalizer"}
+			deleting.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+			mutator := newPodMutator(newNamespace(nil), deleting, newClusterProxyDef("corporate", nil))
+
+			resp := mutator.Handle(ctx, podAdmissionRequest(newPod(nil), admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(patchedConfigMaps(resp)).To(ConsistOf("corporate-cluster-config"))
+		})
+
+		It("should give precedence to the ProxyDef of the namespace", func() {
+			mutator := newPodMutator(
+				newNamespace(nil),
+				newClusterProxyDef("corporate", nil),
+				newProxyDef("local", nil),
+			)
+
+			resp := mutator.Handle(ctx, podAdmissionRequest(newPod(nil), admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(patchedConfigMaps(resp)).To(ConsistOf("local-config"))
+		})
+	})
+
+	Context("When scoping injection", func() {
+		It("should skip Pods not matched by the pod selector", func() {
+			proxyDef := newProxyDef("corporate", nil)
+			proxyDef.Spec.PodSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"egress": "proxy"}}
+			mutator := newPodMutator(proxyDef)
+
+			resp := mutator.Handle(ctx, podAdmissionRequest(newPod(nil), admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patches).To(BeEmpty())
+
+			pod := newPod(nil)
+			pod.Labels = map[string]string{"egress": "proxy"}
+			resp = mutator.Handle(ctx, podAdmissionRequest(pod, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(patchedConfigMaps(resp)).To(ConsistOf("corporate-config"))
+		})
+
+		It("should only inject the selected containers", func() {
+			proxyDef := newProxyDef("corporate", nil)
+			proxyDef.Spec.IncludeContainers = []string{"app", "envoy"}
+			proxyDef.Spec.ExcludeContainers = []string{"envoy"}
+			mutator := newPodMutator(proxyDef)
+
+			pod := newPod(nil)
+			pod.Spec.Containers = append(pod.Spec.Containers,
+				corev1.Container{Name: "envoy", Image: "envoy"},
+				corev1.Container{Name: "logger", Image: "fluentbit"},
+			)
+			resp := mutator.Handle(ctx, podAdmissionRequest(pod, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			paths := []string{}
+			for _, patch := range resp.Patches {
+				paths = append(paths, patch.Path)
+			}
+			Expect(paths).To(ContainElement("/spec/containers/0/envFrom"))
+			Expect(paths).NotTo(ContainElement(HavePrefix("/spec/containers/1")))
+			Expect(paths).NotTo(ContainElement(HavePrefix("/spec/containers/2")))
+		})
+	})
+
+	Context("When honouring Pod annotations", func() {
+		It("should not inject Pods that opted out", func() {
+			mutator := newPodMutator(newProxyDef("corporate", nil))
+
+			pod := newPod(map[string]string{proxyv1alpha1.InjectAnnotation: "false"})
+			resp := mutator.Handle(ctx, podAdmissionRequest(pod, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patches).To(BeEmpty())
+		})
+
+		It("should skip containers excluded by the Pod", func() {
+			mutator := newPodMutator(newProxyDef("corporate", nil))
+
+			pod := newPod(map[string]string{proxyv1alpha1.ExcludeContainersAnnotation: "istio-proxy, envoy"})
+			pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "envoy", Image: "envoy"})
+			resp := mutator.Handle(ctx, podAdmissionRequest(pod, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(patchedConfigMaps(resp)).To(ConsistOf("corporate-config"))
+			for _, patch := range resp.Patches {
+				Expect(patch.Path).NotTo(HavePrefix("/spec/containers/1"))
+			}
+		})
+
+		It("should record where the injected settings came from", func() {
+			proxyDef := newProxyDef("corporate", nil)
+			proxyDef.Generation = 3
+			mutator := newPodMutator(proxyDef)
+
+			resp := mutator.Handle(ctx, podAdmissionRequest(newPod(nil), admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(patchedAnnotation(resp, proxyv1alpha1.InjectedFromAnnotation)).To(Equal("default/corporate@3"))
+
+			clusterProxyDef := newClusterProxyDef("corporate", nil)
+			clusterProxyDef.Generation = 2
+			mutator = newPodMutator(newNamespace(nil), clusterProxyDef)
+
+			resp = mutator.Handle(ctx, podAdmissionRequest(newPod(map[string]string{"team": "a"}), admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(patchedAnnotation(resp, proxyv1alpha1.InjectedFromAnnotation)).To(Equal("corporate@2"))
+		})
+	})
+
+	Context("When the Pod was already injected", func() {
+		It("should not mutate Pod updates", func() {
+			mutator := newPodMutator(newProxyDef("corporate", nil))
+
+			resp := mutator.Handle(ctx, podAdmissionRequest(newPod(nil), admissionv1.Update))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patches).To(BeEmpty())
+		})
+
+		It("should not stack references to the same ConfigMap", func() {
+			mutator := newPodMutator(newProxyDef("corporate", nil))
+
+			pod := newPod(nil)
+			pod.Spec.Containers[0].EnvFrom = []corev1.EnvFromSource{{
+				ConfigMapRef: &corev1.ConfigMapEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "corporate-config"},
+				},
+			}}
+			resp := mutator.Handle(ctx, podAdmissionRequest(pod, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patches).To(BeEmpty())
+		})
+
+		It("should only patch the injected fields", func() {
+			mutator := newPodMutator(newProxyDef("corporate", nil))
+
+			pod := newPod(map[string]string{"team": "a"})
+			pod.Spec.Containers[0].EnvFrom = []corev1.EnvFromSource{{
+				ConfigMapRef: &corev1.ConfigMapEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "app-config"},
+				},
+			}}
+			resp := mutator.Handle(ctx, podAdmissionRequest(pod, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+
+			paths := []string{}
+			for _, patch := range resp.Patches {
+				Expect(patch.Operation).To(Equal("add"))
+				paths = append(paths, patch.Path)
+			}
+			Expect(paths).To(ConsistOf(
+				"/spec/containers/0/envFrom/-",
+				"/metadata/annotations/proxius.igordc.com~1injected-from",
+			))
+		})
+	})
+
+	Context("When injecting other kinds of containers", func() {
+		It("should inject init containers, including native sidecars", func() {
+			mutator := newPodMutator(newProxyDef("corporate", nil))
+
+			always := corev1.ContainerRestartPolicyAlways
+			pod := newPod(nil)
+			pod.Spec.InitContainers = []corev1.Container{
+				{Name: "git-clone", Image: "alpine/git"},
+				{Name: "sidecar", Image: "busybox", RestartPolicy: &always},
+			}
+			resp := mutator.Handle(ctx, podAdmissionRequest(pod, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+
+			paths := []string{}
+			for _, patch := range resp.Patches {
+				paths = append(paths, patch.Path)
+			}
+			Expect(paths).To(ContainElements(
+				"/spec/initContainers/0/envFrom",
+				"/spec/initContainers/1/envFrom",
+				"/spec/containers/0/envFrom",
+			))
+		})
+
+		It("should only inject new ephemeral containers when opted in", func() {
+			oldPod := newPod(nil)
+			oldPod.Spec.EphemeralContainers = []corev1.EphemeralContainer{{
+				EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger-1", Image: "busybox"},
+			}}
+			pod := oldPod.DeepCopy()
+			pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, corev1.EphemeralContainer{
+				EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger-2", Image: "busybox"},
+			})
+			req := podAdmissionRequest(pod, admissionv1.Update)
+			req.SubResource = "ephemeralcontainers"
+			raw, err := json.Marshal(oldPod)
+			Expect(err).NotTo(HaveOccurred())
+			req.OldObject.Raw = raw
+
+			By("leaving ephemeral containers alone by default")
+			resp := newPodMutator(newProxyDef("corporate", nil)).Handle(ctx, req)
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patches).To(BeEmpty())
+
+			By("injecting the new ephemeral container once opted in")
+			proxyDef := newProxyDef("corporate", nil)
+			proxyDef.Spec.InjectEphemeralContainers = true
+			resp = newPodMutator(proxyDef).Handle(ctx, req)
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patches).To(HaveLen(1))
+			Expect(resp.Patches[0].Path).To(Equal("/spec/ephemeralContainers/1/envFrom"))
+		})
+	})
+
+	Context("When the ProxyDef has credentials", func() {
+		It("should inject the generated Secret next to the ConfigMap", func() {
+			proxyDef := newProxyDef("corporate", nil)
+			proxyDef.Spec.CredentialsSecretRef = &proxyv1alpha1.CredentialsSecretReference{Name: "proxy-auth"}
+			proxyDef.Status.SecretName = "corporate-credentials"
+
+			resp := newPodMutator(proxyDef).Handle(ctx, podAdmissionRequest(newPod(nil), admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(patchedConfigMaps(resp)).To(ConsistOf("corporate-config"))
+			Expect(patchedSecrets(resp)).To(ConsistOf("corporate-credentials"))
+		})
+
+		It("should not stack references to the same Secret", func() {
+			proxyDef := newProxyDef("corporate", nil)
+			proxyDef.Status.SecretName = "corporate-credentials"
+			pod := newPod(nil)
+			pod.Spec.Containers[0].EnvFrom = []corev1.EnvFromSource{{
+				SecretRef: &corev1.SecretEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "corporate-credentials"},
+				},
+			}}
+
+			resp := newPodMutator(proxyDef).Handle(ctx, podAdmissionRequest(pod, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(patchedConfigMaps(resp)).To(ConsistOf("corporate-config"))
+			Expect(patchedSecrets(resp)).To(BeEmpty())
+		})
+	})
+
+	Context("When the ProxyDef has a configuration hash", func() {
+		It("should record it on the Pod", func() {
+			proxyDef := newProxyDef("corporate", nil)
+			proxyDef.Status.ConfigHash = "0123456789abcdef"
+
+			resp := newPodMutator(proxyDef).Handle(ctx, podAdmissionRequest(newPod(nil), admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(patchedAnnotation(resp, proxyv1alpha1.ConfigHashAnnotation)).To(Equal("0123456789abcdef"))
+		})
+	})
+
+	Context("When the Pod selects a NO_PROXY format", func() {
+		It("should point NO_PROXY at the variant selected for each container", func() {
+			proxyDef := newProxyDef("corporate", nil)
+			proxyDef.Spec.NoProxyFormat = proxyv1alpha1.NoProxyFormatCIDR
+			proxyDef.Status.VariantsConfigMapName = "corporate-config-variants"
+			pod := newPod(map[string]string{
+				proxyv1alpha1.NoProxyFormatAnnotation: "expanded,legacy=wildcard,modern=cidr",
+			})
+			pod.Spec.Containers = []corev1.Container{
+				{Name: "app", Image: "busybox"},
+				{Name: "legacy", Image: "busybox"},
+				{Name: "modern", Image: "busybox"},
+			}
+
+			resp := newPodMutator(proxyDef).Handle(ctx, podAdmissionRequest(pod, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+
+			keys := map[string][]string{}
+			for _, patch := range resp.Patches {
+				if !strings.HasSuffix(patch.Path, "/env") {
+					continue
+				}
+				for _, env := range normalizedValue(patch.Value).([]interface{}) {
+					ref := env.(map[string]interface{})["valueFrom"].(map[string]interface{})["configMapKeyRef"].(map[string]interface{})
+					Expect(ref["name"]).To(Equal("corporate-config-variants"))
+					keys[patch.Path] = append(keys[patch.Path], ref["key"].(string))
+				}
+			}
+			Expect(keys).To(HaveLen(2))
+			Expect(keys).To(HaveKey("/spec/containers/0/env"))
+			Expect(keys).To(HaveKey("/spec/containers/1/env"))
+			Expect(keys["/spec/containers/1/env"]).To(ConsistOf(
+				proxyv1alpha1.NoProxyVariantKey(proxyv1alpha1.NoProxyFormatWildcard),
+			))
+		})
+
+		It("should ignore the annotation when the ProxyDef renders no variants", func() {
+			pod := newPod(map[string]string{proxyv1alpha1.NoProxyFormatAnnotation: "expanded"})
+
+			resp := newPodMutator(newProxyDef("corporate", nil)).Handle(ctx, podAdmissionRequest(pod, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			for _, patch := range resp.Patches {
+				Expect(patch.Path).NotTo(HaveSuffix("/env"))
+			}
+		})
+	})
+
+	Context("When the ProxyDef renders JVM system properties", func() {
+		newJavaProxyDef := func(ready bool) *proxyv1alpha1.ProxyDef {
+			proxyDef := newProxyDef("corporate", nil)
+			proxyDef.Spec.InjectJavaToolOptions = true
+			proxyDef.Status.VariantsConfigMapName = "corporate-config-variants"
+			if ready {
+				proxyDef.Status.Conditions = []metav1.Condition{{
+					Type:   "Ready",
+					Status: metav1.ConditionTrue,
+					Reason: "ConfigMapInSync",
+				}}
+			}
+			return proxyDef
+		}
+
+		It("should append them to JAVA_TOOL_OPTIONS, keeping the container's own options", func() {
+			pod := newPod(nil)
+			pod.Spec.Containers = []corev1.Container{
+				{Name: "app", Image: "busybox"},
+				{Name: "jvm", Image: "busybox", Env: []corev1.EnvVar{
+					{Name: "JAVA_TOOL_OPTIONS", Value: "-Xmx1g"},
+				}},
+			}
+
+			resp := newPodMutator(newJavaProxyDef(true)).Handle(ctx, podAdmissionRequest(pod, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+
+			helper := HaveKeyWithValue("valueFrom", HaveKeyWithValue("configMapKeyRef", And(
+				HaveKeyWithValue("name", "corporate-config-variants"),
+				HaveKeyWithValue("key", proxyv1alpha1.JavaToolOptionsKey),
+			)))
+			values := map[string][]interface{}{}
+			for _, patch := range resp.Patches {
+				values[patch.Path] = append(values[patch.Path], normalizedValue(patch.Value))
+			}
+			// The helper variable is defined before the reference to it, and never loaded through envFrom
+			Expect(values).To(HaveKeyWithValue("/spec/containers/0/env", ConsistOf(ConsistOf(
+				And(HaveKeyWithValue("name", proxyv1alpha1.JavaToolOptionsKey), helper),
+			))))
+			Expect(values).To(HaveKeyWithValue("/spec/containers/0/env/-", ConsistOf(
+				HaveKeyWithValue("value", "$(PROXIUS_JAVA_TOOL_OPTIONS)"),
+			)))
+			Expect(values).To(HaveKeyWithValue("/spec/containers/1/env/0", ConsistOf(
+				And(HaveKeyWithValue("name", proxyv1alpha1.JavaToolOptionsKey), helper),
+			)))
+			Expect(values).To(HaveKeyWithValue("/spec/containers/1/env/-", ConsistOf(
+				HaveKeyWithValue("value", "-Xmx1g $(PROXIUS_JAVA_TOOL_OPTIONS)"),
+			)))
+
+			By("not appending them twice")
+			pod.Spec.Containers[1].Env = []corev1.EnvVar{
+				{Name: proxyv1alpha1.JavaToolOptionsKey, ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "corporate-config-variants"},
+					Key:                  proxyv1alpha1.JavaToolOptionsKey,
+				}}},
+				{Name: "JAVA_TOOL_OPTIONS", Value: "-Xmx1g $(PROXIUS_JAVA_TOOL_OPTIONS)"},
+			}
+			resp = newPodMutator(newJavaProxyDef(true)).Handle(ctx, podAdmissionRequest(pod, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			for _, patch := range resp.Patches {
+				Expect(patch.Path).NotTo(HavePrefix("/spec/containers/1/env/"))
+			}
+		})
+
+		It("should wait for the controller to render them", func() {
+			resp := newPodMutator(newJavaProxyDef(false)).Handle(ctx, podAdmissionRequest(newPod(nil), admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			for _, patch := range resp.Patches {
+				Expect(patch.Path).NotTo(HaveSuffix("/env"))
+			}
+		})
+	})
+
+	Context("When the ProxyDef tolerates missing generated objects", func() {
+		// patchedEnv returns the literal env values patched into each container
+		patchedEnv := func(resp admission.Response) map[string]map[string]string {
+			envs := map[string]map[string]string{}
+			for _, patch := range resp.Patches {
+				var values []interface{}
+				switch {
+				case strings.HasSuffix(patch.Path, "/env"):
+					values = normalizedValue(patch.Value).([]interface{})
+				case strings.HasSuffix(patch.Path, "/env/-"):
+					values = []interface{}{normalizedValue(patch.Value)}
+				default:
+					continue
+				}
+				container := patch.Path[:strings.Index(patch.Path, "/env")]
+				for _, value := range values {
+					env := value.(map[string]interface{})
+					if envs[container] == nil {
+						envs[container] = map[string]string{}
+					}
+					envs[container][env["name"].(string)], _ = env["value"].(string)
+				}
+			}
+			return envs
+		}
+
+		It("should reference the generated objects as optional", func() {
+			proxyDef := newProxyDef("corporate", nil)
+			proxyDef.Spec.InjectionFailureMode = proxyv1alpha1.InjectionFailureModeOptional
+			proxyDef.Status.SecretName = "corporate-credentials"
+
+			resp := newPodMutator(proxyDef).Handle(ctx, podAdmissionRequest(newPod(nil), admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(patchedConfigMaps(resp)).To(ConsistOf("corporate-config"))
+			Expect(patchedSecrets(resp)).To(ConsistOf("corporate-credentials"))
+			for _, patch := range resp.Patches {
+				switch {
+				case strings.HasSuffix(patch.Path, "/envFrom"):
+					Expect(normalizedValue(patch.Value)).To(HaveEach(Or(
+						HaveKeyWithValue("configMapRef", HaveKeyWithValue("optional", true)),
+						HaveKeyWithValue("secretRef", HaveKeyWithValue("optional", true)),
+					)))
+				case strings.HasSuffix(patch.Path, "/envFrom/-"):
+					Expect(normalizedValue(patch.Value)).To(Or(
+						HaveKeyWithValue("configMapRef", HaveKeyWithValue("optional", true)),
+						HaveKeyWithValue("secretRef", HaveKeyWithValue("optional", true)),
+					))
+				}
+			}
+		})
+
+		It("should copy the values of the ConfigMap into the Pod when inlining them", func() {
+			proxyDef := newProxyDef("corporate", nil)
+			proxyDef.Spec.InjectionFailureMode = proxyv1alpha1.InjectionFailureModeInline
+			proxyDef.Spec.NoProxyFormat = proxyv1alpha1.NoProxyFormatCIDR
+			proxyDef.Status.VariantsConfigMapName = "corporate-config-variants"
+			configMap := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "corporate-config", Namespace: "default"},
+				Data: map[string]string{
+					"HTTP_PROXY": "http://proxy.example.com:3128",
+					"http_proxy": "http://proxy.example.com:3128",
+					"NO_PROXY":   "10.0.0.0/31",
+					"no_proxy":   "10.0.0.0/31",
+				},
+			}
+			variants := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "corporate-config-variants", Namespace: "default"},
+				Data: map[string]string{
+					proxyv1alpha1.NoProxyVariantKey(proxyv1alpha1.NoProxyFormatExpanded): "10.0.0.0,10.0.0.1",
+				},
+			}
+			pod := newPod(map[string]string{proxyv1alpha1.NoProxyFormatAnnotation: "legacy=expanded"})
+			pod.Spec.Containers = []corev1.Container{
+				{Name: "app", Image: "busybox", Env: []corev1.EnvVar{{Name: "HTTP_PROXY", Value: "http://own:3128"}}},
+				{Name: "legacy", Image: "busybox"},
+			}
+
+			resp := newPodMutator(proxyDef, configMap, variants).Handle(ctx, podAdmissionRequest(pod, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Warnings).To(ConsistOf(ContainSubstring("app=HTTP_PROXY")))
+			Expect(patchedConfigMaps(resp)).To(BeEmpty())
+			envs := patchedEnv(resp)
+			Expect(envs["/spec/containers/0"]).To(Equal(map[string]string{
+				"http_proxy": "http://own:3128",
+				"NO_PROXY":   "10.0.0.0/31",
+				"no_proxy":   "10.0.0.0/31",
+			}))
+			Expect(envs["/spec/containers/1"]).To(Equal(map[string]string{
+				"HTTP_PROXY": "http://proxy.example.com:3128",
+				"http_proxy": "http://proxy.example.com:3128",
+				"NO_PROXY":   "10.0.0.0,10.0.0.1",
+				"no_proxy":   "10.0.0.0,10.0.0.1",
+			}))
+		})
+
+		It("should fall back to optional references when the ConfigMap cannot be inlined", func() {
+			proxyDef := newProxyDef("corporate", nil)
+			proxyDef.Spec.InjectionFailureMode = proxyv1alpha1.InjectionFailureModeInline
+
+			resp := newPodMutator(proxyDef).Handle(ctx, podAdmissionRequest(newPod(nil), admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Warnings).To(ConsistOf(ContainSubstring("corporate-config")))
+			Expect(patchedConfigMaps(resp)).To(ConsistOf("corporate-config"))
+		})
+	})
+
+	Context("When containers define proxy variables themselves", func() {
+		newConflictingPod := func() *corev1.Pod {
+			pod := newPod(nil)
+			pod.Spec.Containers[0].Env = []corev1.EnvVar{
+				{Name: "HTTP_PROXY", Value: "http://own:3128"},
+				{Name: "LOG_LEVEL", Value: "debug"},
+				{Name: "https_proxy", Value: "http://own:3129"},
+			}
+			return pod
+		}
+
+		It("should give the container's own definition to every form of a variable by default", func() {
+			resp := newPodMutator(newProxyDef("corporate", nil)).Handle(ctx, podAdmissionRequest(newConflictingPod(), admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(patchedConfigMaps(resp)).To(ConsistOf("corporate-config"))
+			Expect(patchedAnnotation(resp, proxyv1alpha1.EnvConflictsAnnotation)).To(Equal("app=HTTP_PROXY,https_proxy"))
+			Expect(resp.Warnings).To(ConsistOf(ContainSubstring("respect-existing")))
+
+			added := []interface{}{}
+			for _, patch := range resp.Patches {
+				if patch.Path == "/spec/containers/0/env/-" {
+					added = append(added, normalizedValue(patch.Value))
+				}
+			}
+			Expect(added).To(ConsistOf(
+				And(HaveKeyWithValue("name", "http_proxy"), HaveKeyWithValue("value", "http://own:3128")),
+				And(HaveKeyWithValue("name", "HTTPS_PROXY"), HaveKeyWithValue("value", "http://own:3129")),
+			))
+		})
+
+		It("should leave the variables loaded with envFrom to the injected ones, which come after them", func() {
+			appEnv := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "app-env", Namespace: "default"},
+				Data:       map[string]string{"https_proxy": "http://own:3128"},
+			}
+			pod := newPod(nil)
+			pod.Spec.Containers[0].EnvFrom = []corev1.EnvFromSource{{
+				ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app-env"}},
+			}}
+
+			resp := newPodMutator(newProxyDef("corporate", nil), appEnv).Handle(ctx, podAdmissionRequest(pod, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(patchedAnnotation(resp, proxyv1alpha1.EnvConflictsAnnotation)).To(BeEmpty())
+			Expect(resp.Warnings).To(BeEmpty())
+			Expect(patchedConfigMaps(resp)).To(ConsistOf("corporate-config"))
+		})
+
+		It("should remove the container's own definitions when overriding them", func() {
+			proxyDef := newProxyDef("corporate", nil)
+			proxyDef.Spec.EnvConflictPolicy = proxyv1alpha1.EnvConflictPolicyOverride
+
+			resp := newPodMutator(proxyDef).Handle(ctx, podAdmissionRequest(newConflictingPod(), admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(patchedConfigMaps(resp)).To(ConsistOf("corporate-config"))
+			Expect(patchedAnnotation(resp, proxyv1alpha1.EnvConflictsAnnotation)).To(Equal("app=HTTP_PROXY,https_proxy"))
+
+			removed := []string{}
+			for _, patch := range resp.Patches {
+				if patch.Operation == "remove" {
+					removed = append(removed, patch.Path)
+				}
+			}
+			Expect(removed).To(Equal([]string{"/spec/containers/0/env/2", "/spec/containers/0/env/0"}))
+		})
+
+		It("should deny the Pod when rejecting conflicts", func() {
+			proxyDef := newProxyDef("corporate", nil)
+			proxyDef.Spec.EnvConflictPolicy = proxyv1alpha1.EnvConflictPolicyReject
+
+			resp := newPodMutator(proxyDef).Handle(ctx, podAdmissionRequest(newConflictingPod(), admissionv1.Create))
+			Expect(resp.Allowed).To(BeFalse())
+			Expect(resp.Result.Message).To(ContainSubstring("app=HTTP_PROXY,https_proxy"))
+
+			By("admitting Pods without conflicts")
+			resp = newPodMutator(proxyDef).Handle(ctx, podAdmissionRequest(newPod(nil), admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(patchedConfigMaps(resp)).To(ConsistOf("corporate-config"))
+		})
+	})
+
+	Context("When the ProxyDef distributes a trusted CA bundle", func() {
+		newTrustedCAProxyDef := func() *proxyv1alpha1.ProxyDef {
+			proxyDef := newProxyDef("corporate", nil)
+			proxyDef.Spec.TrustedCA = &proxyv1alpha1.TrustedCA{ConfigMapRef: &proxyv1alpha1.CABundleReference{Name: "corporate-ca"}}
+			proxyDef.Status.TrustedCAConfigMapName = "corporate-trusted-ca"
+			return proxyDef
+		}
+
+		It("should mount the bundle into every injected container", func() {
+			pod := newPod(nil)
+			pod.Spec.InitContainers = []corev1.Container{{Name: "git-clone", Image: "alpine/git"}}
+			pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "data", MountPath: "/data"}}
+			pod.Spec.Volumes = []corev1.Volume{{Name: "data", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}}
+
+			resp := newPodMutator(newTrustedCAProxyDef()).Handle(ctx, podAdmissionRequest(pod, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			mount := normalizedValue(corev1.VolumeMount{Name: "proxius-trusted-ca", MountPath: proxyv1alpha1.TrustedCAMountPath, ReadOnly: true})
+			volumes := 0
+			paths := []string{}
+			for _, patch := range resp.Patches {
+				paths = append(paths, patch.Path)
+				switch patch.Path {
+				case "/spec/initContainers/0/volumeMounts":
+					Expect(normalizedValue(patch.Value)).To(ConsistOf(mount))
+				case "/spec/containers/0/volumeMounts/-":
+					Expect(normalizedValue(patch.Value)).To(Equal(mount))
+				case "/spec/volumes/-":
+					volumes++
+					Expect(normalizedValue(patch.Value)).To(HaveKeyWithValue("configMap", HaveKeyWithValue("name", "corporate-trusted-ca")))
+				}
+			}
+			Expect(paths).To(ContainElements("/spec/initContainers/0/volumeMounts", "/spec/containers/0/volumeMounts/-"))
+			Expect(volumes).To(Equal(1))
+		})
+
+		It("should reuse the volume of a Pod created from an already injected spec", func() {
+			pod := newPod(nil)
+			pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "ca", MountPath: proxyv1alpha1.TrustedCAMountPath, ReadOnly: true}}
+			pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "sidecar", Image: "busybox"})
+			pod.Spec.Volumes = []corev1.Volume{{Name: "ca", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "corporate-trusted-ca"},
+			}}}}
+
+			resp := newPodMutator(newTrustedCAProxyDef()).Handle(ctx, podAdmissionRequest(pod, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			paths := []string{}
+			for _, patch := range resp.Patches {
+				paths = append(paths, patch.Path)
+			}
+			Expect(paths).To(ContainElement("/spec/containers/1/volumeMounts"))
+			Expect(paths).NotTo(ContainElements("/spec/containers/0/volumeMounts/-", "/spec/volumes/-"))
+		})
+
+		It("should not mount the bundle over another volume of the Pod", func() {
+			pod := newPod(nil)
+			pod.Spec.Volumes = []corev1.Volume{{Name: "proxius-trusted-ca", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}}
+
+			resp := newPodMutator(newTrustedCAProxyDef()).Handle(ctx, podAdmissionRequest(pod, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Warnings).To(ConsistOf(ContainSubstring("proxius-trusted-ca")))
+			Expect(patchedConfigMaps(resp)).To(ConsistOf("corporate-config"))
+			for _, patch := range resp.Patches {
+				Expect(patch.Path).NotTo(ContainSubstring("volume"))
+			}
+		})
+	})
+
+	Context("When the ProxyDef renders tool configuration files", func() {
+		newConfigFilesProxyDef := func() *proxyv1alpha1.ProxyDef {
+			proxyDef := newProxyDef("corporate", nil)
+			proxyDef.Spec.ConfigFiles = []proxyv1alpha1.ConfigFileProfile{proxyv1alpha1.ConfigFileProfileApt, proxyv1alpha1.ConfigFileProfilePip}
+			proxyDef.Status.ConfigFilesConfigMapName = "corporate-config-files"
+			return proxyDef
+		}
+		// patchedMounts returns the volume mounts patched into each container
+		patchedMounts := func(resp admission.Response) map[string][]interface{} {
+			mounts := map[string][]interface{}{}
+			for _, patch := range resp.Patches {
+				switch {
+				case strings.HasSuffix(patch.Path, "/volumeMounts"):
+					container := strings.TrimSuffix(patch.Path, "/volumeMounts")
+					mounts[container] = append(mounts[container], normalizedValue(patch.Value).([]interface{})...)
+				case strings.HasSuffix(patch.Path, "/volumeMounts/-"):
+					container := strings.TrimSuffix(patch.Path, "/volumeMounts/-")
+					mounts[container] = append(mounts[container], normalizedValue(patch.Value))
+				}
+			}
+			return mounts
+		}
+
+		It("should mount every file at its conventional path, unless something is mounted there already", func() {
+			pod := newPod(nil)
+			pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{
+				Name:         "builder",
+				Image:        "debian",
+				VolumeMounts: []corev1.VolumeMount{{Name: "apt", MountPath: "/etc/apt/"}},
+			})
+			pod.Spec.Volumes = []corev1.Volume{{Name: "apt", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}}
+
+			resp := newPodMutator(newConfigFilesProxyDef()).Handle(ctx, podAdmissionRequest(pod, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			apt := normalizedValue(corev1.VolumeMount{Name: "proxius-config-files", MountPath: "/etc/apt/apt.conf.d/99proxius-proxy", SubPath: "apt.conf", ReadOnly: true})
+			pip := normalizedValue(corev1.VolumeMount{Name: "proxius-config-files", MountPath: "/etc/pip.conf", SubPath: "pip.conf", ReadOnly: true})
+			mounts := patchedMounts(resp)
+			Expect(mounts["/spec/containers/0"]).To(ConsistOf(apt, pip))
+			Expect(mounts["/spec/containers/1"]).To(ConsistOf(pip))
+
+			volumes := []interface{}{}
+			for _, patch := range resp.Patches {
+				if patch.Path == "/spec/volumes/-" {
+					volumes = append(volumes, normalizedValue(patch.Value))
+				}
+			}
+			Expect(volumes).To(ConsistOf(HaveKeyWithValue("configMap", HaveKeyWithValue("name", "corporate-config-files"))))
+		})
+
+		It("should not mount files missing from an optional ConfigMap", func() {
+			proxyDef := newConfigFilesProxyDef()
+			proxyDef.Spec.InjectionFailureMode = proxyv1alpha1.InjectionFailureModeOptional
+
+			resp := newPodMutator(proxyDef).Handle(ctx, podAdmissionRequest(newPod(nil), admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Warnings).To(ConsistOf(ContainSubstring("corporate-config-files")))
+			Expect(patchedMounts(resp)).To(BeEmpty())
+
+			By("mounting them once the ConfigMap exists")
+			configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "corporate-config-files", Namespace: "default"}}
+			resp = newPodMutator(proxyDef, configMap).Handle(ctx, podAdmissionRequest(newPod(nil), admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Warnings).To(BeEmpty())
+			Expect(patchedMounts(resp)["/spec/containers/0"]).To(HaveLen(2))
+		})
+	})
+})
@@ -0,0 +1,349 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	proxyv1alpha1 "github.com/igordcard/proxius/api/v1alpha1"
+)
+
+//+kubebuilder:webhook:path=/mutate-workloads,mutating=true,failurePolicy=ignore,groups=apps;batch,resources=deployments;statefulsets;daemonsets;jobs;cronjobs,verbs=create;update,versions=v1,name=mworkload.kb.io,admissionReviewVersions=v1,sideEffects=None
+
+// WorkloadMutator injects the Pod templates of workloads for the sources using the Workload InjectionMode.
+// Its failures are ignored, since the Pod webhook still injects the Pods of the workloads it misses.
+type WorkloadMutator struct {
+	PodMutator
+}
+
+func (a *WorkloadMutator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	log := logf.FromContext(ctx)
+	if req.Operation != admissionv1.Create && req.Operation != admissionv1.Update {
+		return admission.Allowed("Only workload creations and updates are mutated")
+	}
+
+	var object client.Object
+	var template *corev1.PodTemplateSpec
+	prefix := "/spec/template"
+	switch req.Kind.Kind {
+	case "Deployment":
+		deployment := &appsv1.Deployment{}
+		object, template = deployment, &deployment.Spec.Template
+	case "StatefulSet":
+		statefulSet := &appsv1.StatefulSet{}
+		object, template = statefulSet, &statefulSet.Spec.Template
+	case "DaemonSet":
+		daemonSet := &appsv1.DaemonSet{}
+		object, template = daemonSet, &daemonSet.Spec.Template
+	case "Job":
+		// The Pod template of a Job cannot be changed once it exists
+		if req.Operation != admissionv1.Create {
+			return admission.Allowed("Only Job creations are mutated")
+		}
+		job := &batchv1.Job{}
+		object, template = job, &job.Spec.Template
+	case "CronJob":
+		cronJob := &batchv1.CronJob{}
+		object, template, prefix = cronJob, &cronJob.Spec.JobTemplate.Spec.Template, "/spec/jobTemplate/spec/template"
+	default:
+		return admission.Allowed("Not a workload with a Pod template")
+	}
+	if err := a.decoder.Decode(req, object); err != nil {
+		log.Info("Failed to decode workload", "kind", req.Kind.Kind, "err", err)
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	workload := req.Kind.Kind + " " + req.Namespace + "/" + object.GetName()
+
+	// The settings injected before are recognized by the revision recorded on the workload,
+	// which is also looked up on the old object in case it was replaced as a whole
+	previous := object.GetAnnotations()[proxyv1alpha1.InjectedFromAnnotation]
+	if previous == "" && req.Operation == admissionv1.Update {
+		old := &unstructured.Unstructured{}
+		if err := a.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			log.Info("Failed to decode old workload", "kind", req.Kind.Kind, "err", err)
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		previous = old.GetAnnotations()[proxyv1alpha1.InjectedFromAnnotation]
+	}
+
+	pod := &corev1.Pod{ObjectMeta: template.ObjectMeta, Spec: template.Spec}
+	pod.Namespace = req.Namespace
+	source, reason, err := a.resolveTemplateSource(ctx, object, pod, req.Namespace)
+	if err != nil {
+		log.Info("Failed to get ProxyDef resource", "err", err)
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if source == nil && previous == "" {
+		log.Info("Pod template of workload is not injected, skipping", "workload", workload, "reason", reason)
+		return admission.Allowed(reason)
+	}
+
+	// Whatever was injected from a previous revision, or from another source, that the
+	// current one no longer provides is taken out before injecting the template again
+	patch := newPodPatch()
+	generated := generatedNames(previous)
+	if source != nil {
+		for name := range generatedNames(source.ID()) {
+			generated[name] = true
+		}
+	}
+	stripInjected(patch, prefix, pod, source, generated)
+
+	annotations := object.GetAnnotations()
+	if source == nil {
+		log.Info("Taking the proxy environment out of the Pod template of workload", "workload", workload, "injectedFrom", previous, "reason", reason)
+		for _, key := range []string{proxyv1alpha1.InjectedFromAnnotation, proxyv1alpha1.EnvConflictsAnnotation} {
+			if _, ok := annotations[key]; ok {
+				patch.removeMapKey("/metadata/annotations", key)
+			}
+		}
+		return admission.Patched("Took out the injected proxy environment", patch.operations...)
+	}
+
+	result := a.inject(ctx, req.Namespace, source, &injectionTarget{pod: pod, prefix: prefix}, patch)
+	warnings := result.warnings
+	conflictPolicy := source.Spec.EnvConflictPolicyOrDefault()
+	if len(result.conflicts) > 0 {
+		log.Info("Containers define proxy variables themselves", "kind", source.Kind, "name", source.Name, "conflicts", result.conflicts, "envConflictPolicy", conflictPolicy)
+		if conflictPolicy == proxyv1alpha1.EnvConflictPolicyReject {
+			return admission.Denied(fmt.Sprintf("Containers define proxy variables injected from %s %s themselves: %s", source.Kind, source.Name, strings.Join(result.conflicts, "; ")))
+		}
+		warnings = append(warnings, fmt.Sprintf("Containers define proxy variables injected from %s %s themselves, resolved by the %s policy: %s", source.Kind, source.Name, conflictPolicy, strings.Join(result.conflicts, "; ")))
+	}
+
+	// The annotations go on the workload, so that they do not roll it out. A revision
+	// not rendered yet is recorded as generation 0, for the controller to sync it later.
+	revision := source.ID() + "@0"
+	if source.Current {
+		revision = source.String()
+	}
+	patch.setMapKey("/metadata/annotations", annotations, proxyv1alpha1.InjectedFromAnnotation, revision)
+	if len(result.conflicts) > 0 {
+		patch.setMapKey("/metadata/annotations", annotations, proxyv1alpha1.EnvConflictsAnnotation, strings.Join(result.conflicts, ";"))
+	} else if _, ok := annotations[proxyv1alpha1.EnvConflictsAnnotation]; ok {
+		patch.removeMapKey("/metadata/annotations", proxyv1alpha1.EnvConflictsAnnotation)
+	}
+
+	log.Info("Patching Pod template of workload with proxy environment", "workload", workload, "kind", source.Kind, "name", source.Name)
+	return admission.Patched("Injected proxy environment into the Pod template", patch.operations...).WithWarnings(warnings...)
+}
+
+// resolveTemplateSource returns the source injecting the Pod template of a workload,
+// or nil and the reason when it is not injected
+func (a *WorkloadMutator) resolveTemplateSource(ctx context.Context, object client.Object, pod *corev1.Pod, namespace string) (*proxySource, string, error) {
+	// Application teams can opt their workloads, or only their Pod templates, out of injection
+	for _, annotations := range []map[string]string{object.GetAnnotations(), pod.Annotations} {
+		if optOut, err := strconv.ParseBool(annotations[proxyv1alpha1.InjectAnnotation]); err == nil && !optOut {
+			return nil, "Workload opted out of injection", nil
+		}
+	}
+
+	source, err := a.resolveProxySource(ctx, pod, namespace)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, "ProxyDef resource does not exist", nil
+		}
+		return nil, "", err
+	}
+	switch {
+	case source == nil:
+		return nil, "No ProxyDef applies to the Pod template", nil
+	case source.Spec.InjectionModeOrDefault() != proxyv1alpha1.InjectionModeWorkload:
+		return nil, "ProxyDef does not inject workloads", nil
+	case source.ConfigMapName == "":
+		return nil, "ProxyDef has not generated its ConfigMap yet", nil
+	}
+	if selected, err := podSelected(source.Spec, pod); err != nil || !selected {
+		return nil, "Pod template is not selected by the ProxyDef", nil
+	}
+	return source, "", nil
+}
+
+// generatedNames returns the names of the objects a source may generate, from its ID or a revision of it
+func generatedNames(revision string) map[string]bool {
+	names := map[string]bool{}
+	id, _, _ := strings.Cut(revision, "@")
+	if id == "" {
+		return names
+	}
+	base := id + "-cluster"
+	if _, name, namespaced := strings.Cut(id, "/"); namespaced {
+		base = name
+	}
+	for _, suffix := range []string{"-config", "-credentials", "-trusted-ca", "-config-files", "-config-variants"} {
+		names[base+suffix] = true
+	}
+	return names
+}
+
+// stripInjected takes out of a Pod template what was injected from the given generated objects
+// and the source, nil once the template is no longer injected, does not provide anymore
+func stripInjected(patch *podPatch, prefix string, pod *corev1.Pod, source *proxySource, generated map[string]bool) {
+	if len(generated) == 0 {
+		return
+	}
+	current := map[string]bool{}
+	if source != nil {
+		for _, name := range []string{source.ConfigMapName, source.SecretName, source.TrustedCAConfigMapName, source.ConfigFilesConfigMapName, source.VariantsConfigMapName} {
+			if name != "" {
+				current[name] = true
+			}
+		}
+	}
+
+	// Volumes of generated ConfigMaps that are no longer current are taken out, along with their mounts
+	staleVolumes := map[string]bool{}
+	var removedVolumes []int
+	for i, volume := range pod.Spec.Volumes {
+		if volume.ConfigMap != nil && generated[volume.ConfigMap.Name] && !current[volume.ConfigMap.Name] {
+			staleVolumes[volume.Name] = true
+			removedVolumes = append(removedVolumes, i)
+		}
+	}
+	configFiles := map[string]bool{}
+	if source != nil {
+		for _, profile := range source.Spec.ConfigFiles {
+			configFiles[profile.Key()] = true
+		}
+	}
+
+	excluded := excludedContainers(pod)
+	noProxyFormats := selectedNoProxyFormats(pod)
+	stripContainer := func(path string, container *corev1.Container) {
+		injected := source != nil && containerSelected(source.Spec, container.Name) && !excluded[container.Name]
+		wanted := func(name string) bool {
+			return injected && current[name]
+		}
+		noProxyKey := ""
+		if injected {
+			format := noProxyFormats.forContainer(container.Name)
+			if source.Spec.NoProxyFormat != "" && format != source.Spec.NoProxyFormat {
+				noProxyKey = proxyv1alpha1.NoProxyVariantKey(format)
+			}
+		}
+		keepJavaToolOptions := injected && source.Spec.InjectJavaToolOptions &&
+			source.Spec.InjectionFailureModeOrDefault() == proxyv1alpha1.InjectionFailureModeRequired &&
+			wanted(source.VariantsConfigMapName)
+
+		var removedEnv []int
+		for i, env := range container.Env {
+			switch {
+			case env.Name == "JAVA_TOOL_OPTIONS" && env.ValueFrom == nil && strings.Contains(env.Value, javaToolOptionsReference):
+				if keepJavaToolOptions {
+					continue
+				}
+				if options := strings.TrimSpace(strings.Replace(env.Value, javaToolOptionsReference, "", 1)); options != "" {
+					patch.setValue(fmt.Sprintf("%s/env/%d/value", path, i), options)
+					container.Env[i].Value = options
+				} else {
+					removedEnv = append(removedEnv, i)
+				}
+			case env.Name == proxyv1alpha1.JavaToolOptionsKey && env.ValueFrom != nil && env.ValueFrom.ConfigMapKeyRef != nil && generated[env.ValueFrom.ConfigMapKeyRef.Name]:
+				// The helper variable goes along with the reference to it
+				if !keepJavaToolOptions {
+					removedEnv = append(removedEnv, i)
+				}
+			case env.ValueFrom != nil && env.ValueFrom.ConfigMapKeyRef != nil && generated[env.ValueFrom.ConfigMapKeyRef.Name]:
+				// The NO_PROXY variants are only kept while the same variant is still selected
+				ref := env.ValueFrom.ConfigMapKeyRef
+				variant := (env.Name == "NO_PROXY" || env.Name == "no_proxy") && ref.Key != "NO_PROXY" && ref.Key != "no_proxy"
+				if !wanted(ref.Name) || variant && ref.Key != noProxyKey {
+					removedEnv = append(removedEnv, i)
+				}
+			case env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil && generated[env.ValueFrom.SecretKeyRef.Name]:
+				if !wanted(env.ValueFrom.SecretKeyRef.Name) {
+					removedEnv = append(removedEnv, i)
+				}
+			}
+		}
+		var removedEnvFrom []int
+		for i, envFrom := range container.EnvFrom {
+			if envFrom.ConfigMapRef != nil && generated[envFrom.ConfigMapRef.Name] && !wanted(envFrom.ConfigMapRef.Name) ||
+				envFrom.SecretRef != nil && generated[envFrom.SecretRef.Name] && !wanted(envFrom.SecretRef.Name) {
+				removedEnvFrom = append(removedEnvFrom, i)
+			}
+		}
+		var removedMounts []int
+		for i, mount := range container.VolumeMounts {
+			volume := configMapVolume(pod, mount.Name)
+			if staleVolumes[mount.Name] ||
+				volume != nil && generated[volume.Name] && !injected ||
+				injected && volume != nil && volume.Name == source.ConfigFilesConfigMapName && mount.SubPath != "" && !configFiles[mount.SubPath] {
+				removedMounts = append(removedMounts, i)
+			}
+		}
+
+		container.Env = removeIndices(patch, path+"/env", container.Env, removedEnv)
+		container.EnvFrom = removeIndices(patch, path+"/envFrom", container.EnvFrom, removedEnvFrom)
+		container.VolumeMounts = removeIndices(patch, path+"/volumeMounts", container.VolumeMounts, removedMounts)
+	}
+
+	for i := range pod.Spec.InitContainers {
+		stripContainer(fmt.Sprintf("%s/spec/initContainers/%d", prefix, i), &pod.Spec.InitContainers[i])
+	}
+	for i := range pod.Spec.Containers {
+		stripContainer(fmt.Sprintf("%s/spec/containers/%d", prefix, i), &pod.Spec.Containers[i])
+	}
+	pod.Spec.Volumes = removeIndices(patch, prefix+"/spec/volumes", pod.Spec.Volumes, removedVolumes)
+}
+
+// configMapVolume returns the ConfigMap source of the Pod volume with the given name, if any
+func configMapVolume(pod *corev1.Pod, name string) *corev1.ConfigMapVolumeSource {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.Name == name {
+			return volume.ConfigMap
+		}
+	}
+	return nil
+}
+
+// removeIndices removes the items at the given ascending indices from the list at path,
+// highest first, and returns what is left
+func removeIndices[T any](patch *podPatch, path string, list []T, indices []int) []T {
+	if len(indices) == 0 {
+		return list
+	}
+	sort.Ints(indices)
+	remaining := make([]T, 0, len(list)-len(indices))
+	next := 0
+	for i, item := range list {
+		if next < len(indices) && indices[next] == i {
+			next++
+			continue
+		}
+		remaining = append(remaining, item)
+	}
+	for i := len(indices) - 1; i >= 0; i-- {
+		patch.removeFromList(path, indices[i])
+	}
+	return remaining
+}
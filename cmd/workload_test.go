@@ -0,0 +1,274 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	proxyv1alpha1 "github.com/igordcard/proxius/api/v1alpha1"
+)
+
+// newWorkloadMutator returns a WorkloadMutator backed by a fake client holding the given objects
+func newWorkloadMutator(objs ...client.Object) *WorkloadMutator {
+	return &WorkloadMutator{*newPodMutator(objs...)}
+}
+
+// newWorkloadProxyDef returns a ProxyDef injecting workloads, rendered for its current generation
+func newWorkloadProxyDef() *proxyv1alpha1.ProxyDef {
+	proxyDef := newProxyDef("corporate", nil)
+	proxyDef.Generation = 2
+	proxyDef.Spec.InjectionMode = proxyv1alpha1.InjectionModeWorkload
+	proxyDef.Spec.InjectJavaToolOptions = true
+	proxyDef.Status.SecretName = "corporate-credentials"
+	proxyDef.Status.TrustedCAConfigMapName = "corporate-trusted-ca"
+	proxyDef.Status.VariantsConfigMapName = "corporate-config-variants"
+	proxyDef.Status.Conditions = []metav1.Condition{{
+		Type:               "Ready",
+		Status:             metav1.ConditionTrue,
+		Reason:             "ConfigMapInSync",
+		ObservedGeneration: 2,
+	}}
+	return proxyDef
+}
+
+// javaToolOptionsHelper returns the helper variable injected along with the JVM system properties
+func javaToolOptionsHelper() corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: proxyv1alpha1.JavaToolOptionsKey,
+		ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "corporate-config-variants"},
+			Key:                  proxyv1alpha1.JavaToolOptionsKey,
+		}},
+	}
+}
+
+// newDeployment returns a Deployment with a single container in the default namespace
+func newDeployment() *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: "busybox"}},
+				},
+			},
+		},
+	}
+}
+
+// workloadAdmissionRequest wraps a workload into an admission request for the given operation,
+// with the workload itself as the old object of an update
+func workloadAdmissionRequest(kind string, workload client.Object, operation admissionv1.Operation) admission.Request {
+	raw, err := json.Marshal(workload)
+	Expect(err).NotTo(HaveOccurred())
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Kind: kind},
+			Operation: operation,
+			Namespace: workload.GetNamespace(),
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+	if operation == admissionv1.Update {
+		req.OldObject = runtime.RawExtension{Raw: raw}
+	}
+	return req
+}
+
+// applyPatches applies the JSON patch of a response to a workload, as the API server would
+func applyPatches[T any](workload *T, resp admission.Response) {
+	raw, err := json.Marshal(workload)
+	Expect(err).NotTo(HaveOccurred())
+	operations, err := json.Marshal(resp.Patches)
+	Expect(err).NotTo(HaveOccurred())
+	patch, err := jsonpatch.DecodePatch(operations)
+	Expect(err).NotTo(HaveOccurred())
+	patched, err := patch.Apply(raw)
+	Expect(err).NotTo(HaveOccurred())
+	var result T
+	Expect(json.Unmarshal(patched, &result)).To(Succeed())
+	*workload = result
+}
+
+var _ = Describe("Workload Webhook", func() {
+	ctx := context.Background()
+
+	Context("When the ProxyDef injects workloads", func() {
+		It("should inject the Pod template and record the revision on the workload", func() {
+			mutator := newWorkloadMutator(newWorkloadProxyDef())
+
+			deployment := newDeployment()
+			resp := mutator.Handle(ctx, workloadAdmissionRequest("Deployment", deployment, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			applyPatches(deployment, resp)
+
+			Expect(deployment.Annotations).To(HaveKeyWithValue(proxyv1alpha1.InjectedFromAnnotation, "default/corporate@2"))
+			Expect(deployment.Spec.Template.Annotations).To(BeEmpty())
+			container := deployment.Spec.Template.Spec.Containers[0]
+			Expect(container.EnvFrom).To(HaveLen(2))
+			Expect(container.EnvFrom[0].ConfigMapRef.Name).To(Equal("corporate-config"))
+			Expect(container.EnvFrom[1].SecretRef.Name).To(Equal("corporate-credentials"))
+			Expect(container.Env).To(Equal([]corev1.EnvVar{
+				javaToolOptionsHelper(),
+				{Name: "JAVA_TOOL_OPTIONS", Value: "$(PROXIUS_JAVA_TOOL_OPTIONS)"},
+			}))
+			Expect(container.VolumeMounts).To(ConsistOf(HaveField("Name", "proxius-trusted-ca")))
+			Expect(deployment.Spec.Template.Spec.Volumes).To(ConsistOf(HaveField("ConfigMap.Name", "corporate-trusted-ca")))
+
+			By("leaving the Pod template alone when nothing changed")
+			resp = mutator.Handle(ctx, workloadAdmissionRequest("Deployment", deployment, admissionv1.Update))
+			Expect(resp.Allowed).To(BeTrue())
+			for _, patch := range resp.Patches {
+				Expect(patch.Path).To(HavePrefix("/metadata/annotations"))
+			}
+		})
+
+		It("should leave workloads alone for ProxyDefs injecting Pods", func() {
+			proxyDef := newWorkloadProxyDef()
+			proxyDef.Spec.InjectionMode = proxyv1alpha1.InjectionModePod
+
+			resp := newWorkloadMutator(proxyDef).Handle(ctx, workloadAdmissionRequest("Deployment", newDeployment(), admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patches).To(BeEmpty())
+		})
+
+		It("should take out what the ProxyDef no longer provides", func() {
+			deployment := newDeployment()
+			deployment.Spec.Template.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", Value: "-Xmx1g"}}
+			resp := newWorkloadMutator(newWorkloadProxyDef()).Handle(ctx, workloadAdmissionRequest("Deployment", deployment, admissionv1.Create))
+			applyPatches(deployment, resp)
+
+			By("dropping the credentials and the trusted CA bundle")
+			proxyDef := newWorkloadProxyDef()
+			proxyDef.Generation = 3
+			proxyDef.Status.Conditions[0].ObservedGeneration = 3
+			proxyDef.Status.SecretName = ""
+			proxyDef.Status.TrustedCAConfigMapName = ""
+			resp = newWorkloadMutator(proxyDef).Handle(ctx, workloadAdmissionRequest("Deployment", deployment, admissionv1.Update))
+			Expect(resp.Allowed).To(BeTrue())
+			applyPatches(deployment, resp)
+
+			Expect(deployment.Annotations).To(HaveKeyWithValue(proxyv1alpha1.InjectedFromAnnotation, "default/corporate@3"))
+			container := deployment.Spec.Template.Spec.Containers[0]
+			Expect(container.EnvFrom).To(ConsistOf(HaveField("ConfigMapRef.Name", "corporate-config")))
+			Expect(container.Env).To(Equal([]corev1.EnvVar{
+				javaToolOptionsHelper(),
+				{Name: "JAVA_TOOL_OPTIONS", Value: "-Xmx1g $(PROXIUS_JAVA_TOOL_OPTIONS)"},
+			}))
+			Expect(container.VolumeMounts).To(BeEmpty())
+			Expect(deployment.Spec.Template.Spec.Volumes).To(BeEmpty())
+
+			By("dropping the JVM system properties while other helper variables remain")
+			proxyDef.Generation = 4
+			proxyDef.Status.Conditions[0].ObservedGeneration = 4
+			proxyDef.Spec.InjectJavaToolOptions = false
+			proxyDef.Spec.NoProxyFormat = proxyv1alpha1.NoProxyFormatCIDR
+			resp = newWorkloadMutator(proxyDef).Handle(ctx, workloadAdmissionRequest("Deployment", deployment, admissionv1.Update))
+			Expect(resp.Allowed).To(BeTrue())
+			applyPatches(deployment, resp)
+
+			container = deployment.Spec.Template.Spec.Containers[0]
+			Expect(container.Env).To(ConsistOf(corev1.EnvVar{Name: "JAVA_TOOL_OPTIONS", Value: "-Xmx1g"}))
+
+			By("taking out everything once the ProxyDef injects Pods instead")
+			proxyDef.Spec.InjectionMode = proxyv1alpha1.InjectionModePod
+			resp = newWorkloadMutator(proxyDef).Handle(ctx, workloadAdmissionRequest("Deployment", deployment, admissionv1.Update))
+			Expect(resp.Allowed).To(BeTrue())
+			applyPatches(deployment, resp)
+
+			Expect(deployment.Annotations).NotTo(HaveKey(proxyv1alpha1.InjectedFromAnnotation))
+			container = deployment.Spec.Template.Spec.Containers[0]
+			Expect(container.EnvFrom).To(BeEmpty())
+			Expect(container.Env).To(ConsistOf(corev1.EnvVar{Name: "JAVA_TOOL_OPTIONS", Value: "-Xmx1g"}))
+		})
+
+		It("should record generation 0 until the generated objects are rendered", func() {
+			proxyDef := newWorkloadProxyDef()
+			proxyDef.Generation = 3
+
+			deployment := newDeployment()
+			resp := newWorkloadMutator(proxyDef).Handle(ctx, workloadAdmissionRequest("Deployment", deployment, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			applyPatches(deployment, resp)
+			Expect(deployment.Annotations).To(HaveKeyWithValue(proxyv1alpha1.InjectedFromAnnotation, "default/corporate@0"))
+		})
+
+		It("should inject the Job template of CronJobs, but not Jobs that already exist", func() {
+			mutator := newWorkloadMutator(newWorkloadProxyDef())
+
+			cronJob := &batchv1.CronJob{
+				ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: "default"},
+				Spec: batchv1.CronJobSpec{
+					Schedule:    "@daily",
+					JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: newDeployment().Spec.Template}},
+				},
+			}
+			resp := mutator.Handle(ctx, workloadAdmissionRequest("CronJob", cronJob, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			applyPatches(cronJob, resp)
+			Expect(cronJob.Spec.JobTemplate.Spec.Template.Spec.Containers[0].EnvFrom).To(HaveLen(2))
+
+			job := &batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{Name: "once", Namespace: "default"},
+				Spec:       batchv1.JobSpec{Template: newDeployment().Spec.Template},
+			}
+			resp = mutator.Handle(ctx, workloadAdmissionRequest("Job", job, admissionv1.Update))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patches).To(BeEmpty())
+		})
+
+		It("should leave workloads that opted out alone", func() {
+			deployment := newDeployment()
+			deployment.Annotations = map[string]string{proxyv1alpha1.InjectAnnotation: "false"}
+
+			resp := newWorkloadMutator(newWorkloadProxyDef()).Handle(ctx, workloadAdmissionRequest("Deployment", deployment, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Patches).To(BeEmpty())
+		})
+	})
+
+	Context("When a Pod is created from an injected Pod template", func() {
+		It("should only annotate the Pod", func() {
+			proxyDef := newWorkloadProxyDef()
+			deployment := newDeployment()
+			applyPatches(deployment, newWorkloadMutator(proxyDef).Handle(ctx, workloadAdmissionRequest("Deployment", deployment, admissionv1.Create)))
+
+			pod := newPod(nil)
+			pod.Spec = deployment.Spec.Template.Spec
+			resp := newPodMutator(proxyDef).Handle(ctx, podAdmissionRequest(pod, admissionv1.Create))
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(patchedAnnotation(resp, proxyv1alpha1.InjectedFromAnnotation)).To(Equal("default/corporate@2"))
+			for _, patch := range resp.Patches {
+				Expect(patch.Path).To(HavePrefix("/metadata/annotations"))
+			}
+		})
+	})
+})
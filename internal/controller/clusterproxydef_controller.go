@@ -0,0 +1,734 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/igordcard/proxius/api/v1alpha1"
+)
+
+// clusterProxyDefLabel is set on every ConfigMap generated from a ClusterProxyDef,
+// so that the ConfigMaps of namespaces that stop matching can be found and removed
+const clusterProxyDefLabel = "proxy.igordc.com/clusterproxydef"
+
+// ClusterProxyDefReconciler reconciles a ClusterProxyDef object
+type ClusterProxyDefReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// PACBaseURL is the URL the manager serves proxy auto-config files under,
+	// published in the status of the ClusterProxyDefs with autoDetect set
+	PACBaseURL string
+	// PACSourceHosts are the only hosts PAC sources may be downloaded from, when set,
+	// and may resolve to private addresses
+	PACSourceHosts []string
+	// APIReader reads the ConfigMaps and Secrets referenced by ClusterProxyDefs straight
+	// from the API server, since the manager only caches the generated ones
+	APIReader client.Reader
+}
+
+//+kubebuilder:rbac:groups=proxy.igordc.com,resources=clusterproxydefs,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=proxy.igordc.com,resources=clusterproxydefs/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=proxy.igordc.com,resources=clusterproxydefs/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=nodes;services,verbs=get;list;watch
+//+kubebuilder:rbac:groups=apps,resources=replicasets,verbs=get;list;watch
+//+kubebuilder:rbac:groups=apps,resources=deployments;statefulsets;daemonsets,verbs=get;list;watch;patch
+//+kubebuilder:rbac:groups=batch,resources=cronjobs,verbs=get;list;watch;patch
+//+kubebuilder:rbac:groups=config.openshift.io,resources=proxies,verbs=get;list;watch
+
+// Reconcile fans a ClusterProxyDef out into one ConfigMap per namespace matched
+// by its namespace selector, plus one Secret when it has credentials and one ConfigMap
+// each for a trusted CA bundle and tool configuration files. They are created
+// when namespaces start matching, kept in line with the spec, and deleted when
+// namespaces stop matching. As for a ProxyDef, a finalizer keeps a deleted
+// ClusterProxyDef around until its DeletionPolicy has decided what becomes of the
+// generated objects still referenced by Pods.
+func (r *ClusterProxyDefReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
+	log := log.FromContext(ctx)
+
+	log.Info("ClusterProxyDef resource request detected")
+
+	clusterproxydef := &v1alpha1.ClusterProxyDef{}
+	err = r.Get(ctx, req.NamespacedName, clusterproxydef)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			// The ConfigMaps are owned by the ClusterProxyDef, so what its DeletionPolicy did not keep is garbage collected with it
+			log.Info("ClusterProxyDef resource not found. Ignoring since object must be deleted")
+			return ctrl.Result{}, nil
+		}
+		// Error reading the object - requeue the request.
+		log.Error(err, "Failed to get ClusterProxyDef resource")
+		return ctrl.Result{}, err
+	}
+
+	// A ClusterProxyDef being deleted is only let go once its DeletionPolicy has been applied
+	if !clusterproxydef.DeletionTimestamp.IsZero() {
+		return r.finalizeClusterProxyDef(ctx, clusterproxydef)
+	}
+	defer func() {
+		result = requeueForReferences(&clusterproxydef.Spec.ProxyDefSpec, result)
+	}()
+
+	// The finalizer lets the DeletionPolicy be applied before the generated objects are garbage collected
+	if controllerutil.AddFinalizer(clusterproxydef, proxyDefFinalizer) {
+		if err := r.Update(ctx, clusterproxydef); err != nil {
+			log.Error(err, "Failed to add the finalizer to the ClusterProxyDef")
+			return ctrl.Result{}, err
+		}
+	}
+
+	selector := labels.Everything()
+	if clusterproxydef.Spec.NamespaceSelector != nil {
+		selector, err = metav1.LabelSelectorAsSelector(clusterproxydef.Spec.NamespaceSelector)
+		if err != nil {
+			log.Error(err, "Invalid namespace selector")
+			return r.setDegradedCondition(ctx, clusterproxydef, "InvalidNamespaceSelector", err.Error(), nil)
+		}
+	}
+
+	if errs := clusterproxydef.Spec.Validate(field.NewPath("spec")); len(errs) > 0 {
+		log.Info("Invalid ClusterProxyDef spec", "err", errs.ToAggregate())
+		return r.setDegradedCondition(ctx, clusterproxydef, "InvalidSpec", errs.ToAggregate().Error(), nil)
+	}
+
+	// A ClusterProxyDef has no namespace of its own, so the credentials Secret must name one
+	var credentials *proxyCredentials
+	if ref := clusterproxydef.Spec.CredentialsSecretRef; ref != nil {
+		if ref.Namespace == "" {
+			message := field.Required(field.NewPath("spec", "credentialsSecretRef", "namespace"), "must be set for a ClusterProxyDef").Error()
+			log.Info("Invalid ClusterProxyDef spec", "err", message)
+			return r.setDegradedCondition(ctx, clusterproxydef, "InvalidSpec", message, nil)
+		}
+		credentials, err = loadProxyCredentials(ctx, r.APIReader, ref.Namespace, ref.Name)
+		if err != nil {
+			var credErr *credentialsError
+			if errors.As(err, &credErr) {
+				log.Info("Unusable credentials Secret", "err", credErr)
+				return r.setDegradedCondition(ctx, clusterproxydef, credErr.reason, credErr.message, nil)
+			}
+			log.Error(err, "Failed to get credentials Secret")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Likewise, a PAC file held in a ConfigMap must name its namespace
+	var pacNamespace string
+	if source := clusterproxydef.Spec.PACSource; source != nil && source.ConfigMapRef != nil {
+		if source.ConfigMapRef.Namespace == "" {
+			message := field.Required(field.NewPath("spec", "pacSource", "configMapRef", "namespace"), "must be set for a ClusterProxyDef").Error()
+			log.Info("Invalid ClusterProxyDef spec", "err", message)
+			return r.setDegradedCondition(ctx, clusterproxydef, "InvalidSpec", message, nil)
+		}
+		pacNamespace = source.ConfigMapRef.Namespace
+	}
+	spec, err := withPACSource(ctx, r.APIReader, pacNamespace, r.PACSourceHosts, &clusterproxydef.Spec.ProxyDefSpec)
+	if err != nil {
+		var pacErr *pacSourceError
+		if errors.As(err, &pacErr) {
+			log.Info("Unusable PAC source", "err", pacErr)
+			return r.setDegradedCondition(ctx, clusterproxydef, pacErr.reason, pacErr.message, nil)
+		}
+		log.Error(err, "Failed to load PAC file")
+		return r.setDegradedCondition(ctx, clusterproxydef, "PACSourceUnavailable", fmt.Sprintf("Failed to load PAC file: %v", err), err)
+	}
+
+	// The cluster-wide proxy of OpenShift is cluster-scoped like the ClusterProxyDef itself
+	clusterProxy, err := loadOpenShiftProxy(ctx, r.Client, clusterproxydef.Spec.OpenShiftProxy)
+	if err != nil {
+		var proxyErr *openShiftProxyError
+		if errors.As(err, &proxyErr) {
+			log.Info("Unusable OpenShift Proxy", "err", proxyErr)
+			return r.setDegradedCondition(ctx, clusterproxydef, proxyErr.reason, proxyErr.message, nil)
+		}
+		log.Error(err, "Failed to get OpenShift Proxy")
+		return r.setDegradedCondition(ctx, clusterproxydef, "OpenShiftProxyUnavailable", fmt.Sprintf("Failed to get OpenShift Proxy: %v", err), err)
+	}
+	ca := clusterproxydef.Spec.TrustedCA
+	if clusterProxy != nil {
+		spec = clusterProxy.mirror(spec)
+		if credentials == nil {
+			credentials = clusterProxy.credentials
+		}
+		if ca == nil {
+			ca = clusterProxy.trustedCA
+		}
+	}
+
+	// And so must the trusted CA bundle
+	var trustedCA string
+	if ca != nil {
+		ref, _, secret := ca.Reference()
+		if ref.Namespace == "" {
+			child := "configMapRef"
+			if secret {
+				child = "secretRef"
+			}
+			message := field.Required(field.NewPath("spec", "trustedCA", child, "namespace"), "must be set for a ClusterProxyDef").Error()
+			log.Info("Invalid ClusterProxyDef spec", "err", message)
+			return r.setDegradedCondition(ctx, clusterproxydef, "InvalidSpec", message, nil)
+		}
+		trustedCA, err = loadTrustedCA(ctx, r.APIReader, ref.Namespace, ca)
+		if err != nil {
+			var caErr *trustedCAError
+			if errors.As(err, &caErr) {
+				log.Info("Unusable trusted CA bundle", "err", caErr)
+				return r.setDegradedCondition(ctx, clusterproxydef, caErr.reason, caErr.message, nil)
+			}
+			log.Error(err, "Failed to get trusted CA bundle")
+			return ctrl.Result{}, err
+		}
+	}
+
+	var discovered []string
+	if clusterproxydef.Spec.DiscoverNoProxy {
+		discovered, err = discoverNoProxy(ctx, r.Client, r.APIReader)
+		if err != nil {
+			log.Error(err, "Failed to discover the cluster networking")
+			return r.setDegradedCondition(ctx, clusterproxydef, "NoProxyDiscoveryFailed", "Failed to discover the cluster networking", err)
+		}
+	}
+
+	configData, secretData, err := proxyConfigData(spec, discovered, credentials)
+	if err != nil {
+		log.Info("Invalid ClusterProxyDef spec", "err", err)
+		return r.setDegradedCondition(ctx, clusterproxydef, "InvalidSpec", err.Error(), nil)
+	}
+	variants := splitVariants(configData)
+
+	configFiles := configFilesData(spec, discovered)
+
+	namespaces := &corev1.NamespaceList{}
+	if err := r.List(ctx, namespaces, client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		log.Error(err, "Failed to list namespaces")
+		return ctrl.Result{}, err
+	}
+
+	// If the ClusterProxyDef was already Ready for this generation, any difference found
+	// in a namespace it was rendered into can only come from an out-of-band change
+	inSync := isClusterInSync(clusterproxydef)
+	hash := configHash(spec, credentials)
+	// A PAC file or cluster-wide proxy changing under the same generation is an update, not a drift
+	if inSync && hash != clusterproxydef.Status.ConfigHash {
+		switch {
+		case clusterproxydef.Spec.PACSource != nil:
+			r.Recorder.Event(clusterproxydef, corev1.EventTypeNormal, "PACSourceUpdated", "The PAC file has changed and is being rendered again")
+			inSync = false
+		case clusterproxydef.Spec.OpenShiftProxy != nil:
+			r.Recorder.Event(clusterproxydef, corev1.EventTypeNormal, "OpenShiftProxyUpdated", "The cluster-wide proxy has changed and is being rendered again")
+			inSync = false
+		}
+	}
+	previouslyRendered := map[string]bool{}
+	for _, namespace := range clusterproxydef.Status.Namespaces {
+		previouslyRendered[namespace] = true
+	}
+
+	matched := map[string]bool{}
+	offered := map[string]bool{}
+	for i := range namespaces.Items {
+		namespace := &namespaces.Items[i]
+		// Terminating namespaces refuse new objects, and their ConfigMaps are about to go anyway
+		if namespace.DeletionTimestamp != nil {
+			continue
+		}
+		matched[namespace.Name] = true
+		wasInSync := inSync && previouslyRendered[namespace.Name]
+		offered[namespace.Name] = !wasInSync
+		if err := r.reconcileSecret(ctx, clusterproxydef, namespace.Name, secretData, wasInSync); err != nil {
+			log.Error(err, "Failed to reconcile Secret", "namespace", namespace.Name)
+			return r.setDegradedCondition(ctx, clusterproxydef, "SecretSyncFailed", fmt.Sprintf("Failed to reconcile Secret in namespace %s", namespace.Name), err)
+		}
+		if err := r.reconcileMountedConfigMap(ctx, clusterproxydef, namespace.Name, clusterTrustedCAConfigMapName(clusterproxydef), trustedCAData(trustedCA), wasInSync); err != nil {
+			log.Error(err, "Failed to reconcile trusted CA ConfigMap", "namespace", namespace.Name)
+			return r.setDegradedCondition(ctx, clusterproxydef, "TrustedCASyncFailed", fmt.Sprintf("Failed to reconcile trusted CA ConfigMap in namespace %s", namespace.Name), err)
+		}
+		if err := r.reconcileMountedConfigMap(ctx, clusterproxydef, namespace.Name, clusterConfigFilesConfigMapName(clusterproxydef), configFiles, wasInSync); err != nil {
+			log.Error(err, "Failed to reconcile config files ConfigMap", "namespace", namespace.Name)
+			return r.setDegradedCondition(ctx, clusterproxydef, "ConfigFilesSyncFailed", fmt.Sprintf("Failed to reconcile config files ConfigMap in namespace %s", namespace.Name), err)
+		}
+		if err := r.reconcileMountedConfigMap(ctx, clusterproxydef, namespace.Name, clusterVariantsConfigMapName(clusterproxydef), variants, wasInSync); err != nil {
+			log.Error(err, "Failed to reconcile variants ConfigMap", "namespace", namespace.Name)
+			return r.setDegradedCondition(ctx, clusterproxydef, "VariantsSyncFailed", fmt.Sprintf("Failed to reconcile variants ConfigMap in namespace %s", namespace.Name), err)
+		}
+		if err := r.reconcileConfigMap(ctx, clusterproxydef, namespace.Name, configData, wasInSync); err != nil {
+			log.Error(err, "Failed to reconcile ConfigMap", "namespace", namespace.Name)
+			return r.setDegradedCondition(ctx, clusterproxydef, "ConfigMapSyncFailed", fmt.Sprintf("Failed to reconcile ConfigMap in namespace %s", namespace.Name), err)
+		}
+	}
+
+	// Clean up the ConfigMaps of namespaces that no longer match, trusted CA ones included
+	if err := r.cleanupConfigMaps(ctx, clusterproxydef, matched); err != nil {
+		log.Error(err, "Failed to clean up ConfigMaps")
+		return r.setDegradedCondition(ctx, clusterproxydef, "ConfigMapCleanupFailed", "Failed to clean up ConfigMaps of namespaces no longer selected", err)
+	}
+
+	// Likewise for the Secrets, which are removed everywhere once there are no credentials
+	secretNamespaces := matched
+	if secretData == nil {
+		secretNamespaces = nil
+	}
+	if err := r.cleanupSecrets(ctx, clusterproxydef, secretNamespaces); err != nil {
+		log.Error(err, "Failed to clean up Secrets")
+		return r.setDegradedCondition(ctx, clusterproxydef, "SecretCleanupFailed", "Failed to clean up Secrets no longer needed", err)
+	}
+
+	rendered := make([]string, 0, len(matched))
+	for namespace := range matched {
+		rendered = append(rendered, namespace)
+	}
+	sort.Strings(rendered)
+
+	result, err = r.setReadyCondition(ctx, clusterproxydef, rendered, hash)
+	if err != nil {
+		return result, err
+	}
+
+	// Pod templates injected from an older generation are injected again by the workload webhook,
+	// and the ones not injected yet are injected as well where this generation was not rendered before
+	if err := syncWorkloadTemplates(ctx, r.Client, r.Recorder, clusterproxydef, spec, rendered, offered, clusterproxydef.Name, clusterproxydef.Generation); err != nil {
+		return requeueForPACSource(spec, ctrl.Result{}), err
+	}
+
+	// Pods only read their environment when they start, so the workloads of Pods
+	// injected with an older configuration are restarted when the policy allows it
+	result, err = rolloutWorkloads(ctx, r.Client, r.Recorder, clusterproxydef, clusterproxydef.Spec.RolloutPolicy, rendered, clusterproxydef.Name, hash)
+	return requeueForPACSource(spec, result), err
+}
+
+// isClusterInSync reports whether the ClusterProxyDef was already reconciled successfully for its current generation
+func isClusterInSync(clusterproxydef *v1alpha1.ClusterProxyDef) bool {
+	ready := meta.FindStatusCondition(clusterproxydef.Status.Conditions, typeReadyProxyDef)
+	return ready != nil && ready.Status == metav1.ConditionTrue && ready.ObservedGeneration == clusterproxydef.Generation
+}
+
+// clusterConfigMapName returns the name of the ConfigMap generated in each namespace for a ClusterProxyDef
+func clusterConfigMapName(clusterproxydef *v1alpha1.ClusterProxyDef) string {
+	return clusterproxydef.Name + "-cluster-config"
+}
+
+// clusterSecretName returns the name of the Secret generated in each namespace for a ClusterProxyDef with credentials
+func clusterSecretName(clusterproxydef *v1alpha1.ClusterProxyDef) string {
+	return clusterproxydef.Name + "-cluster-credentials"
+}
+
+// clusterTrustedCAConfigMapName returns the name of the ConfigMap generated in each namespace for a ClusterProxyDef with a trusted CA bundle
+func clusterTrustedCAConfigMapName(clusterproxydef *v1alpha1.ClusterProxyDef) string {
+	return clusterproxydef.Name + "-cluster-trusted-ca"
+}
+
+// clusterConfigFilesConfigMapName returns the name of the ConfigMap generated in each namespace for a ClusterProxyDef with tool configuration files
+func clusterConfigFilesConfigMapName(clusterproxydef *v1alpha1.ClusterProxyDef) string {
+	return clusterproxydef.Name + "-cluster-config-files"
+}
+
+// clusterVariantsConfigMapName returns the name of the ConfigMap generated in each namespace for a ClusterProxyDef with helper variables
+func clusterVariantsConfigMapName(clusterproxydef *v1alpha1.ClusterProxyDef) string {
+	return clusterproxydef.Name + "-cluster-config-variants"
+}
+
+// generatedLabels returns the labels of the objects generated from a ClusterProxyDef
+func generatedLabels(clusterproxydef *v1alpha1.ClusterProxyDef) map[string]string {
+	generated := map[string]string{}
+	for key, value := range clusterproxydef.Labels {
+		generated[key] = value
+	}
+	generated[clusterProxyDefLabel] = clusterproxydef.Name
+	generated[v1alpha1.GeneratedLabel] = "true"
+	return generated
+}
+
+// desiredConfigMap renders the ConfigMap that corresponds to the current ClusterProxyDef spec in a namespace
+func (r *ClusterProxyDefReconciler) desiredConfigMap(clusterproxydef *v1alpha1.ClusterProxyDef, namespace string, data map[string]string) (*corev1.ConfigMap, error) {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        clusterConfigMapName(clusterproxydef),
+			Namespace:   namespace,
+			Labels:      generatedLabels(clusterproxydef),
+			Annotations: clusterproxydef.Annotations,
+		},
+		Data: data,
+	}
+	if err := ctrl.SetControllerReference(clusterproxydef, configMap, r.Scheme); err != nil {
+		return nil, err
+	}
+	return configMap, nil
+}
+
+// reconcileConfigMap creates or updates the ConfigMap of a single namespace.
+// When wasInSync is set, any change made is reported as a correction of drift.
+func (r *ClusterProxyDefReconciler) reconcileConfigMap(ctx context.Context, clusterproxydef *v1alpha1.ClusterProxyDef, namespace string, data map[string]string, wasInSync bool) error {
+	log := log.FromContext(ctx)
+
+	desired, err := r.desiredConfigMap(clusterproxydef, namespace, data)
+	if err != nil {
+		return err
+	}
+
+	configMap := &corev1.ConfigMap{}
+	err = getGenerated(ctx, r.Client, r.APIReader, client.ObjectKeyFromObject(desired), configMap)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		if wasInSync {
+			r.Recorder.Eventf(clusterproxydef, corev1.EventTypeWarning, "ConfigMapRecreated", "ConfigMap %s/%s was deleted and has been recreated", namespace, desired.Name)
+		}
+		if err := r.Create(ctx, desired); err != nil {
+			return err
+		}
+		log.Info("ConfigMap created successfully", "namespace", namespace)
+		return nil
+	}
+
+	if !configMapNeedsUpdate(configMap, desired) {
+		return nil
+	}
+	switch {
+	case !wasInSync:
+	case clusterproxydef.Spec.DiscoverNoProxy && onlyNoProxyChanged(configMap, desired):
+		// Nodes joining or leaving the cluster are not a drift of the ConfigMap
+		r.Recorder.Eventf(clusterproxydef, corev1.EventTypeNormal, "NoProxyUpdated", "ConfigMap %s/%s has been updated with the discovered cluster networking", namespace, desired.Name)
+	default:
+		r.Recorder.Eventf(clusterproxydef, corev1.EventTypeWarning, "ConfigMapDriftCorrected", "ConfigMap %s/%s was modified out of band and has been reverted", namespace, desired.Name)
+	}
+	configMap.Data = desired.Data
+	configMap.Labels = desired.Labels
+	configMap.Annotations = desired.Annotations
+	configMap.OwnerReferences = desired.OwnerReferences
+	if err := r.Update(ctx, configMap); err != nil {
+		return err
+	}
+	log.Info("ConfigMap updated successfully", "namespace", namespace)
+	return nil
+}
+
+// reconcileMountedConfigMap creates or updates, in a single namespace, one of the ConfigMaps
+// that Pods mount, such as the one holding the trusted CA bundle, or deletes it when the
+// ClusterProxyDef no longer needs it.
+// When wasInSync is set, a deleted ConfigMap is reported as recreated.
+func (r *ClusterProxyDefReconciler) reconcileMountedConfigMap(ctx context.Context, clusterproxydef *v1alpha1.ClusterProxyDef, namespace, name string, data map[string]string, wasInSync bool) error {
+	log := log.FromContext(ctx)
+
+	configMap := &corev1.ConfigMap{}
+	err := getGenerated(ctx, r.Client, r.APIReader, client.ObjectKey{Namespace: namespace, Name: name}, configMap)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	found := err == nil
+
+	if data == nil {
+		if !found || !metav1.IsControlledBy(configMap, clusterproxydef) {
+			return nil
+		}
+		if err := r.Delete(ctx, configMap); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		log.Info("ConfigMap deleted since the ClusterProxyDef no longer needs it", "namespace", namespace, "name", name)
+		return nil
+	}
+
+	desired := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   namespace,
+			Labels:      generatedLabels(clusterproxydef),
+			Annotations: clusterproxydef.Annotations,
+		},
+		Data: data,
+	}
+	if err := ctrl.SetControllerReference(clusterproxydef, desired, r.Scheme); err != nil {
+		return err
+	}
+
+	if !found {
+		if wasInSync {
+			r.Recorder.Eventf(clusterproxydef, corev1.EventTypeWarning, "ConfigMapRecreated", "ConfigMap %s/%s was deleted and has been recreated", namespace, desired.Name)
+		}
+		if err := r.Create(ctx, desired); err != nil {
+			return err
+		}
+		log.Info("ConfigMap created successfully", "namespace", namespace, "name", name)
+		return nil
+	}
+
+	if !configMapNeedsUpdate(configMap, desired) {
+		return nil
+	}
+	// The data also changes with the objects and cluster networking it is rendered from,
+	// e.g. when the referenced CA is rotated, so an update is not necessarily a correction of drift
+	if wasInSync {
+		r.Recorder.Eventf(clusterproxydef, corev1.EventTypeNormal, "ConfigMapUpdated", "ConfigMap %s/%s has been updated to match the ClusterProxyDef and the objects it is rendered from", namespace, desired.Name)
+	}
+	configMap.Data = desired.Data
+	configMap.Labels = desired.Labels
+	configMap.Annotations = desired.Annotations
+	configMap.OwnerReferences = desired.OwnerReferences
+	if err := r.Update(ctx, configMap); err != nil {
+		return err
+	}
+	log.Info("ConfigMap updated successfully", "namespace", namespace, "name", name)
+	return nil
+}
+
+// cleanupConfigMaps deletes the ConfigMaps generated for namespaces that are no longer matched
+func (r *ClusterProxyDefReconciler) cleanupConfigMaps(ctx context.Context, clusterproxydef *v1alpha1.ClusterProxyDef, matched map[string]bool) error {
+	log := log.FromContext(ctx)
+
+	configMaps := &corev1.ConfigMapList{}
+	if err := r.List(ctx, configMaps, client.MatchingLabels{clusterProxyDefLabel: clusterproxydef.Name}); err != nil {
+		return err
+	}
+	for i := range configMaps.Items {
+		configMap := &configMaps.Items[i]
+		if matched[configMap.Namespace] || !metav1.IsControlledBy(configMap, clusterproxydef) {
+			continue
+		}
+		if err := r.Delete(ctx, configMap); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		log.Info("ConfigMap deleted since its namespace is no longer selected", "namespace", configMap.Namespace)
+	}
+	return nil
+}
+
+// reconcileSecret creates or updates the Secret holding the credential-embedded proxy URLs
+// in a single namespace. Without credentials there is nothing to do here, since unneeded
+// Secrets are removed by cleanupSecrets.
+func (r *ClusterProxyDefReconciler) reconcileSecret(ctx context.Context, clusterproxydef *v1alpha1.ClusterProxyDef, namespace string, data map[string][]byte, wasInSync bool) error {
+	log := log.FromContext(ctx)
+
+	if data == nil {
+		return nil
+	}
+
+	desired := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        clusterSecretName(clusterproxydef),
+			Namespace:   namespace,
+			Labels:      generatedLabels(clusterproxydef),
+			Annotations: clusterproxydef.Annotations,
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: data,
+	}
+	if err := ctrl.SetControllerReference(clusterproxydef, desired, r.Scheme); err != nil {
+		return err
+	}
+
+	secret := &corev1.Secret{}
+	err := getGenerated(ctx, r.Client, r.APIReader, client.ObjectKeyFromObject(desired), secret)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		if wasInSync {
+			r.Recorder.Eventf(clusterproxydef, corev1.EventTypeWarning, "SecretRecreated", "Secret %s/%s was deleted and has been recreated", namespace, desired.Name)
+		}
+		if err := r.Create(ctx, desired); err != nil {
+			return err
+		}
+		log.Info("Secret created successfully", "namespace", namespace)
+		return nil
+	}
+
+	if !secretNeedsUpdate(secret, desired) {
+		return nil
+	}
+	// The Secret also changes when the referenced credentials are rotated,
+	// so an update is not necessarily a correction of drift
+	if wasInSync {
+		r.Recorder.Eventf(clusterproxydef, corev1.EventTypeNormal, "SecretUpdated", "Secret %s/%s has been updated to match the ClusterProxyDef and its credentials", namespace, desired.Name)
+	}
+	secret.Type = desired.Type
+	secret.Data = desired.Data
+	secret.Labels = desired.Labels
+	secret.Annotations = desired.Annotations
+	secret.OwnerReferences = desired.OwnerReferences
+	if err := r.Update(ctx, secret); err != nil {
+		return err
+	}
+	log.Info("Secret updated successfully", "namespace", namespace)
+	return nil
+}
+
+// cleanupSecrets deletes the Secrets generated for namespaces that are not in keep
+func (r *ClusterProxyDefReconciler) cleanupSecrets(ctx context.Context, clusterproxydef *v1alpha1.ClusterProxyDef, keep map[string]bool) error {
+	log := log.FromContext(ctx)
+
+	secrets := &corev1.SecretList{}
+	if err := r.List(ctx, secrets, client.MatchingLabels{clusterProxyDefLabel: clusterproxydef.Name}); err != nil {
+		return err
+	}
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		if keep[secret.Namespace] || !metav1.IsControlledBy(secret, clusterproxydef) {
+			continue
+		}
+		if err := r.Delete(ctx, secret); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		log.Info("Secret deleted since it is no longer needed", "namespace", secret.Namespace)
+	}
+	return nil
+}
+
+// setReadyCondition marks the ClusterProxyDef as Ready and records the namespaces it was rendered into
+// and the configuration hash,
+// only writing the status when something actually changed
+func (r *ClusterProxyDefReconciler) setReadyCondition(ctx context.Context, clusterproxydef *v1alpha1.ClusterProxyDef, namespaces []string, configHash string) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	message := fmt.Sprintf("ConfigMap rendered into %d namespaces", len(namespaces))
+	previous := clusterproxydef.Status.DeepCopy()
+	clusterproxydef.Status.ConfigMapName = clusterConfigMapName(clusterproxydef)
+	clusterproxydef.Status.SecretName = ""
+	if clusterproxydef.Spec.CredentialsSecretRef != nil {
+		clusterproxydef.Status.SecretName = clusterSecretName(clusterproxydef)
+	}
+	clusterproxydef.Status.TrustedCAConfigMapName = ""
+	if clusterproxydef.Spec.TrustedCA != nil {
+		clusterproxydef.Status.TrustedCAConfigMapName = clusterTrustedCAConfigMapName(clusterproxydef)
+	}
+	clusterproxydef.Status.ConfigFilesConfigMapName = ""
+	if len(clusterproxydef.Spec.ConfigFiles) > 0 {
+		clusterproxydef.Status.ConfigFilesConfigMapName = clusterConfigFilesConfigMapName(clusterproxydef)
+	}
+	clusterproxydef.Status.VariantsConfigMapName = ""
+	if hasVariants(&clusterproxydef.Spec.ProxyDefSpec) {
+		clusterproxydef.Status.VariantsConfigMapName = clusterVariantsConfigMapName(clusterproxydef)
+	}
+	clusterproxydef.Status.Namespaces = namespaces
+	clusterproxydef.Status.ConfigHash = configHash
+	clusterproxydef.Status.PACURL = pacURL(&clusterproxydef.Spec.ProxyDefSpec, r.PACBaseURL, v1alpha1.ClusterProxyDefPACPath(clusterproxydef.Name))
+	meta.SetStatusCondition(&clusterproxydef.Status.Conditions, metav1.Condition{Type: typeReadyProxyDef, Status: metav1.ConditionTrue, Reason: "ConfigMapsInSync", Message: message, ObservedGeneration: clusterproxydef.Generation})
+	meta.SetStatusCondition(&clusterproxydef.Status.Conditions, metav1.Condition{Type: typeSyncingProxyDef, Status: metav1.ConditionFalse, Reason: "ConfigMapsInSync", Message: message, ObservedGeneration: clusterproxydef.Generation})
+	meta.SetStatusCondition(&clusterproxydef.Status.Conditions, metav1.Condition{Type: typeDegradedProxyDef, Status: metav1.ConditionFalse, Reason: "ConfigMapsInSync", Message: message, ObservedGeneration: clusterproxydef.Generation})
+	if equality.Semantic.DeepEqual(previous, &clusterproxydef.Status) {
+		return ctrl.Result{}, nil
+	}
+	if err := r.Status().Update(ctx, clusterproxydef); err != nil {
+		log.Error(err, "Failed to update ClusterProxyDef status (to Ready)")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// setDegradedCondition records a failure on the ClusterProxyDef status and returns the original error
+// so that the request is requeued
+func (r *ClusterProxyDefReconciler) setDegradedCondition(ctx context.Context, clusterproxydef *v1alpha1.ClusterProxyDef, reason, message string, cause error) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	meta.SetStatusCondition(&clusterproxydef.Status.Conditions, metav1.Condition{Type: typeDegradedProxyDef, Status: metav1.ConditionTrue, Reason: reason, Message: message, ObservedGeneration: clusterproxydef.Generation})
+	meta.SetStatusCondition(&clusterproxydef.Status.Conditions, metav1.Condition{Type: typeReadyProxyDef, Status: metav1.ConditionFalse, Reason: reason, Message: message, ObservedGeneration: clusterproxydef.Generation})
+	if err := r.Status().Update(ctx, clusterproxydef); err != nil {
+		log.Error(err, "Failed to update ClusterProxyDef status (to Degraded)")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, cause
+}
+
+// requestsForNamespace enqueues every ClusterProxyDef whenever a namespace changes,
+// since a change of labels may make it start or stop matching any of them
+func (r *ClusterProxyDefReconciler) requestsForNamespace(ctx context.Context, _ client.Object) []reconcile.Request {
+	clusterproxydefs := &v1alpha1.ClusterProxyDefList{}
+	if err := r.List(ctx, clusterproxydefs); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list ClusterProxyDefs")
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(clusterproxydefs.Items))
+	for _, clusterproxydef := range clusterproxydefs.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: clusterproxydef.Name}})
+	}
+	return requests
+}
+
+// requestsForNode enqueues the ClusterProxyDefs discovering the cluster networking,
+// since a node joining or leaving changes their NO_PROXY entries
+func (r *ClusterProxyDefReconciler) requestsForNode(ctx context.Context, _ client.Object) []reconcile.Request {
+	clusterproxydefs := &v1alpha1.ClusterProxyDefList{}
+	if err := r.List(ctx, clusterproxydefs); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list ClusterProxyDefs")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, clusterproxydef := range clusterproxydefs.Items {
+		if clusterproxydef.Spec.DiscoverNoProxy {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: clusterproxydef.Name}})
+		}
+	}
+	return requests
+}
+
+// requestsForOpenShiftProxy enqueues the ClusterProxyDefs mirroring a Proxy whenever it changes
+func (r *ClusterProxyDefReconciler) requestsForOpenShiftProxy(ctx context.Context, object client.Object) []reconcile.Request {
+	clusterproxydefs := &v1alpha1.ClusterProxyDefList{}
+	if err := r.List(ctx, clusterproxydefs); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list ClusterProxyDefs")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, clusterproxydef := range clusterproxydefs.Items {
+		if source := clusterproxydef.Spec.OpenShiftProxy; source != nil && source.NameOrDefault() == object.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&clusterproxydef)})
+		}
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+// As for ProxyDefs, the objects referenced by the spec are read again periodically
+// rather than watched.
+func (r *ClusterProxyDefReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	b := ctrl.NewControllerManagedBy(mgr).
+		For(&v1alpha1.ClusterProxyDef{}).
+		Owns(&corev1.ConfigMap{}).
+		Owns(&corev1.Secret{}).
+		Watches(&corev1.Namespace{}, handler.EnqueueRequestsFromMapFunc(r.requestsForNamespace)).
+		Watches(&corev1.Node{}, handler.EnqueueRequestsFromMapFunc(r.requestsForNode), builder.WithPredicates(nodeNoProxyChanged))
+	// The Proxy of OpenShift can only be watched on clusters serving it
+	if openShiftProxyServed(mgr.GetRESTMapper()) {
+		b = b.Watches(newOpenShiftProxyObject(), handler.EnqueueRequestsFromMapFunc(r.requestsForOpenShiftProxy))
+	}
+	return b.Complete(r)
+}
@@ -0,0 +1,228 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	proxyv1alpha1 "github.com/igordcard/proxius/api/v1alpha1"
+)
+
+var _ = Describe("ClusterProxyDef Controller", func() {
+	Context("When reconciling a resource", func() {
+		const resourceName = "test-cluster-resource"
+		const selectedNamespace = "clusterproxydef-selected"
+
+		ctx := context.Background()
+
+		typeNamespacedName := types.NamespacedName{Name: resourceName}
+		configMapNamespacedName := types.NamespacedName{
+			Name:      resourceName + "-cluster-config",
+			Namespace: selectedNamespace,
+		}
+
+		BeforeEach(func() {
+			By("creating a namespace matched by the selector")
+			namespace := &corev1.Namespace{}
+			err := k8sClient.Get(ctx, types.NamespacedName{Name: selectedNamespace}, namespace)
+			if err != nil && errors.IsNotFound(err) {
+				namespace = &corev1.Namespace{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:   selectedNamespace,
+						Labels: map[string]string{"proxy": "corporate"},
+					},
+				}
+				Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+			}
+
+			By("creating the custom resource for the Kind ClusterProxyDef")
+			resource := &proxyv1alpha1.ClusterProxyDef{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: resourceName,
+				},
+				Spec: proxyv1alpha1.ClusterProxyDefSpec{
+					NamespaceSelector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{"proxy": "corporate"},
+					},
+					ProxyDefSpec: proxyv1alpha1.ProxyDefSpec{
+						HTTPProxy: "http://proxy.example.com:3128",
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, resource)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			resource := &proxyv1alpha1.ClusterProxyDef{}
+			err := k8sClient.Get(ctx, typeNamespacedName, resource)
+			if !errors.IsNotFound(err) {
+				Expect(err).NotTo(HaveOccurred())
+
+				By("Cleanup the specific resource instance ClusterProxyDef")
+				Expect(k8sClient.Delete(ctx, resource)).To(Succeed())
+				// The finalizer is only removed by a reconciliation, so it is removed by hand
+				Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+				if controllerutil.RemoveFinalizer(resource, proxyDefFinalizer) {
+					Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+				}
+			}
+
+			// envtest does not run the garbage collector, so owned objects are removed by hand
+			configMap := &corev1.ConfigMap{}
+			if err := k8sClient.Get(ctx, configMapNamespacedName, configMap); err == nil {
+				Expect(k8sClient.Delete(ctx, configMap)).To(Succeed())
+			}
+		})
+
+		It("should render ConfigMaps into selected namespaces only", func() {
+			controllerReconciler := &ClusterProxyDefReconciler{
+				Client:    k8sClient,
+				APIReader: k8sClient,
+				Scheme:    k8sClient.Scheme(),
+				Recorder:  record.NewFakeRecorder(10),
+			}
+
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			configMap := &corev1.ConfigMap{}
+			Expect(k8sClient.Get(ctx, configMapNamespacedName, configMap)).To(Succeed())
+			Expect(configMap.Data).To(HaveKeyWithValue("HTTP_PROXY", "http://proxy.example.com:3128"))
+			Expect(configMap.Labels).To(HaveKeyWithValue(clusterProxyDefLabel, resourceName))
+			Expect(configMap.Labels).To(HaveKeyWithValue(proxyv1alpha1.GeneratedLabel, "true"))
+
+			err = k8sClient.Get(ctx, types.NamespacedName{Name: configMapNamespacedName.Name, Namespace: "default"}, configMap)
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+
+			resource := &proxyv1alpha1.ClusterProxyDef{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.ConfigMapName).To(Equal(configMapNamespacedName.Name))
+			Expect(resource.Status.Namespaces).To(ConsistOf(selectedNamespace))
+		})
+
+		It("should clean up ConfigMaps of namespaces that stop matching", func() {
+			controllerReconciler := &ClusterProxyDefReconciler{
+				Client:    k8sClient,
+				APIReader: k8sClient,
+				Scheme:    k8sClient.Scheme(),
+				Recorder:  record.NewFakeRecorder(10),
+			}
+
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Changing the selector so that the namespace no longer matches")
+			resource := &proxyv1alpha1.ClusterProxyDef{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Spec.NamespaceSelector.MatchLabels = map[string]string{"proxy": "other"}
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			configMap := &corev1.ConfigMap{}
+			err = k8sClient.Get(ctx, configMapNamespacedName, configMap)
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.Namespaces).To(BeEmpty())
+		})
+		It("should hold the deletion back or empty the generated objects while Pods use them", func() {
+			controllerReconciler := &ClusterProxyDefReconciler{
+				Client:    k8sClient,
+				APIReader: k8sClient,
+				Scheme:    k8sClient.Scheme(),
+				Recorder:  record.NewFakeRecorder(10),
+			}
+
+			By("Blocking the deletion while in use")
+			resource := &proxyv1alpha1.ClusterProxyDef{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Spec.DeletionPolicy = proxyv1alpha1.DeletionPolicyBlockWhileInUse
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Finalizers).To(ContainElement(proxyDefFinalizer))
+
+			By("Creating a Pod that loads its environment from the ConfigMap")
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "deletion", Namespace: selectedNamespace},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  "app",
+						Image: "busybox",
+						EnvFrom: []corev1.EnvFromSource{{
+							ConfigMapRef: &corev1.ConfigMapEnvSource{
+								LocalObjectReference: corev1.LocalObjectReference{Name: configMapNamespacedName.Name},
+							},
+						}},
+					}},
+				},
+			}
+			Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, pod)).To(Succeed())
+			}()
+
+			Expect(k8sClient.Delete(ctx, resource)).To(Succeed())
+			result, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(deletionRequeueInterval))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			ready := meta.FindStatusCondition(resource.Status.Conditions, typeReadyProxyDef)
+			Expect(ready).NotTo(BeNil())
+			Expect(ready.Reason).To(Equal("DeletionBlocked"))
+			Expect(ready.Message).To(ContainSubstring(selectedNamespace + "/" + pod.Name))
+
+			By("Switching to the Cleanup policy")
+			resource.Spec.DeletionPolicy = proxyv1alpha1.DeletionPolicyCleanup
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, typeNamespacedName, resource))).To(BeTrue())
+
+			configMap := &corev1.ConfigMap{}
+			Expect(k8sClient.Get(ctx, configMapNamespacedName, configMap)).To(Succeed())
+			Expect(configMap.OwnerReferences).To(BeEmpty())
+			Expect(configMap.Data).To(HaveKeyWithValue("HTTP_PROXY", ""))
+		})
+	})
+})
@@ -0,0 +1,193 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/igordcard/proxius/api/v1alpha1"
+)
+
+// configFilesData renders the configuration files of the profiles opted into by a spec,
+// keyed as they are mounted from the generated ConfigMap, or nil without profiles.
+// The discovered NO_PROXY entries are merged in as for the environment variables.
+func configFilesData(spec *v1alpha1.ProxyDefSpec, discovered []string) map[string]string {
+	if len(spec.ConfigFiles) == 0 {
+		return nil
+	}
+	files := &configFiles{
+		httpProxy:  configFileProxyURL(spec, spec.HTTPProxy),
+		httpsProxy: configFileProxyURL(spec, spec.HTTPSProxy),
+		noProxy:    mergeNoProxy(spec, discovered),
+	}
+	if spec.TrustedCA != nil {
+		files.caFile = v1alpha1.TrustedCAFile
+	}
+	data := map[string]string{}
+	for _, profile := range spec.ConfigFiles {
+		switch profile {
+		case v1alpha1.ConfigFileProfileApt:
+			data[profile.Key()] = files.apt()
+		case v1alpha1.ConfigFileProfilePip:
+			data[profile.Key()] = files.pip()
+		case v1alpha1.ConfigFileProfileNpm:
+			data[profile.Key()] = files.npm()
+		case v1alpha1.ConfigFileProfileGit:
+			data[profile.Key()] = files.git()
+		case v1alpha1.ConfigFileProfileMaven:
+			data[profile.Key()] = files.maven(spec)
+		}
+	}
+	return data
+}
+
+// configFiles holds what the configuration files are rendered from
+type configFiles struct {
+	httpProxy  string
+	httpsProxy string
+	noProxy    string
+	caFile     string
+}
+
+// anyProxy returns the proxy used by the tools that take a single one for every scheme,
+// preferring the HTTPS proxy since package indexes and repositories are mostly served over HTTPS
+func (f *configFiles) anyProxy() string {
+	if f.httpsProxy != "" {
+		return f.httpsProxy
+	}
+	return f.httpProxy
+}
+
+// apt renders an apt.conf snippet. apt only bypasses the proxy for exact hosts,
+// so the NO_PROXY domains, wildcards and CIDRs are left out.
+func (f *configFiles) apt() string {
+	var b strings.Builder
+	for _, proxy := range []struct{ scheme, value string }{{"http", f.httpProxy}, {"https", f.httpsProxy}} {
+		if proxy.value == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "Acquire::%s::Proxy %q;\n", proxy.scheme, proxy.value)
+		for _, entry := range v1alpha1.SplitList(f.noProxy) {
+			if !strings.ContainsAny(entry, "*/") && !strings.HasPrefix(entry, ".") {
+				fmt.Fprintf(&b, "Acquire::%s::Proxy::%s \"DIRECT\";\n", proxy.scheme, entry)
+			}
+		}
+	}
+	if f.caFile != "" {
+		fmt.Fprintf(&b, "Acquire::https::CaInfo %q;\n", f.caFile)
+	}
+	return b.String()
+}
+
+// pip renders a pip.conf. pip takes a single proxy, and honours no_proxy from the environment.
+func (f *configFiles) pip() string {
+	var b strings.Builder
+	b.WriteString("[global]\n")
+	if proxy := f.anyProxy(); proxy != "" {
+		fmt.Fprintf(&b, "proxy = %s\n", proxy)
+	}
+	if f.caFile != "" {
+		fmt.Fprintf(&b, "cert = %s\n", f.caFile)
+	}
+	return b.String()
+}
+
+// npm renders a global npmrc
+func (f *configFiles) npm() string {
+	var b strings.Builder
+	if f.httpProxy != "" {
+		fmt.Fprintf(&b, "proxy=%s\n", f.httpProxy)
+	}
+	if f.httpsProxy != "" {
+		fmt.Fprintf(&b, "https-proxy=%s\n", f.httpsProxy)
+	}
+	if f.noProxy != "" {
+		fmt.Fprintf(&b, "noproxy=%s\n", f.noProxy)
+	}
+	if f.caFile != "" {
+		fmt.Fprintf(&b, "cafile=%s\n", f.caFile)
+	}
+	return b.String()
+}
+
+// git renders a system gitconfig. git takes a single proxy, and libcurl still honours
+// no_proxy from the environment.
+func (f *configFiles) git() string {
+	var b strings.Builder
+	b.WriteString("[http]\n")
+	if proxy := f.anyProxy(); proxy != "" {
+		fmt.Fprintf(&b, "\tproxy = %s\n", proxy)
+	}
+	if f.caFile != "" {
+		fmt.Fprintf(&b, "\tsslCAInfo = %s\n", f.caFile)
+	}
+	return b.String()
+}
+
+// maven renders a global settings.xml, translating NO_PROXY as for the JVM
+func (f *configFiles) maven(spec *v1alpha1.ProxyDefSpec) string {
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString("<settings xmlns=\"http://maven.apache.org/SETTINGS/1.0.0\">\n  <proxies>\n")
+	nonProxyHosts := javaNonProxyHosts(v1alpha1.SplitList(f.noProxy), spec.NonProxyHosts, spec.ExpansionLimit())
+	for _, proxy := range []struct{ protocol, value string }{{"http", spec.HTTPProxy}, {"https", spec.HTTPSProxy}} {
+		host, port, ok := javaProxyHostPort(spec, proxy.value)
+		if !ok {
+			continue
+		}
+		b.WriteString("    <proxy>\n")
+		fmt.Fprintf(&b, "      <id>proxius-%s</id>\n", proxy.protocol)
+		b.WriteString("      <active>true</active>\n")
+		fmt.Fprintf(&b, "      <protocol>%s</protocol>\n", proxy.protocol)
+		fmt.Fprintf(&b, "      <host>%s</host>\n", xmlEscape(host))
+		fmt.Fprintf(&b, "      <port>%d</port>\n", port)
+		if nonProxyHosts != "" {
+			fmt.Fprintf(&b, "      <nonProxyHosts>%s</nonProxyHosts>\n", xmlEscape(nonProxyHosts))
+		}
+		b.WriteString("    </proxy>\n")
+	}
+	b.WriteString("  </proxies>\n</settings>\n")
+	return b.String()
+}
+
+// configFileProxyURL returns a proxy URL with the scheme and port that the spec assumes
+// when the URL has none, since configuration files are not as lenient as HTTP_PROXY
+func configFileProxyURL(spec *v1alpha1.ProxyDefSpec, value string) string {
+	host, port, ok := javaProxyHostPort(spec, value)
+	if !ok {
+		return ""
+	}
+	scheme := spec.ProxyProtocol
+	if i := strings.Index(value, "://"); i >= 0 {
+		scheme = value[:i]
+	}
+	if scheme == "" {
+		scheme = "http"
+	}
+	return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// xmlEscape escapes text for an XML element
+func xmlEscape(text string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(text))
+	return b.String()
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/igordcard/proxius/api/v1alpha1"
+)
+
+// proxyVariable is a proxy environment variable rendered from a ProxyDefSpec
+type proxyVariable struct {
+	name  string
+	value string
+	// always renders the variable even when empty, as HTTP_PROXY and HTTPS_PROXY always were
+	always bool
+}
+
+// proxyConfigData renders the proxy environment variables described by a ProxyDefSpec.
+// It is shared by ProxyDef and ClusterProxyDef so that both produce identical ConfigMaps.
+// The discovered NO_PROXY entries are merged after the ones of the spec, and also
+// rendered in every NoProxyFormat when the spec chooses one.
+// When credentials are given, the proxy URLs are rendered with them embedded into
+// the returned Secret data instead, so that they never end up in a ConfigMap.
+func proxyConfigData(spec *v1alpha1.ProxyDefSpec, discovered []string, credentials *proxyCredentials) (map[string]string, map[string][]byte, error) {
+	noProxy := mergeNoProxy(spec, discovered)
+	data := map[string]string{}
+	if spec.InjectJavaToolOptions {
+		data[v1alpha1.JavaToolOptionsKey] = javaToolOptions(spec, noProxy)
+	}
+	// Once a format is chosen, every format is rendered so that Pods can pick another one
+	if spec.NoProxyFormat != "" {
+		entries := v1alpha1.SplitList(noProxy)
+		for _, format := range v1alpha1.NoProxyFormats {
+			data[v1alpha1.NoProxyVariantKey(format)] = formatNoProxy(entries, format, spec.ExpansionLimit())
+		}
+		noProxy = data[v1alpha1.NoProxyVariantKey(spec.NoProxyFormat)]
+	}
+	data["NO_PROXY"] = noProxy
+	data["no_proxy"] = noProxy
+	var secretData map[string][]byte
+	if credentials != nil {
+		secretData = map[string][]byte{}
+	}
+
+	// The protocol-specific proxies are only rendered when set, since an empty
+	// ALL_PROXY or SOCKS_PROXY confuses some tools more than a missing one
+	variables := []proxyVariable{
+		{name: "HTTP_PROXY", value: spec.HTTPProxy, always: true},
+		{name: "HTTPS_PROXY", value: spec.HTTPSProxy, always: true},
+		{name: "ALL_PROXY", value: spec.AllProxy},
+		{name: "SOCKS_PROXY", value: spec.SocksProxyURL()},
+		{name: "FTP_PROXY", value: spec.FTPProxy},
+	}
+	for _, variable := range variables {
+		if credentials == nil || variable.value == "" {
+			if variable.always || variable.value != "" {
+				setProxyVariable(data, variable.name, variable.value)
+			}
+			continue
+		}
+		value, err := withCredentials(variable.value, credentials.userinfo)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", variable.name, err)
+		}
+		secretData[variable.name] = []byte(value)
+		secretData[strings.ToLower(variable.name)] = []byte(value)
+	}
+
+	// The bundle itself is mounted from a ConfigMap of its own, since it can grow
+	// beyond what fits into an environment variable
+	if spec.TrustedCA != nil {
+		for _, name := range v1alpha1.TrustedCAVariables {
+			data[name] = v1alpha1.TrustedCAFile
+		}
+	}
+	return data, secretData, nil
+}
+
+// splitVariants moves the helper variables out of the data rendered by proxyConfigData
+// and returns them, or nil when there are none. The generated ConfigMap is injected
+// whole through envFrom, so they go to a ConfigMap of their own, from which the pod
+// webhook only references the ones a container needs.
+func splitVariants(data map[string]string) map[string]string {
+	var variants map[string]string
+	for key, value := range data {
+		if !strings.HasPrefix(key, v1alpha1.VariantKeyPrefix) {
+			continue
+		}
+		if variants == nil {
+			variants = map[string]string{}
+		}
+		variants[key] = value
+		delete(data, key)
+	}
+	return variants
+}
+
+// hasVariants reports whether a ProxyDefSpec renders any helper variable
+func hasVariants(spec *v1alpha1.ProxyDefSpec) bool {
+	return spec.InjectJavaToolOptions || spec.NoProxyFormat != ""
+}
+
+// configHash identifies the proxy configuration rendered from a ProxyDefSpec, along with
+// the revision of its credentials. The credentials themselves are left out of it, since
+// the hash ends up on Pods, where it would otherwise allow guessing them offline.
+// Their revision is keyed instead, and changes with them rather than with the Secret.
+// Discovered NO_PROXY entries are left out too, so that nodes joining or leaving
+// the cluster do not restart every workload. The configuration files are part of it,
+// since they are mounted by subPath, which running containers never see updated.
+func configHash(spec *v1alpha1.ProxyDefSpec, credentials *proxyCredentials) string {
+	// Without credentials, rendering cannot fail and every variable ends up in the ConfigMap data
+	data, _, _ := proxyConfigData(spec, nil, nil)
+	for key, value := range configFilesData(spec, nil) {
+		data["file:"+key] = value
+	}
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%s=%s\n", key, data[key])
+	}
+	if credentials != nil {
+		fmt.Fprintf(hash, "credentials=%s\n", credentials.revision)
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// setProxyVariable sets both the upper- and lower-case forms of a proxy variable
+func setProxyVariable(data map[string]string, name, value string) {
+	data[name] = value
+	data[strings.ToLower(name)] = value
+}
+
+// getGenerated reads a generated ConfigMap or Secret from the cache, falling back to the
+// API server when it is not found there, since the ones generated by older versions lack
+// GeneratedLabel, and so are left out of the cache until they are updated
+func getGenerated(ctx context.Context, c, apiReader client.Reader, key client.ObjectKey, object client.Object) error {
+	err := c.Get(ctx, key, object)
+	if apierrors.IsNotFound(err) {
+		return apiReader.Get(ctx, key, object)
+	}
+	return err
+}
+
+// configMapNeedsUpdate reports whether the existing ConfigMap differs from the desired one
+// in any of the fields owned by the controller
+func configMapNeedsUpdate(existing, desired *corev1.ConfigMap) bool {
+	return !equalStringMaps(existing.Data, desired.Data) ||
+		!equalStringMaps(existing.Labels, desired.Labels) ||
+		!equalStringMaps(existing.Annotations, desired.Annotations) ||
+		!equality.Semantic.DeepEqual(existing.OwnerReferences, desired.OwnerReferences)
+}
+
+// equalStringMaps compares two maps treating nil and empty maps as equal
+func equalStringMaps(a, b map[string]string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return equality.Semantic.DeepEqual(a, b)
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// credentialsUsernameKey and credentialsPasswordKey are the keys read from a
+	// referenced credentials Secret, matching the kubernetes.io/basic-auth type
+	credentialsUsernameKey = corev1.BasicAuthUsernameKey
+	credentialsPasswordKey = corev1.BasicAuthPasswordKey
+)
+
+// credentialsError reports a referenced credentials Secret that cannot be used
+type credentialsError struct {
+	reason  string
+	message string
+}
+
+func (e *credentialsError) Error() string {
+	return e.message
+}
+
+// proxyCredentials are the credentials read from a referenced Secret
+type proxyCredentials struct {
+	userinfo *url.Userinfo
+	// revision changes along with the credentials, without revealing them
+	revision string
+}
+
+// loadProxyCredentials reads the proxy credentials from the Secret namespace/name.
+// The returned error is a *credentialsError when the Secret is missing or malformed.
+func loadProxyCredentials(ctx context.Context, c client.Reader, namespace, name string) (*proxyCredentials, error) {
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, &credentialsError{reason: "CredentialsSecretNotFound", message: fmt.Sprintf("Credentials Secret %s/%s not found", namespace, name)}
+		}
+		return nil, err
+	}
+
+	username := string(secret.Data[credentialsUsernameKey])
+	if username == "" {
+		return nil, &credentialsError{reason: "CredentialsSecretInvalid", message: fmt.Sprintf("Credentials Secret %s/%s has no %q key", namespace, name, credentialsUsernameKey)}
+	}
+	// The revision is keyed with the UID of the Secret, so that it cannot be told from the values
+	mac := hmac.New(sha256.New, []byte(secret.UID))
+	mac.Write([]byte(username))
+	credentials := &proxyCredentials{userinfo: url.User(username)}
+	if password, ok := secret.Data[credentialsPasswordKey]; ok {
+		credentials.userinfo = url.UserPassword(username, string(password))
+		mac.Write([]byte{0})
+		mac.Write(password)
+	}
+	credentials.revision = hex.EncodeToString(mac.Sum(nil))
+	return credentials, nil
+}
+
+// withCredentials embeds the credentials into a proxy URL, defaulting to http://
+// when the URL has no scheme, like most tools do for HTTP_PROXY
+func withCredentials(value string, credentials *url.Userinfo) (string, error) {
+	if !strings.Contains(value, "://") {
+		value = "http://" + value
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return "", err
+	}
+	u.User = credentials
+	return u.String(), nil
+}
+
+// secretNeedsUpdate reports whether the existing Secret differs from the desired one
+// in any of the fields owned by the controller
+func secretNeedsUpdate(existing, desired *corev1.Secret) bool {
+	return existing.Type != desired.Type ||
+		!equalByteMaps(existing.Data, desired.Data) ||
+		!equalStringMaps(existing.Labels, desired.Labels) ||
+		!equalStringMaps(existing.Annotations, desired.Annotations) ||
+		!equality.Semantic.DeepEqual(existing.OwnerReferences, desired.OwnerReferences)
+}
+
+// equalByteMaps compares two maps treating nil and empty maps as equal
+func equalByteMaps(a, b map[string][]byte) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return equality.Semantic.DeepEqual(a, b)
+}
@@ -0,0 +1,385 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/igordcard/proxius/api/v1alpha1"
+)
+
+// proxyDefFinalizer holds a ProxyDef back until its DeletionPolicy has been applied
+const proxyDefFinalizer = "proxy.igordc.com/finalizer"
+
+// deletionRequeueInterval is how often a deletion blocked by Pods in use is checked upon
+const deletionRequeueInterval = 30 * time.Second
+
+// maxListedPods is how many of the Pods blocking a deletion are named in the condition
+const maxListedPods = 5
+
+// finalizeProxyDef applies the DeletionPolicy of a ProxyDef being deleted, then removes its finalizer
+func (r *ProxyDefReconciler) finalizeProxyDef(ctx context.Context, proxydef *v1alpha1.ProxyDef) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	if !controllerutil.ContainsFinalizer(proxydef, proxyDefFinalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	configMapNames := []string{configMapName(proxydef), trustedCAConfigMapName(proxydef), configFilesConfigMapName(proxydef), variantsConfigMapName(proxydef)}
+	pods, err := podsReferencing(ctx, r.Client, proxydef.Namespace, configMapNames, secretName(proxydef))
+	if err != nil {
+		log.Error(err, "Failed to list the Pods referencing the generated objects")
+		return ctrl.Result{}, err
+	}
+
+	policy := proxydef.Spec.DeletionPolicyOrDefault()
+	switch {
+	case policy == v1alpha1.DeletionPolicyOrphan:
+		if err := r.releaseGenerated(ctx, proxydef, false); err != nil {
+			log.Error(err, "Failed to orphan the generated objects")
+			return ctrl.Result{}, err
+		}
+	case len(pods) == 0:
+	case policy == v1alpha1.DeletionPolicyBlockWhileInUse:
+		return r.setDeletionBlockedCondition(ctx, proxydef, pods)
+	default:
+		// Pods restarted later on still need the objects to exist, but not the proxies
+		if err := r.releaseGenerated(ctx, proxydef, true); err != nil {
+			log.Error(err, "Failed to empty the generated objects")
+			return ctrl.Result{}, err
+		}
+		r.Recorder.Eventf(proxydef, corev1.EventTypeNormal, "GeneratedObjectsEmptied", "%d Pods still reference the generated objects, which have been emptied and left behind", len(pods))
+	}
+
+	controllerutil.RemoveFinalizer(proxydef, proxyDefFinalizer)
+	if err := r.Update(ctx, proxydef); err != nil {
+		log.Error(err, "Failed to remove the finalizer of the ProxyDef")
+		return ctrl.Result{}, err
+	}
+	log.Info("ProxyDef finalized", "deletionPolicy", policy, "pods", len(pods))
+	return ctrl.Result{}, nil
+}
+
+// releaseGenerated orphans the objects generated from a ProxyDef, emptied when empty is set.
+// The trusted CA bundle is never emptied, or Pods mounting it would distrust every server.
+func (r *ProxyDefReconciler) releaseGenerated(ctx context.Context, proxydef *v1alpha1.ProxyDef, empty bool) error {
+	configMap := &corev1.ConfigMap{}
+	if err := getGenerated(ctx, r.Client, r.APIReader, client.ObjectKey{Namespace: proxydef.Namespace, Name: configMapName(proxydef)}, configMap); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+	} else if metav1.IsControlledBy(configMap, proxydef) {
+		configMap.OwnerReferences = withoutOwner(configMap.OwnerReferences, proxydef)
+		if empty {
+			for key := range configMap.Data {
+				configMap.Data[key] = ""
+			}
+		}
+		if err := r.Update(ctx, configMap); err != nil {
+			return err
+		}
+	}
+
+	secret := &corev1.Secret{}
+	if err := getGenerated(ctx, r.Client, r.APIReader, client.ObjectKey{Namespace: proxydef.Namespace, Name: secretName(proxydef)}, secret); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+	} else if metav1.IsControlledBy(secret, proxydef) {
+		secret.OwnerReferences = withoutOwner(secret.OwnerReferences, proxydef)
+		if empty {
+			for key := range secret.Data {
+				secret.Data[key] = []byte{}
+			}
+		}
+		if err := r.Update(ctx, secret); err != nil {
+			return err
+		}
+	}
+
+	for name, emptied := range map[string]bool{trustedCAConfigMapName(proxydef): false, configFilesConfigMapName(proxydef): empty, variantsConfigMapName(proxydef): empty} {
+		mounted := &corev1.ConfigMap{}
+		if err := getGenerated(ctx, r.Client, r.APIReader, client.ObjectKey{Namespace: proxydef.Namespace, Name: name}, mounted); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return err
+			}
+			continue
+		}
+		if !metav1.IsControlledBy(mounted, proxydef) {
+			continue
+		}
+		mounted.OwnerReferences = withoutOwner(mounted.OwnerReferences, proxydef)
+		if emptied {
+			for key := range mounted.Data {
+				mounted.Data[key] = ""
+			}
+		}
+		if err := r.Update(ctx, mounted); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setDeletionBlockedCondition reports the Pods holding the deletion of a ProxyDef back
+func (r *ProxyDefReconciler) setDeletionBlockedCondition(ctx context.Context, proxydef *v1alpha1.ProxyDef, pods []string) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	message := deletionBlockedMessage(pods)
+	previous := proxydef.Status.DeepCopy()
+	meta.SetStatusCondition(&proxydef.Status.Conditions, metav1.Condition{Type: typeReadyProxyDef, Status: metav1.ConditionFalse, Reason: "DeletionBlocked", Message: message, ObservedGeneration: proxydef.Generation})
+	if !equality.Semantic.DeepEqual(previous, &proxydef.Status) {
+		r.Recorder.Event(proxydef, corev1.EventTypeWarning, "DeletionBlocked", message)
+		if err := r.Status().Update(ctx, proxydef); err != nil {
+			log.Error(err, "Failed to update ProxyDef status (to DeletionBlocked)")
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{RequeueAfter: deletionRequeueInterval}, nil
+}
+
+// finalizeClusterProxyDef applies the DeletionPolicy of a ClusterProxyDef being deleted, namespace
+// by namespace, then removes its finalizer
+func (r *ClusterProxyDefReconciler) finalizeClusterProxyDef(ctx context.Context, clusterproxydef *v1alpha1.ClusterProxyDef) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	if !controllerutil.ContainsFinalizer(clusterproxydef, proxyDefFinalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	configMaps := &corev1.ConfigMapList{}
+	if err := r.List(ctx, configMaps, client.MatchingLabels{clusterProxyDefLabel: clusterproxydef.Name}); err != nil {
+		log.Error(err, "Failed to list the generated ConfigMaps")
+		return ctrl.Result{}, err
+	}
+	secrets := &corev1.SecretList{}
+	if err := r.List(ctx, secrets, client.MatchingLabels{clusterProxyDefLabel: clusterproxydef.Name}); err != nil {
+		log.Error(err, "Failed to list the generated Secrets")
+		return ctrl.Result{}, err
+	}
+	namespaces := map[string]bool{}
+	for i := range configMaps.Items {
+		namespaces[configMaps.Items[i].Namespace] = true
+	}
+	for i := range secrets.Items {
+		namespaces[secrets.Items[i].Namespace] = true
+	}
+
+	configMapNames := []string{clusterConfigMapName(clusterproxydef), clusterTrustedCAConfigMapName(clusterproxydef), clusterConfigFilesConfigMapName(clusterproxydef), clusterVariantsConfigMapName(clusterproxydef)}
+	inUse := map[string]bool{}
+	var pods []string
+	for namespace := range namespaces {
+		names, err := podsReferencing(ctx, r.Client, namespace, configMapNames, clusterSecretName(clusterproxydef))
+		if err != nil {
+			log.Error(err, "Failed to list the Pods referencing the generated objects", "namespace", namespace)
+			return ctrl.Result{}, err
+		}
+		inUse[namespace] = len(names) > 0
+		for _, name := range names {
+			pods = append(pods, namespace+"/"+name)
+		}
+	}
+	sort.Strings(pods)
+
+	policy := clusterproxydef.Spec.DeletionPolicyOrDefault()
+	switch {
+	case policy == v1alpha1.DeletionPolicyOrphan:
+		if err := r.releaseGenerated(ctx, clusterproxydef, configMaps, secrets, namespaces, false); err != nil {
+			log.Error(err, "Failed to orphan the generated objects")
+			return ctrl.Result{}, err
+		}
+	case len(pods) == 0:
+	case policy == v1alpha1.DeletionPolicyBlockWhileInUse:
+		return r.setDeletionBlockedCondition(ctx, clusterproxydef, pods)
+	default:
+		// Pods restarted later on still need the objects to exist, but not the proxies
+		if err := r.releaseGenerated(ctx, clusterproxydef, configMaps, secrets, inUse, true); err != nil {
+			log.Error(err, "Failed to empty the generated objects")
+			return ctrl.Result{}, err
+		}
+		r.Recorder.Eventf(clusterproxydef, corev1.EventTypeNormal, "GeneratedObjectsEmptied", "%d Pods still reference the generated objects, which have been emptied and left behind in their namespaces", len(pods))
+	}
+
+	controllerutil.RemoveFinalizer(clusterproxydef, proxyDefFinalizer)
+	if err := r.Update(ctx, clusterproxydef); err != nil {
+		log.Error(err, "Failed to remove the finalizer of the ClusterProxyDef")
+		return ctrl.Result{}, err
+	}
+	log.Info("ClusterProxyDef finalized", "deletionPolicy", policy, "pods", len(pods))
+	return ctrl.Result{}, nil
+}
+
+// releaseGenerated orphans the objects generated from a ClusterProxyDef in the kept namespaces
+func (r *ClusterProxyDefReconciler) releaseGenerated(ctx context.Context, clusterproxydef *v1alpha1.ClusterProxyDef, configMaps *corev1.ConfigMapList, secrets *corev1.SecretList, keep map[string]bool, empty bool) error {
+	for i := range configMaps.Items {
+		configMap := &configMaps.Items[i]
+		if !keep[configMap.Namespace] || !metav1.IsControlledBy(configMap, clusterproxydef) {
+			continue
+		}
+		configMap.OwnerReferences = withoutOwner(configMap.OwnerReferences, clusterproxydef)
+		if empty && configMap.Name != clusterTrustedCAConfigMapName(clusterproxydef) {
+			for key := range configMap.Data {
+				configMap.Data[key] = ""
+			}
+		}
+		if err := r.Update(ctx, configMap); err != nil {
+			return err
+		}
+	}
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		if !keep[secret.Namespace] || !metav1.IsControlledBy(secret, clusterproxydef) {
+			continue
+		}
+		secret.OwnerReferences = withoutOwner(secret.OwnerReferences, clusterproxydef)
+		if empty {
+			for key := range secret.Data {
+				secret.Data[key] = []byte{}
+			}
+		}
+		if err := r.Update(ctx, secret); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setDeletionBlockedCondition reports the Pods holding the deletion of a ClusterProxyDef back
+func (r *ClusterProxyDefReconciler) setDeletionBlockedCondition(ctx context.Context, clusterproxydef *v1alpha1.ClusterProxyDef, pods []string) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	message := deletionBlockedMessage(pods)
+	previous := clusterproxydef.Status.DeepCopy()
+	meta.SetStatusCondition(&clusterproxydef.Status.Conditions, metav1.Condition{Type: typeReadyProxyDef, Status: metav1.ConditionFalse, Reason: "DeletionBlocked", Message: message, ObservedGeneration: clusterproxydef.Generation})
+	if !equality.Semantic.DeepEqual(previous, &clusterproxydef.Status) {
+		r.Recorder.Event(clusterproxydef, corev1.EventTypeWarning, "DeletionBlocked", message)
+		if err := r.Status().Update(ctx, clusterproxydef); err != nil {
+			log.Error(err, "Failed to update ClusterProxyDef status (to DeletionBlocked)")
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{RequeueAfter: deletionRequeueInterval}, nil
+}
+
+// deletionBlockedMessage names the first few of the Pods holding a deletion back
+func deletionBlockedMessage(pods []string) string {
+	listed := pods
+	if len(listed) > maxListedPods {
+		listed = append(listed[:maxListedPods:maxListedPods], "...")
+	}
+	return fmt.Sprintf("Deletion is blocked while %d Pods reference the generated objects: %s", len(pods), strings.Join(listed, ", "))
+}
+
+// withoutOwner returns the owner references without the ones to owner
+func withoutOwner(references []metav1.OwnerReference, owner client.Object) []metav1.OwnerReference {
+	kept := []metav1.OwnerReference{}
+	for _, reference := range references {
+		if reference.UID != owner.GetUID() {
+			kept = append(kept, reference)
+		}
+	}
+	return kept
+}
+
+// podsReferencing returns the sorted names of the Pods that may still start a container needing
+// the given ConfigMaps or Secret
+func podsReferencing(ctx context.Context, c client.Client, namespace string, configMapNames []string, secretName string) ([]string, error) {
+	pods := &corev1.PodList{}
+	if err := c.List(ctx, pods, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	var names []string
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		if podReferences(pod, configMapNames, secretName) {
+			names = append(names, pod.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// podReferences reports whether a Pod loads its environment from, or mounts, any of the given objects
+func podReferences(pod *corev1.Pod, configMapNames []string, secretName string) bool {
+	isConfigMap := func(name string) bool {
+		for _, configMapName := range configMapNames {
+			if name == configMapName {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, volume := range pod.Spec.Volumes {
+		if volume.ConfigMap != nil && isConfigMap(volume.ConfigMap.Name) ||
+			volume.Secret != nil && volume.Secret.SecretName == secretName {
+			return true
+		}
+		if volume.Projected == nil {
+			continue
+		}
+		for _, source := range volume.Projected.Sources {
+			if source.ConfigMap != nil && isConfigMap(source.ConfigMap.Name) ||
+				source.Secret != nil && source.Secret.Name == secretName {
+				return true
+			}
+		}
+	}
+
+	containers := append([]corev1.Container{}, pod.Spec.InitContainers...)
+	containers = append(containers, pod.Spec.Containers...)
+	for i := range pod.Spec.EphemeralContainers {
+		containers = append(containers, corev1.Container(pod.Spec.EphemeralContainers[i].EphemeralContainerCommon))
+	}
+	for _, container := range containers {
+		for _, envFrom := range container.EnvFrom {
+			if envFrom.ConfigMapRef != nil && isConfigMap(envFrom.ConfigMapRef.Name) ||
+				envFrom.SecretRef != nil && envFrom.SecretRef.Name == secretName {
+				return true
+			}
+		}
+		for _, env := range container.Env {
+			if env.ValueFrom == nil {
+				continue
+			}
+			if ref := env.ValueFrom.ConfigMapKeyRef; ref != nil && isConfigMap(ref.Name) {
+				return true
+			}
+			if ref := env.ValueFrom.SecretKeyRef; ref != nil && ref.Name == secretName {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/igordcard/proxius/api/v1alpha1"
+)
+
+// javaToolOptions renders the proxies of a spec as the JVM system properties the
+// built-in HTTP clients read, since the JVM ignores HTTP_PROXY and friends.
+// The JVM has no standard property for proxy credentials, so none are rendered.
+func javaToolOptions(spec *v1alpha1.ProxyDefSpec, noProxy string) string {
+	options := []string{}
+	for _, proxy := range []struct{ protocol, value string }{{"http", spec.HTTPProxy}, {"https", spec.HTTPSProxy}} {
+		host, port, ok := javaProxyHostPort(spec, proxy.value)
+		if !ok {
+			continue
+		}
+		options = append(options, fmt.Sprintf("-D%s.proxyHost=%s", proxy.protocol, host), fmt.Sprintf("-D%s.proxyPort=%d", proxy.protocol, port))
+	}
+	// http.nonProxyHosts is used for both HTTP and HTTPS
+	if hosts := javaNonProxyHosts(v1alpha1.SplitList(noProxy), spec.NonProxyHosts, spec.ExpansionLimit()); hosts != "" {
+		options = append(options, "-Dhttp.nonProxyHosts="+hosts)
+	}
+	return strings.Join(options, " ")
+}
+
+// javaProxyHostPort returns the host and port of a proxy URL, assuming the
+// ProxyProtocol and ProxyPort of the spec when the URL has no scheme or port
+func javaProxyHostPort(spec *v1alpha1.ProxyDefSpec, value string) (string, int, bool) {
+	if value == "" {
+		return "", 0, false
+	}
+	if !strings.Contains(value, "://") {
+		protocol := spec.ProxyProtocol
+		if protocol == "" {
+			protocol = "http"
+		}
+		value = protocol + "://" + value
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Hostname() == "" {
+		return "", 0, false
+	}
+	if port, err := strconv.Atoi(u.Port()); err == nil {
+		return u.Hostname(), port, true
+	}
+	if spec.ProxyPort > 0 {
+		return u.Hostname(), spec.ProxyPort, true
+	}
+	if strings.EqualFold(u.Scheme, "https") {
+		return u.Hostname(), 443, true
+	}
+	return u.Hostname(), 80, true
+}
+
+// javaNonProxyHosts translates NO_PROXY entries into the pipe-separated, wildcard syntax
+// of http.nonProxyHosts, followed by the extra hosts given in that syntax already
+func javaNonProxyHosts(entries []string, extra string, expansionLimit int) string {
+	hosts := []string{}
+	for _, entry := range entries {
+		switch {
+		case entry == "*":
+			hosts = append(hosts, entry)
+		case strings.HasPrefix(entry, "."):
+			hosts = append(hosts, "*"+entry)
+		case strings.Contains(entry, "/"):
+			hosts = append(hosts, javaCIDR(entry, expansionLimit)...)
+		default:
+			hosts = append(hosts, entry)
+			// Like curl, a domain also matches its subdomains
+			if wildcard := wildcardDomain(entry); wildcard != "" {
+				hosts = append(hosts, wildcard)
+			}
+		}
+	}
+	hosts = append(hosts, strings.Split(extra, "|")...)
+
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, host := range hosts {
+		if host = strings.TrimSpace(host); host != "" && !seen[host] {
+			seen[host] = true
+			unique = append(unique, host)
+		}
+	}
+	return strings.Join(unique, "|")
+}
+
+// javaCIDR translates a CIDR into nonProxyHosts patterns: octet-aligned IPv4 CIDRs
+// become wildcards such as "10.*", and others are expanded when small enough.
+// CIDRs that cannot be translated are left out.
+func javaCIDR(entry string, expansionLimit int) []string {
+	_, network, err := net.ParseCIDR(entry)
+	if err != nil {
+		return nil
+	}
+	if ip := network.IP.To4(); ip != nil {
+		ones, _ := network.Mask.Size()
+		if ones%8 == 0 && ones < 32 {
+			octets := strings.Split(ip.String(), ".")[:ones/8]
+			return []string{strings.Join(append(octets, "*"), ".")}
+		}
+	}
+	expanded := expandCIDR(entry, expansionLimit)
+	if len(expanded) == 1 && expanded[0] == entry {
+		return nil
+	}
+	return expanded
+}
@@ -0,0 +1,227 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/yaml"
+
+	"github.com/igordcard/proxius/api/v1alpha1"
+)
+
+// defaultClusterDomain is assumed when the cluster DNS domain cannot be discovered
+const defaultClusterDomain = "cluster.local"
+
+// kubeadmConfigKey locates the ConfigMap where kubeadm stores the cluster configuration
+var kubeadmConfigKey = client.ObjectKey{Namespace: "kube-system", Name: "kubeadm-config"}
+
+// kubeadmClusterConfiguration holds the few fields read from kubeadm's ClusterConfiguration
+type kubeadmClusterConfiguration struct {
+	Networking struct {
+		ServiceSubnet string `json:"serviceSubnet"`
+		DNSDomain     string `json:"dnsDomain"`
+	} `json:"networking"`
+}
+
+// mergeNoProxy joins the NO_PROXY entries of a spec with the discovered ones, dropping duplicates.
+// NoProxy is kept verbatim when there is nothing to merge into it.
+func mergeNoProxy(spec *v1alpha1.ProxyDefSpec, discovered []string) string {
+	if spec.NoProxyCIDRs == "" && len(discovered) == 0 {
+		return spec.NoProxy
+	}
+	seen := map[string]bool{}
+	entries := []string{}
+	for _, list := range [][]string{v1alpha1.SplitList(spec.NoProxy), v1alpha1.SplitList(spec.NoProxyCIDRs), discovered} {
+		for _, entry := range list {
+			if !seen[entry] {
+				seen[entry] = true
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return strings.Join(entries, ",")
+}
+
+// formatNoProxy writes NO_PROXY entries in the given format
+func formatNoProxy(entries []string, format v1alpha1.NoProxyFormat, expansionLimit int) string {
+	formatted := []string{}
+	for _, entry := range entries {
+		switch format {
+		case v1alpha1.NoProxyFormatExpanded:
+			formatted = append(formatted, expandCIDR(entry, expansionLimit)...)
+		case v1alpha1.NoProxyFormatWildcard:
+			formatted = append(formatted, entry)
+			if wildcard := wildcardDomain(entry); wildcard != "" {
+				formatted = append(formatted, wildcard)
+			}
+		default:
+			formatted = append(formatted, entry)
+		}
+	}
+	return strings.Join(formatted, ",")
+}
+
+// expandCIDR returns the addresses of a CIDR when there are no more than limit of them,
+// or the entry itself when it is not a CIDR or is too large
+func expandCIDR(entry string, limit int) []string {
+	_, network, err := net.ParseCIDR(entry)
+	if err != nil {
+		return []string{entry}
+	}
+	ones, bits := network.Mask.Size()
+	if bits-ones >= 31 || 1<<(bits-ones) > limit {
+		return []string{entry}
+	}
+	addresses := make([]string, 0, 1<<(bits-ones))
+	ip := network.IP
+	for i := 0; i < 1<<(bits-ones); i++ {
+		addresses = append(addresses, ip.String())
+		ip = nextIP(ip)
+	}
+	return addresses
+}
+
+// nextIP returns the address following ip
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// wildcardDomain returns the "*.example.com" form of a domain entry such as
+// ".example.com" or "example.com", or "" for IPs, CIDRs and single-label names
+func wildcardDomain(entry string) string {
+	if strings.HasPrefix(entry, "*") || net.ParseIP(entry) != nil || strings.Contains(entry, "/") || strings.Contains(entry, ":") {
+		return ""
+	}
+	domain := strings.TrimPrefix(entry, ".")
+	if !strings.Contains(domain, ".") {
+		return ""
+	}
+	return "*." + domain
+}
+
+// discoverNoProxy returns the cluster networking that must bypass the proxy: the ClusterIP
+// of the "kubernetes" Service, the service subnet and DNS domain, and the pod CIDRs and
+// internal IPs of every node. Whatever cannot be found is skipped. The kubeadm ConfigMap is
+// read through apiReader, since the manager only caches the ConfigMaps it generates.
+func discoverNoProxy(ctx context.Context, c, apiReader client.Reader) ([]string, error) {
+	log := log.FromContext(ctx)
+	entries := []string{}
+
+	service := &corev1.Service{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "kubernetes"}, service); err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			return nil, err
+		}
+	} else {
+		entries = append(entries, service.Spec.ClusterIPs...)
+	}
+
+	// Kubernetes does not expose the service subnet through its API, but kubeadm records it
+	clusterDomain := defaultClusterDomain
+	kubeadmConfig := &corev1.ConfigMap{}
+	if err := apiReader.Get(ctx, kubeadmConfigKey, kubeadmConfig); err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			return nil, err
+		}
+	} else {
+		configuration := &kubeadmClusterConfiguration{}
+		if err := yaml.Unmarshal([]byte(kubeadmConfig.Data["ClusterConfiguration"]), configuration); err != nil {
+			log.Info("Ignoring unreadable kubeadm ClusterConfiguration", "err", err)
+		} else {
+			entries = append(entries, v1alpha1.SplitList(configuration.Networking.ServiceSubnet)...)
+			if configuration.Networking.DNSDomain != "" {
+				clusterDomain = configuration.Networking.DNSDomain
+			}
+		}
+	}
+	entries = append(entries, ".svc", "."+clusterDomain)
+
+	nodes := &corev1.NodeList{}
+	if err := c.List(ctx, nodes); err != nil {
+		return nil, err
+	}
+	sort.Slice(nodes.Items, func(i, j int) bool { return nodes.Items[i].Name < nodes.Items[j].Name })
+	for i := range nodes.Items {
+		entries = append(entries, nodeNoProxy(&nodes.Items[i])...)
+	}
+	return entries, nil
+}
+
+// nodeNoProxy returns the pod CIDRs and internal IPs of a node
+func nodeNoProxy(node *corev1.Node) []string {
+	entries := []string{}
+	if len(node.Spec.PodCIDRs) > 0 {
+		entries = append(entries, node.Spec.PodCIDRs...)
+	} else if node.Spec.PodCIDR != "" {
+		entries = append(entries, node.Spec.PodCIDR)
+	}
+	for _, address := range node.Status.Addresses {
+		if address.Type == corev1.NodeInternalIP {
+			entries = append(entries, address.Address)
+		}
+	}
+	return entries
+}
+
+// nodeNoProxyChanged only lets through the node events that may change the discovered
+// NO_PROXY entries, leaving out the frequent status updates nodes go through
+var nodeNoProxyChanged = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldNode, ok := e.ObjectOld.(*corev1.Node)
+		if !ok {
+			return true
+		}
+		newNode, ok := e.ObjectNew.(*corev1.Node)
+		if !ok {
+			return true
+		}
+		return !equality.Semantic.DeepEqual(nodeNoProxy(oldNode), nodeNoProxy(newNode))
+	},
+}
+
+// onlyNoProxyChanged reports whether the existing ConfigMap would be left as desired by
+// just updating NO_PROXY, which is what happens when the discovered cluster networking
+// changes. What derives from it is in the variants ConfigMap, which is updated on its own.
+func onlyNoProxyChanged(existing, desired *corev1.ConfigMap) bool {
+	withExistingNoProxy := desired.DeepCopy()
+	for _, key := range []string{"NO_PROXY", "no_proxy"} {
+		if value, ok := existing.Data[key]; ok {
+			withExistingNoProxy.Data[key] = value
+		} else {
+			delete(withExistingNoProxy.Data, key)
+		}
+	}
+	return !configMapNeedsUpdate(existing, withExistingNoProxy)
+}
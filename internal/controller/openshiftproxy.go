@@ -0,0 +1,153 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/igordcard/proxius/api/v1alpha1"
+)
+
+// openShiftProxyGVK is the kind OpenShift configures the cluster-wide proxy with. It is only
+// ever read as unstructured, so that Proxius does not depend on the OpenShift API.
+var openShiftProxyGVK = schema.GroupVersionKind{Group: "config.openshift.io", Version: "v1", Kind: "Proxy"}
+
+// openShiftProxyError reports a Proxy that cannot be mirrored
+type openShiftProxyError struct {
+	reason  string
+	message string
+}
+
+func (e *openShiftProxyError) Error() string {
+	return e.message
+}
+
+// openShiftProxy is the cluster-wide proxy read from a Proxy
+type openShiftProxy struct {
+	// httpProxy and httpsProxy are the proxy URLs, without the credentials embedded into them
+	httpProxy  string
+	httpsProxy string
+	// noProxy is the effective NO_PROXY published in the status of the Proxy,
+	// or the one of its spec until the cluster has published it
+	noProxy []string
+	// trustedCA references the bundle of the Proxy, if any
+	trustedCA *v1alpha1.TrustedCA
+	// credentials are the ones embedded into the proxy URLs, if any
+	credentials *proxyCredentials
+}
+
+// loadOpenShiftProxy reads the Proxy referenced by an OpenShiftProxySource, returning nil
+// when there is none. The returned error is an *openShiftProxyError when the Proxy is
+// missing, not served by the cluster, or embeds different credentials into its proxies.
+func loadOpenShiftProxy(ctx context.Context, c client.Reader, source *v1alpha1.OpenShiftProxySource) (*openShiftProxy, error) {
+	if source == nil {
+		return nil, nil
+	}
+	name := source.NameOrDefault()
+	object := &unstructured.Unstructured{}
+	object.SetGroupVersionKind(openShiftProxyGVK)
+	if err := c.Get(ctx, client.ObjectKey{Name: name}, object); err != nil {
+		switch {
+		case apierrors.IsNotFound(err):
+			return nil, &openShiftProxyError{reason: "OpenShiftProxyNotFound", message: fmt.Sprintf("Proxy %s not found", name)}
+		case meta.IsNoMatchError(err):
+			return nil, &openShiftProxyError{reason: "OpenShiftProxyNotFound", message: fmt.Sprintf("%s is not served by the cluster", openShiftProxyGVK.GroupVersion().WithResource("proxies").GroupResource())}
+		}
+		return nil, err
+	}
+
+	field := func(fields ...string) string {
+		value, _, _ := unstructured.NestedString(object.Object, fields...)
+		return strings.TrimSpace(value)
+	}
+	proxy := &openShiftProxy{}
+	noProxy := field("status", "noProxy")
+	if noProxy == "" {
+		noProxy = field("spec", "noProxy")
+	}
+	proxy.noProxy = v1alpha1.SplitList(noProxy)
+	if trustedCA := field("spec", "trustedCA", "name"); trustedCA != "" {
+		proxy.trustedCA = &v1alpha1.TrustedCA{ConfigMapRef: &v1alpha1.CABundleReference{
+			Name:      trustedCA,
+			Namespace: v1alpha1.OpenShiftConfigNamespace,
+		}}
+	}
+
+	// OpenShift lets credentials be embedded into the proxy URLs, which must not end up in
+	// the generated ConfigMap. A single set of credentials is embedded into both proxies.
+	var userinfo *url.Userinfo
+	for _, proxyURL := range []struct {
+		field  string
+		target *string
+	}{{"httpProxy", &proxy.httpProxy}, {"httpsProxy", &proxy.httpsProxy}} {
+		value := field("spec", proxyURL.field)
+		if value == "" {
+			continue
+		}
+		u, err := url.Parse(value)
+		if err != nil || u.Host == "" {
+			return nil, &openShiftProxyError{reason: "OpenShiftProxyInvalid", message: fmt.Sprintf("Proxy %s has an invalid %s", name, proxyURL.field)}
+		}
+		if u.User != nil {
+			if userinfo != nil && userinfo.String() != u.User.String() {
+				return nil, &openShiftProxyError{reason: "OpenShiftProxyInvalid", message: fmt.Sprintf("Proxy %s embeds different credentials into its proxies", name)}
+			}
+			userinfo = u.User
+			u.User = nil
+		}
+		*proxyURL.target = u.String()
+	}
+	if userinfo != nil {
+		proxy.credentials = &proxyCredentials{
+			userinfo: userinfo,
+			revision: fmt.Sprintf("%s/%d", object.GetUID(), object.GetGeneration()),
+		}
+	}
+	return proxy, nil
+}
+
+// mirror returns the spec with the proxies and bypass list of the cluster-wide proxy
+func (p *openShiftProxy) mirror(spec *v1alpha1.ProxyDefSpec) *v1alpha1.ProxyDefSpec {
+	effective := spec.DeepCopy()
+	effective.HTTPProxy = p.httpProxy
+	effective.HTTPSProxy = p.httpsProxy
+	effective.NoProxy = strings.Join(append(v1alpha1.SplitList(spec.NoProxy), p.noProxy...), ",")
+	return effective
+}
+
+// openShiftProxyServed reports whether the cluster serves the Proxy kind, which
+// can only be watched then
+func openShiftProxyServed(mapper meta.RESTMapper) bool {
+	_, err := mapper.RESTMapping(openShiftProxyGVK.GroupKind(), openShiftProxyGVK.Version)
+	return err == nil
+}
+
+// newOpenShiftProxyObject returns an empty Proxy to watch
+func newOpenShiftProxyObject() client.Object {
+	object := &unstructured.Unstructured{}
+	object.SetGroupVersionKind(openShiftProxyGVK)
+	return object
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/igordcard/proxius/api/v1alpha1"
+)
+
+// PACFile renders the proxies of a spec as a proxy auto-config file bypassing them for NO_PROXY,
+// which is the one rendered in the cidr format, discovered entries included
+func PACFile(spec *v1alpha1.ProxyDefSpec, noProxy string) string {
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("  host = host.toLowerCase();\n")
+	if conditions := pacDirectConditions(v1alpha1.SplitList(noProxy)); len(conditions) > 0 {
+		fmt.Fprintf(&b, "  if (%s) {\n    return \"DIRECT\";\n  }\n", strings.Join(conditions, " ||\n      "))
+	}
+	for _, proxy := range []struct{ scheme, value string }{{"https", spec.HTTPSProxy}, {"http", spec.HTTPProxy}, {"ftp", spec.FTPProxy}} {
+		if directive := pacProxy(spec, proxy.value); directive != "" {
+			fmt.Fprintf(&b, "  if (url.substring(0, %d) == \"%s:\") {\n    return \"%s\";\n  }\n", len(proxy.scheme)+1, proxy.scheme, directive)
+		}
+	}
+	// ALL_PROXY and SOCKS_PROXY apply to every other scheme, e.g. ws: and wss:
+	fallback := "DIRECT"
+	for _, value := range []string{spec.AllProxy, spec.SocksProxyURL()} {
+		if directive := pacProxy(spec, value); directive != "" {
+			fallback = directive
+			break
+		}
+	}
+	fmt.Fprintf(&b, "  return \"%s\";\n}\n", fallback)
+	return b.String()
+}
+
+// pacDirectConditions translates NO_PROXY entries into PAC expressions, ignoring their ports
+func pacDirectConditions(entries []string) []string {
+	conditions := []string{}
+	for _, entry := range entries {
+		entry = strings.ToLower(entry)
+		switch {
+		case entry == "*":
+			return []string{"true"}
+		case strings.Contains(entry, "/"):
+			_, network, err := net.ParseCIDR(entry)
+			// isInNet only understands IPv4, and resolves hosts names, so it is
+			// only given IPv4 addresses to avoid a DNS lookup for every request
+			if err != nil || network.IP.To4() == nil {
+				continue
+			}
+			conditions = append(conditions, fmt.Sprintf("(/^[0-9.]+$/.test(host) && isInNet(host, \"%s\", \"%s\"))", network.IP, net.IP(network.Mask)))
+		default:
+			host := entry
+			if h, _, err := net.SplitHostPort(entry); err == nil {
+				host = h
+			}
+			host = strings.TrimPrefix(host, "*")
+			switch {
+			case strings.HasPrefix(host, "."):
+				conditions = append(conditions, fmt.Sprintf("dnsDomainIs(host, %q)", host))
+			case net.ParseIP(strings.Trim(host, "[]")) != nil:
+				conditions = append(conditions, fmt.Sprintf("host == %q", strings.Trim(host, "[]")))
+			case host != "":
+				// Like curl, a domain also matches its subdomains
+				conditions = append(conditions, fmt.Sprintf("host == %q || dnsDomainIs(host, %q)", host, "."+host))
+			}
+		}
+	}
+	return conditions
+}
+
+// pacProxy returns the PAC directive for a proxy URL, e.g. "PROXY proxy.example.com:3128",
+// or nothing when the URL cannot be used
+func pacProxy(spec *v1alpha1.ProxyDefSpec, value string) string {
+	host, port, ok := javaProxyHostPort(spec, value)
+	if !ok {
+		return ""
+	}
+	scheme := spec.ProxyProtocol
+	if u, err := url.Parse(value); err == nil && strings.Contains(value, "://") {
+		scheme = strings.ToLower(u.Scheme)
+		// SOCKS proxies listen on 1080 unless told otherwise
+		if strings.HasPrefix(scheme, "socks") && u.Port() == "" {
+			port = 1080
+		}
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	switch scheme {
+	case "https":
+		return "HTTPS " + address
+	case "socks5", "socks5h":
+		return "SOCKS5 " + address
+	case "socks4", "socks4a":
+		return "SOCKS4 " + address
+	case "socks":
+		return "SOCKS " + address
+	default:
+		return "PROXY " + address
+	}
+}
+
+// pacURL returns the URL a proxy auto-config file is served at by the manager,
+// or nothing when autoDetect is not set or the manager was given no base URL
+func pacURL(spec *v1alpha1.ProxyDefSpec, baseURL, path string) string {
+	if !spec.AutoDetect || baseURL == "" {
+		return ""
+	}
+	return strings.TrimSuffix(baseURL, "/") + path
+}
@@ -0,0 +1,492 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dop251/goja"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/igordcard/proxius/api/v1alpha1"
+)
+
+const (
+	// pacSourceRefreshInterval is how often PAC files are downloaded again from their URL
+	pacSourceRefreshInterval = 10 * time.Minute
+	// pacSourceMaxSize bounds the size of the PAC files evaluated
+	pacSourceMaxSize = 256 << 10
+	// pacEvaluationTimeout bounds the whole evaluation of a PAC file
+	pacEvaluationTimeout = 3 * time.Second
+	// pacMaxProbes bounds the number of hosts the PAC file is evaluated for
+	pacMaxProbes = 256
+	// pacProbeHost is the host the default proxies are derived from, and the label
+	// prepended to the domains found in the PAC file to make up hosts matching them
+	pacProbeHost = "proxius-probe"
+)
+
+// pacSharedAddressSpace is the carrier-grade NAT range, often used for Pod and Service networks
+var pacSharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// pacSourceError reports a PAC source that cannot be used
+type pacSourceError struct {
+	reason  string
+	message string
+}
+
+func (e *pacSourceError) Error() string {
+	return e.message
+}
+
+// withPACSource returns the spec with the proxies and NO_PROXY derived from its PAC source, if any.
+// The returned error is a *pacSourceError when the PAC file is missing, forbidden or invalid.
+func withPACSource(ctx context.Context, c client.Reader, namespace string, allowedHosts []string, spec *v1alpha1.ProxyDefSpec) (*v1alpha1.ProxyDefSpec, error) {
+	if spec.PACSource == nil {
+		return spec, nil
+	}
+	script, err := loadPACSource(ctx, c, namespace, allowedHosts, spec.PACSource)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := evaluatePAC(script)
+	if err != nil {
+		return nil, err
+	}
+
+	effective := spec.DeepCopy()
+	effective.HTTPProxy = rules.httpProxy
+	effective.HTTPSProxy = rules.httpsProxy
+	effective.NoProxy = strings.Join(append(v1alpha1.SplitList(spec.NoProxy), rules.noProxy...), ",")
+	return effective, nil
+}
+
+// loadPACSource reads the PAC file of a PAC source
+func loadPACSource(ctx context.Context, c client.Reader, namespace string, allowedHosts []string, source *v1alpha1.PACSource) (string, error) {
+	switch {
+	case source.ConfigMapRef != nil:
+		configMap := &corev1.ConfigMap{}
+		if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: source.ConfigMapRef.Name}, configMap); err != nil {
+			if apierrors.IsNotFound(err) {
+				return "", &pacSourceError{reason: "PACSourceNotFound", message: fmt.Sprintf("PAC ConfigMap %s/%s not found", namespace, source.ConfigMapRef.Name)}
+			}
+			return "", err
+		}
+		script, ok := configMap.Data[source.ConfigMapRef.KeyOrDefault()]
+		if !ok {
+			return "", &pacSourceError{reason: "PACSourceNotFound", message: fmt.Sprintf("PAC ConfigMap %s/%s has no %q key", namespace, source.ConfigMapRef.Name, source.ConfigMapRef.KeyOrDefault())}
+		}
+		return script, nil
+	case source.URL != "":
+		return downloadPAC(ctx, source.URL, allowedHosts)
+	default:
+		return source.Inline, nil
+	}
+}
+
+// downloadPAC downloads a PAC file over https, from one of the allowed hosts when some are
+func downloadPAC(ctx context.Context, rawURL string, allowedHosts []string) (string, error) {
+	if err := checkPACURL(rawURL, allowedHosts); err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{
+		Transport: newPACTransport(allowedHosts),
+		Timeout:   10 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after %d redirects", len(via))
+			}
+			return checkPACURL(req.URL.String(), allowedHosts)
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("downloading %s: %s", rawURL, resp.Status)
+	}
+	script, err := io.ReadAll(io.LimitReader(resp.Body, pacSourceMaxSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(script) > pacSourceMaxSize {
+		return "", &pacSourceError{reason: "PACSourceInvalid", message: fmt.Sprintf("PAC file at %s is larger than %d bytes", rawURL, pacSourceMaxSize)}
+	}
+	return string(script), nil
+}
+
+// newPACTransport returns a transport refusing private addresses to all but the allowed hosts
+func newPACTransport(allowedHosts []string) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+			allowPrivate := pacHostAllowed(host, allowedHosts)
+			dialer := &net.Dialer{
+				Timeout: 5 * time.Second,
+				Control: func(_, address string, _ syscall.RawConn) error {
+					return checkPACAddress(address, allowPrivate)
+				},
+			}
+			return dialer.DialContext(ctx, network, address)
+		},
+		TLSHandshakeTimeout: 5 * time.Second,
+		ForceAttemptHTTP2:   true,
+	}
+}
+
+// checkPACURL reports a URL that is not https, or whose host is not allowed
+func checkPACURL(rawURL string, allowedHosts []string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return &pacSourceError{reason: "PACSourceInvalid", message: fmt.Sprintf("PAC URL %s is invalid", rawURL)}
+	}
+	if u.Scheme != "https" {
+		return &pacSourceError{reason: "PACSourceForbidden", message: fmt.Sprintf("PAC file at %s is not served over https", rawURL)}
+	}
+	if len(allowedHosts) == 0 || pacHostAllowed(u.Hostname(), allowedHosts) {
+		return nil
+	}
+	return &pacSourceError{reason: "PACSourceForbidden", message: fmt.Sprintf("PAC files are not downloaded from %s, which the manager does not allow", u.Hostname())}
+}
+
+// pacHostAllowed reports whether a host is one of the allowed ones
+func pacHostAllowed(host string, allowedHosts []string) bool {
+	for _, allowed := range allowedHosts {
+		if strings.EqualFold(host, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPACAddress refuses the resolved addresses that are not global unicast, or private ones unless allowed
+func checkPACAddress(address string, allowPrivate bool) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsGlobalUnicast() || !allowPrivate && (ip.IsPrivate() || pacSharedAddressSpace.Contains(ip)) {
+		return &pacSourceError{reason: "PACSourceForbidden", message: fmt.Sprintf("PAC files are not downloaded from %s", host)}
+	}
+	return nil
+}
+
+// requeueForPACSource schedules the next download of a PAC file served from a URL
+func requeueForPACSource(spec *v1alpha1.ProxyDefSpec, result ctrl.Result) ctrl.Result {
+	if spec.PACSource == nil || spec.PACSource.URL == "" || (result.Requeue && result.RequeueAfter == 0) {
+		return result
+	}
+	if result.RequeueAfter == 0 || result.RequeueAfter > pacSourceRefreshInterval {
+		result.RequeueAfter = pacSourceRefreshInterval
+	}
+	return result
+}
+
+// pacRules are the proxies and bypass list derived from a PAC file
+type pacRules struct {
+	httpProxy  string
+	httpsProxy string
+	noProxy    []string
+}
+
+// pacCandidate is a NO_PROXY entry the PAC file may send DIRECT, and a host matching it
+type pacCandidate struct {
+	entry string
+	probe string
+}
+
+// evaluatePAC derives proxies from what FindProxyForURL returns for an unknown host, and
+// NO_PROXY from the domains, hosts and networks it compares hosts against and sends DIRECT
+func evaluatePAC(script string) (*pacRules, error) {
+	if len(script) > pacSourceMaxSize {
+		return nil, &pacSourceError{reason: "PACSourceInvalid", message: fmt.Sprintf("PAC file is larger than %d bytes", pacSourceMaxSize)}
+	}
+	evaluator := newPACEvaluator()
+	// Once interrupted, every later run fails too, so the timeout covers the whole evaluation
+	timer := time.AfterFunc(pacEvaluationTimeout, func() {
+		evaluator.vm.Interrupt("timed out")
+	})
+	defer timer.Stop()
+	if _, err := evaluator.vm.RunString(script); err != nil {
+		return nil, &pacSourceError{reason: "PACSourceInvalid", message: fmt.Sprintf("Failed to evaluate PAC file: %v", err)}
+	}
+	findProxy, ok := goja.AssertFunction(evaluator.vm.Get("FindProxyForURL"))
+	if !ok {
+		return nil, &pacSourceError{reason: "PACSourceInvalid", message: "PAC file does not define FindProxyForURL"}
+	}
+	evaluator.findProxy = findProxy
+
+	host := pacProbeHost + ".invalid"
+	rules := &pacRules{}
+	var err error
+	if rules.httpProxy, err = evaluator.proxyFor("http", host); err != nil {
+		return nil, err
+	}
+	if rules.httpsProxy, err = evaluator.proxyFor("https", host); err != nil {
+		return nil, err
+	}
+	if rules.httpProxy == "" && rules.httpsProxy == "" {
+		return rules, nil
+	}
+
+	// Evaluating the candidates may find further ones, which are appended as they are found
+	for i := 0; i < len(evaluator.candidates) && i < pacMaxProbes; i++ {
+		candidate := evaluator.candidates[i]
+		direct := true
+		for _, scheme := range []string{"http", "https"} {
+			proxy, err := evaluator.proxyFor(scheme, candidate.probe)
+			if err != nil {
+				return nil, err
+			}
+			direct = direct && proxy == ""
+		}
+		if direct {
+			rules.noProxy = append(rules.noProxy, candidate.entry)
+		}
+	}
+	return rules, nil
+}
+
+// pacEvaluator runs a PAC file in a JavaScript interpreter offering the standard PAC
+// functions, none of which resolves names, and records the candidate NO_PROXY entries
+type pacEvaluator struct {
+	vm         *goja.Runtime
+	findProxy  goja.Callable
+	host       string
+	candidates []pacCandidate
+	seen       map[string]bool
+}
+
+func newPACEvaluator() *pacEvaluator {
+	e := &pacEvaluator{vm: goja.New(), seen: map[string]bool{}}
+	functions := map[string]func(goja.FunctionCall) goja.Value{
+		"isPlainHostName": func(call goja.FunctionCall) goja.Value {
+			return e.vm.ToValue(!strings.Contains(call.Argument(0).String(), "."))
+		},
+		"dnsDomainIs": func(call goja.FunctionCall) goja.Value {
+			host, domain := call.Argument(0).String(), strings.ToLower(call.Argument(1).String())
+			if e.isHost(host) {
+				e.addDomain(domain)
+			}
+			return e.vm.ToValue(strings.HasSuffix(strings.ToLower(host), domain))
+		},
+		"localHostOrDomainIs": func(call goja.FunctionCall) goja.Value {
+			host, hostdom := strings.ToLower(call.Argument(0).String()), strings.ToLower(call.Argument(1).String())
+			if e.isHost(host) {
+				e.addCandidate(hostdom, hostdom)
+			}
+			return e.vm.ToValue(host == hostdom || (!strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+".")))
+		},
+		"shExpMatch": func(call goja.FunctionCall) goja.Value {
+			str, pattern := call.Argument(0).String(), call.Argument(1).String()
+			if e.isHost(str) {
+				e.addPattern(strings.ToLower(pattern))
+			}
+			return e.vm.ToValue(shExpMatch(str, pattern))
+		},
+		"isInNet": func(call goja.FunctionCall) goja.Value {
+			ip := net.ParseIP(call.Argument(0).String()).To4()
+			pattern := net.ParseIP(call.Argument(1).String()).To4()
+			mask := net.ParseIP(call.Argument(2).String()).To4()
+			if pattern == nil || mask == nil {
+				return e.vm.ToValue(false)
+			}
+			e.addNetwork(pattern, net.IPMask(mask))
+			return e.vm.ToValue(ip != nil && ip.Mask(net.IPMask(mask)).Equal(pattern.Mask(net.IPMask(mask))))
+		},
+		// Names are never resolved, so only addresses are resolvable
+		"isResolvable": func(call goja.FunctionCall) goja.Value {
+			return e.vm.ToValue(net.ParseIP(call.Argument(0).String()) != nil)
+		},
+		"dnsResolve": func(call goja.FunctionCall) goja.Value {
+			if ip := net.ParseIP(call.Argument(0).String()); ip != nil {
+				return e.vm.ToValue(ip.String())
+			}
+			return goja.Null()
+		},
+		"myIpAddress": func(goja.FunctionCall) goja.Value {
+			return e.vm.ToValue("127.0.0.1")
+		},
+		"convert_addr": func(call goja.FunctionCall) goja.Value {
+			if ip := net.ParseIP(call.Argument(0).String()).To4(); ip != nil {
+				return e.vm.ToValue(binary.BigEndian.Uint32(ip))
+			}
+			return e.vm.ToValue(0)
+		},
+		"dnsDomainLevels": func(call goja.FunctionCall) goja.Value {
+			return e.vm.ToValue(strings.Count(call.Argument(0).String(), "."))
+		},
+		// The rendered configuration must not depend on when it was rendered,
+		// so rules restricted to some days or times never apply
+		"weekdayRange": func(goja.FunctionCall) goja.Value {
+			return e.vm.ToValue(false)
+		},
+		"dateRange": func(goja.FunctionCall) goja.Value {
+			return e.vm.ToValue(false)
+		},
+		"timeRange": func(goja.FunctionCall) goja.Value {
+			return e.vm.ToValue(false)
+		},
+		"alert": func(goja.FunctionCall) goja.Value {
+			return goja.Undefined()
+		},
+	}
+	for name, function := range functions {
+		// Setting a function on a fresh runtime cannot fail
+		_ = e.vm.Set(name, function)
+	}
+	return e
+}
+
+// proxyFor returns the proxy FindProxyForURL chooses for a host, or nothing for DIRECT
+func (e *pacEvaluator) proxyFor(scheme, host string) (string, error) {
+	e.host = host
+	result, err := e.findProxy(goja.Undefined(), e.vm.ToValue(scheme+"://"+host+"/"), e.vm.ToValue(host))
+	if err != nil {
+		return "", &pacSourceError{reason: "PACSourceInvalid", message: fmt.Sprintf("Failed to evaluate FindProxyForURL for %s: %v", host, err)}
+	}
+	proxy, err := pacDirectiveURL(result.String())
+	if err != nil {
+		return "", &pacSourceError{reason: "PACSourceInvalid", message: fmt.Sprintf("FindProxyForURL returned %q for %s: %v", result.String(), host, err)}
+	}
+	return proxy, nil
+}
+
+// isHost reports whether a value is the host being evaluated, as opposed to e.g. the URL
+func (e *pacEvaluator) isHost(value string) bool {
+	return strings.EqualFold(value, e.host)
+}
+
+// addCandidate records a candidate NO_PROXY entry, unless it was already found
+func (e *pacEvaluator) addCandidate(entry, probe string) {
+	if entry == "" || e.seen[entry] {
+		return
+	}
+	e.seen[entry] = true
+	e.candidates = append(e.candidates, pacCandidate{entry: entry, probe: probe})
+}
+
+// addDomain records a domain compared with dnsDomainIs
+func (e *pacEvaluator) addDomain(domain string) {
+	if strings.HasPrefix(domain, ".") {
+		e.addCandidate(domain, pacProbeHost+domain)
+	} else if domain != "" {
+		e.addCandidate(domain, pacProbeHost+"."+domain)
+	}
+}
+
+// pacOctetWildcard matches shell expressions such as "10.*" or "192.168.*"
+var pacOctetWildcard = regexp.MustCompile(`^(\d{1,3}\.){1,3}\*$`)
+
+// addPattern records a shell expression compared with shExpMatch, when NO_PROXY can express it
+func (e *pacEvaluator) addPattern(pattern string) {
+	switch {
+	case !strings.ContainsAny(pattern, "*?"):
+		e.addCandidate(pattern, pattern)
+	case strings.HasPrefix(pattern, "*.") && !strings.ContainsAny(pattern[2:], "*?"):
+		e.addDomain(pattern[1:])
+	case pacOctetWildcard.MatchString(pattern):
+		octets := strings.Split(strings.TrimSuffix(pattern, ".*"), ".")
+		ip := make(net.IP, net.IPv4len)
+		for i, octet := range octets {
+			var value int
+			if _, err := fmt.Sscanf(octet, "%d", &value); err != nil || value > 255 {
+				return
+			}
+			ip[i] = byte(value)
+		}
+		e.addNetwork(ip, net.CIDRMask(8*len(octets), 32))
+	}
+}
+
+// addNetwork records a network compared with isInNet
+func (e *pacEvaluator) addNetwork(ip net.IP, mask net.IPMask) {
+	ones, bits := mask.Size()
+	// Non-contiguous masks cannot be told as a CIDR
+	if bits == 0 {
+		return
+	}
+	network := ip.Mask(mask)
+	e.addCandidate(fmt.Sprintf("%s/%d", network, ones), network.String())
+}
+
+// shExpMatch matches a string against a shell expression of "*" and "?" wildcards
+func shExpMatch(str, pattern string) bool {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String()).MatchString(str)
+}
+
+// pacDirectiveURL translates the first directive returned by FindProxyForURL into a proxy URL
+func pacDirectiveURL(result string) (string, error) {
+	directive := strings.Fields(strings.SplitN(result, ";", 2)[0])
+	if len(directive) == 0 {
+		return "", nil
+	}
+	keyword := strings.ToUpper(directive[0])
+	if keyword == "DIRECT" {
+		return "", nil
+	}
+	if len(directive) != 2 {
+		return "", fmt.Errorf("expected a single host:port after %s", keyword)
+	}
+	switch keyword {
+	case "PROXY", "HTTP":
+		return "http://" + directive[1], nil
+	case "HTTPS":
+		return "https://" + directive[1], nil
+	case "SOCKS", "SOCKS5":
+		return "socks5://" + directive[1], nil
+	case "SOCKS4":
+		return "socks4://" + directive[1], nil
+	default:
+		return "", fmt.Errorf("unknown directive %s", keyword)
+	}
+}
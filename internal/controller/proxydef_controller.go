@@ -18,16 +18,24 @@ package controller
 
 import (
 	"context"
+	"errors"
+	"fmt"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	"github.com/igordcard/proxius/api/v1alpha1"
 	proxyv1alpha1 "github.com/igordcard/proxius/api/v1alpha1"
@@ -38,29 +46,52 @@ type ProxyDefReconciler struct {
 	client.Client
 	Scheme   *runtime.Scheme
 	Recorder record.EventRecorder
+	// PACBaseURL is the URL the manager serves proxy auto-config files under,
+	// published in the status of the ProxyDefs with autoDetect set
+	PACBaseURL string
+	// PACSourceHosts are the only hosts PAC sources may be downloaded from, when set,
+	// and may resolve to private addresses
+	PACSourceHosts []string
+	// APIReader reads the ConfigMaps and Secrets referenced by ProxyDefs straight from the
+	// API server, since the manager only caches the generated ones
+	APIReader client.Reader
 }
 
 //+kubebuilder:rbac:groups=proxy.igordc.com,resources=proxydefs,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=proxy.igordc.com,resources=proxydefs/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=proxy.igordc.com,resources=proxydefs/finalizers,verbs=update
 //+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=nodes;services,verbs=get;list;watch
+//+kubebuilder:rbac:groups=apps,resources=replicasets,verbs=get;list;watch
+//+kubebuilder:rbac:groups=apps,resources=deployments;statefulsets;daemonsets,verbs=get;list;watch;patch
+//+kubebuilder:rbac:groups=batch,resources=cronjobs,verbs=get;list;watch;patch
+//+kubebuilder:rbac:groups=config.openshift.io,resources=proxies,verbs=get;list;watch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
-// TODO(user): Modify the Reconcile function to compare the state specified by
-// the ProxyDef object against the actual cluster state, and then
-// perform operations to make the cluster state reflect the state specified by
-// the user.
+// On every pass the ConfigMap is rendered from the ProxyDef spec and created,
+// or updated whenever its data, labels, annotations or owner references drift.
+// Since the ConfigMap is owned and watched, out-of-band edits and deletions are
+// also reverted, and an Event is recorded on the ProxyDef each time that happens.
+// When the ProxyDef references credentials, the proxy URLs are rendered with them
+// into a Secret instead, which is kept up to date the same way.
+// A trusted CA bundle and tool configuration files are likewise rendered into ConfigMaps
+// of their own, which Pods mount.
+// A finalizer keeps a deleted ProxyDef around until its DeletionPolicy has decided
+// what becomes of the generated objects still referenced by Pods.
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.16.3/pkg/reconcile
-func (r *ProxyDefReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (r *ProxyDefReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
 	log := log.FromContext(ctx)
 
 	log.Info("ProxyDef resource request detected")
 
 	proxydef := &v1alpha1.ProxyDef{}
-	err := r.Get(ctx, req.NamespacedName, proxydef)
+	err = r.Get(ctx, req.NamespacedName, proxydef)
 	if err != nil {
 		if apierrors.IsNotFound(err) {
 			// If the custom resource is not found then, it usually means that it was deleted or not created
@@ -73,6 +104,14 @@ func (r *ProxyDefReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		return ctrl.Result{}, err
 	}
 
+	// A ProxyDef being deleted is only let go once its DeletionPolicy has been applied
+	if !proxydef.DeletionTimestamp.IsZero() {
+		return r.finalizeProxyDef(ctx, proxydef)
+	}
+	defer func() {
+		result = requeueForReferences(&proxydef.Spec, result)
+	}()
+
 	// Let's just set the status as Unknown when no status are available
 	if proxydef.Status.Conditions == nil || len(proxydef.Status.Conditions) == 0 {
 		meta.SetStatusCondition(&proxydef.Status.Conditions, metav1.Condition{Type: typeSyncingProxyDef, Status: metav1.ConditionUnknown, Reason: "Reconciling", Message: "Starting reconciliation"})
@@ -92,19 +131,199 @@ func (r *ProxyDefReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		}
 	}
 
+	// The finalizer lets the DeletionPolicy be applied before the generated objects are garbage collected
+	if controllerutil.AddFinalizer(proxydef, proxyDefFinalizer) {
+		if err := r.Update(ctx, proxydef); err != nil {
+			log.Error(err, "Failed to add the finalizer to the ProxyDef")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// A spec that cannot be rendered is reported without requeueing, since only
+	// a change to the ProxyDef can fix it
+	if errs := proxydef.Spec.Validate(field.NewPath("spec")); len(errs) > 0 {
+		log.Info("Invalid ProxyDef spec", "err", errs.ToAggregate())
+		return r.setDegradedCondition(ctx, proxydef, "InvalidSpec", errs.ToAggregate().Error(), nil)
+	}
+
+	// Credentials are only read from the namespace of the ProxyDef, so that
+	// a ProxyDef cannot be used to copy Secrets out of other namespaces
+	var credentials *proxyCredentials
+	if ref := proxydef.Spec.CredentialsSecretRef; ref != nil {
+		credentials, err = loadProxyCredentials(ctx, r.APIReader, proxydef.Namespace, ref.Name)
+		if err != nil {
+			var credErr *credentialsError
+			if errors.As(err, &credErr) {
+				log.Info("Unusable credentials Secret", "err", credErr)
+				return r.setDegradedCondition(ctx, proxydef, credErr.reason, credErr.message, nil)
+			}
+			log.Error(err, "Failed to get credentials Secret")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Likewise, a PAC file held in a ConfigMap is only read from the namespace of the ProxyDef
+	spec, err := withPACSource(ctx, r.APIReader, proxydef.Namespace, r.PACSourceHosts, &proxydef.Spec)
+	if err != nil {
+		var pacErr *pacSourceError
+		if errors.As(err, &pacErr) {
+			log.Info("Unusable PAC source", "err", pacErr)
+			return r.setDegradedCondition(ctx, proxydef, pacErr.reason, pacErr.message, nil)
+		}
+		log.Error(err, "Failed to load PAC file")
+		return r.setDegradedCondition(ctx, proxydef, "PACSourceUnavailable", fmt.Sprintf("Failed to load PAC file: %v", err), err)
+	}
+
+	// The cluster-wide proxy of OpenShift, on the other hand, is cluster-scoped
+	clusterProxy, err := loadOpenShiftProxy(ctx, r.Client, proxydef.Spec.OpenShiftProxy)
+	if err != nil {
+		var proxyErr *openShiftProxyError
+		if errors.As(err, &proxyErr) {
+			log.Info("Unusable OpenShift Proxy", "err", proxyErr)
+			return r.setDegradedCondition(ctx, proxydef, proxyErr.reason, proxyErr.message, nil)
+		}
+		log.Error(err, "Failed to get OpenShift Proxy")
+		return r.setDegradedCondition(ctx, proxydef, "OpenShiftProxyUnavailable", fmt.Sprintf("Failed to get OpenShift Proxy: %v", err), err)
+	}
+	trustedCARef, trustedCANamespace := proxydef.Spec.TrustedCA, proxydef.Namespace
+	if clusterProxy != nil {
+		spec = clusterProxy.mirror(spec)
+		if credentials == nil {
+			credentials = clusterProxy.credentials
+		}
+		// Its trusted CA bundle is kept by the cluster admins in the openshift-config namespace
+		if trustedCARef == nil && clusterProxy.trustedCA != nil {
+			trustedCARef, trustedCANamespace = clusterProxy.trustedCA, v1alpha1.OpenShiftConfigNamespace
+		}
+	}
+
+	// The trusted CA bundle is read from the namespace of the ProxyDef too, unless mirrored
+	// from the cluster-wide proxy
+	var trustedCA string
+	if trustedCARef != nil {
+		trustedCA, err = loadTrustedCA(ctx, r.APIReader, trustedCANamespace, trustedCARef)
+		if err != nil {
+			var caErr *trustedCAError
+			if errors.As(err, &caErr) {
+				log.Info("Unusable trusted CA bundle", "err", caErr)
+				return r.setDegradedCondition(ctx, proxydef, caErr.reason, caErr.message, nil)
+			}
+			log.Error(err, "Failed to get trusted CA bundle")
+			return ctrl.Result{}, err
+		}
+	}
+
+	var discovered []string
+	if proxydef.Spec.DiscoverNoProxy {
+		discovered, err = discoverNoProxy(ctx, r.Client, r.APIReader)
+		if err != nil {
+			log.Error(err, "Failed to discover the cluster networking")
+			return r.setDegradedCondition(ctx, proxydef, "NoProxyDiscoveryFailed", "Failed to discover the cluster networking", err)
+		}
+	}
+
+	configData, secretData, err := proxyConfigData(spec, discovered, credentials)
+	if err != nil {
+		log.Info("Invalid ProxyDef spec", "err", err)
+		return r.setDegradedCondition(ctx, proxydef, "InvalidSpec", err.Error(), nil)
+	}
+	variants := splitVariants(configData)
+
+	// Let's compute the ConfigMap that the current spec should produce so that
+	// any change to the ProxyDef is also propagated to an existing ConfigMap
+	desired, err := r.desiredConfigMap(proxydef, configData)
+	if err != nil {
+		log.Error(err, "Failed to compute desired ConfigMap")
+		return ctrl.Result{}, err
+	}
+
+	// If the ProxyDef was already Ready for this generation, any difference found
+	// below can only come from an out-of-band change to the generated objects
+	inSync := isInSync(proxydef)
+	hash := configHash(spec, credentials)
+	// A PAC file or cluster-wide proxy changing under the same generation is an update, not a drift
+	if inSync && hash != proxydef.Status.ConfigHash {
+		switch {
+		case proxydef.Spec.PACSource != nil:
+			r.Recorder.Event(proxydef, corev1.EventTypeNormal, "PACSourceUpdated", "The PAC file has changed and is being rendered again")
+			inSync = false
+		case proxydef.Spec.OpenShiftProxy != nil:
+			r.Recorder.Event(proxydef, corev1.EventTypeNormal, "OpenShiftProxyUpdated", "The cluster-wide proxy has changed and is being rendered again")
+			inSync = false
+		}
+	}
+
+	// The credential-embedded proxy URLs go to a Secret, which is reconciled first
+	// so that Pods injected once the ConfigMap is ready find it in place
+	if err := r.reconcileSecret(ctx, proxydef, secretData, inSync); err != nil {
+		log.Error(err, "Failed to reconcile Secret")
+		return r.setDegradedCondition(ctx, proxydef, "SecretSyncFailed", "Failed to reconcile Secret", err)
+	}
+	// Likewise for the ConfigMaps that Pods mount
+	if err := r.reconcileMountedConfigMap(ctx, proxydef, trustedCAConfigMapName(proxydef), trustedCAData(trustedCA), inSync); err != nil {
+		log.Error(err, "Failed to reconcile trusted CA ConfigMap")
+		return r.setDegradedCondition(ctx, proxydef, "TrustedCASyncFailed", "Failed to reconcile trusted CA ConfigMap", err)
+	}
+	if err := r.reconcileMountedConfigMap(ctx, proxydef, configFilesConfigMapName(proxydef), configFilesData(spec, discovered), inSync); err != nil {
+		log.Error(err, "Failed to reconcile config files ConfigMap")
+		return r.setDegradedCondition(ctx, proxydef, "ConfigFilesSyncFailed", "Failed to reconcile config files ConfigMap", err)
+	}
+	if err := r.reconcileMountedConfigMap(ctx, proxydef, variantsConfigMapName(proxydef), variants, inSync); err != nil {
+		log.Error(err, "Failed to reconcile variants ConfigMap")
+		return r.setDegradedCondition(ctx, proxydef, "VariantsSyncFailed", "Failed to reconcile variants ConfigMap", err)
+	}
+
+	result, err = r.syncConfigMap(ctx, proxydef, desired, hash, inSync, req)
+	if err != nil || !meta.IsStatusConditionTrue(proxydef.Status.Conditions, typeReadyProxyDef) {
+		return requeueForPACSource(spec, result), err
+	}
+
+	// Pod templates injected from an older generation are injected again by the workload webhook,
+	// and the ones not injected yet are injected as well when this generation was not rendered before
+	offered := map[string]bool{proxydef.Namespace: !inSync}
+	if err := syncWorkloadTemplates(ctx, r.Client, r.Recorder, proxydef, spec, []string{proxydef.Namespace}, offered, proxySourceID(proxydef), proxydef.Generation); err != nil {
+		return requeueForPACSource(spec, ctrl.Result{}), err
+	}
+
+	// Pods only read their environment when they start, so the workloads of Pods
+	// injected with an older configuration are restarted when the policy allows it
+	result, err = rolloutWorkloads(ctx, r.Client, r.Recorder, proxydef, proxydef.Spec.RolloutPolicy, []string{proxydef.Namespace}, proxySourceID(proxydef), hash)
+	return requeueForPACSource(spec, result), err
+}
+
+// syncConfigMap creates or updates the ConfigMap as needed and marks the ProxyDef as Ready once it is in line with the spec
+func (r *ProxyDefReconciler) syncConfigMap(ctx context.Context, proxydef *v1alpha1.ProxyDef, desired *corev1.ConfigMap, configHash string, inSync bool, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
 	// Check if ConfigMap already exists:
 	configMap := &corev1.ConfigMap{}
-	err = r.Get(ctx, client.ObjectKey{Namespace: proxydef.Namespace, Name: proxydef.Name + "-config"}, configMap)
+	err := getGenerated(ctx, r.Client, r.APIReader, client.ObjectKeyFromObject(desired), configMap)
 	if err != nil {
 		if apierrors.IsNotFound(err) {
 			// If the ConfigMap is not found, let's create it
-			return r.createConfigMap(ctx, proxydef, req)
+			if inSync {
+				r.Recorder.Eventf(proxydef, corev1.EventTypeWarning, "ConfigMapRecreated", "ConfigMap %s was deleted and has been recreated", desired.Name)
+			}
+			return r.createConfigMap(ctx, proxydef, desired, configHash, req)
 		}
 		// Error reading the object - requeue the request.
 		log.Error(err, "Failed to get ConfigMap")
 		return ctrl.Result{}, err
 	}
 
+	// If the ConfigMap has drifted from the spec, let's bring it back in line
+	if configMapNeedsUpdate(configMap, desired) {
+		switch {
+		case !inSync:
+		case proxydef.Spec.DiscoverNoProxy && onlyNoProxyChanged(configMap, desired):
+			// Nodes joining or leaving the cluster are not a drift of the ConfigMap
+			r.Recorder.Eventf(proxydef, corev1.EventTypeNormal, "NoProxyUpdated", "ConfigMap %s has been updated with the discovered cluster networking", desired.Name)
+		default:
+			r.Recorder.Eventf(proxydef, corev1.EventTypeWarning, "ConfigMapDriftCorrected", "ConfigMap %s was modified out of band and has been reverted", desired.Name)
+		}
+		return r.updateConfigMap(ctx, proxydef, configMap, desired, configHash, req)
+	}
+
 	// The following are a few possible return options for a Reconciler:
 	// With the error:
 	// 		return ctrl.Result{}, err
@@ -115,43 +334,283 @@ func (r *ProxyDefReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 	// Reconcile again after X time:
 	//  	return ctrl.Result{RequeueAfter: 5 * time.Minute}, nil
 
-	return ctrl.Result{}, nil
+	return r.setReadyCondition(ctx, proxydef, configMap.Name, configHash, "ConfigMapInSync", "ConfigMap is up to date", req)
 }
 
-func (r *ProxyDefReconciler) createConfigMap(ctx context.Context, proxydef *v1alpha1.ProxyDef, req ctrl.Request) (ctrl.Result, error) {
-	log := log.FromContext(ctx)
+// proxySourceID identifies a ProxyDef as in the injected-from annotation of the Pods it was injected into
+func proxySourceID(proxydef *v1alpha1.ProxyDef) string {
+	return proxydef.Namespace + "/" + proxydef.Name
+}
 
-	// Let's create a ConfigMap in the same namespace based on the contents of the ProxyDef
+// isInSync reports whether the ProxyDef was already reconciled successfully for its current generation
+func isInSync(proxydef *v1alpha1.ProxyDef) bool {
+	ready := meta.FindStatusCondition(proxydef.Status.Conditions, typeReadyProxyDef)
+	return ready != nil && ready.Status == metav1.ConditionTrue && ready.ObservedGeneration == proxydef.Generation
+}
+
+// configMapName returns the name of the ConfigMap generated for a ProxyDef
+func configMapName(proxydef *v1alpha1.ProxyDef) string {
+	return proxydef.Name + "-config"
+}
+
+// secretName returns the name of the Secret generated for a ProxyDef with credentials
+func secretName(proxydef *v1alpha1.ProxyDef) string {
+	return proxydef.Name + "-credentials"
+}
+
+// trustedCAConfigMapName returns the name of the ConfigMap generated for a ProxyDef with a trusted CA bundle
+func trustedCAConfigMapName(proxydef *v1alpha1.ProxyDef) string {
+	return proxydef.Name + "-trusted-ca"
+}
+
+// configFilesConfigMapName returns the name of the ConfigMap generated for a ProxyDef with tool configuration files
+func configFilesConfigMapName(proxydef *v1alpha1.ProxyDef) string {
+	return proxydef.Name + "-config-files"
+}
+
+// variantsConfigMapName returns the name of the ConfigMap generated for a ProxyDef with helper variables
+func variantsConfigMapName(proxydef *v1alpha1.ProxyDef) string {
+	return proxydef.Name + "-config-variants"
+}
+
+// proxyDefLabels returns the labels of the objects generated from a ProxyDef
+func proxyDefLabels(proxydef *v1alpha1.ProxyDef) map[string]string {
+	generated := map[string]string{}
+	for key, value := range proxydef.Labels {
+		generated[key] = value
+	}
+	generated[v1alpha1.GeneratedLabel] = "true"
+	return generated
+}
+
+// desiredConfigMap renders the ConfigMap that corresponds to the current ProxyDef spec
+func (r *ProxyDefReconciler) desiredConfigMap(proxydef *v1alpha1.ProxyDef, data map[string]string) (*corev1.ConfigMap, error) {
 	configMap := &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:        proxydef.Name + "-config",
+			Name:        configMapName(proxydef),
 			Namespace:   proxydef.Namespace,
-			Labels:      proxydef.Labels,
+			Labels:      proxyDefLabels(proxydef),
 			Annotations: proxydef.Annotations,
-			OwnerReferences: []metav1.OwnerReference{
-				*metav1.NewControllerRef(proxydef, proxyv1alpha1.GroupVersion.WithKind("ProxyDef")),
-			},
 		},
-		Data: map[string]string{
-			"HTTP_PROXY":  proxydef.Spec.HTTPProxy,
-			"http_proxy":  proxydef.Spec.HTTPProxy,
-			"HTTPS_PROXY": proxydef.Spec.HTTPSProxy,
-			"https_proxy": proxydef.Spec.HTTPSProxy,
-			"NO_PROXY":    proxydef.Spec.NoProxy,
-			"no_proxy":    proxydef.Spec.NoProxy,
+		Data: data,
+	}
+	if err := ctrl.SetControllerReference(proxydef, configMap, r.Scheme); err != nil {
+		return nil, err
+	}
+	return configMap, nil
+}
+
+// reconcileSecret creates or updates the Secret holding the credential-embedded proxy URLs,
+// or deletes it when the ProxyDef no longer has credentials.
+// When wasInSync is set, a deleted Secret is reported as recreated.
+func (r *ProxyDefReconciler) reconcileSecret(ctx context.Context, proxydef *v1alpha1.ProxyDef, data map[string][]byte, wasInSync bool) error {
+	log := log.FromContext(ctx)
+
+	secret := &corev1.Secret{}
+	err := getGenerated(ctx, r.Client, r.APIReader, client.ObjectKey{Namespace: proxydef.Namespace, Name: secretName(proxydef)}, secret)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	found := err == nil
+
+	if data == nil {
+		if !found || !metav1.IsControlledBy(secret, proxydef) {
+			return nil
+		}
+		if err := r.Delete(ctx, secret); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		log.Info("Secret deleted since the ProxyDef no longer has credentials")
+		return nil
+	}
+
+	desired := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        secretName(proxydef),
+			Namespace:   proxydef.Namespace,
+			Labels:      proxyDefLabels(proxydef),
+			Annotations: proxydef.Annotations,
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: data,
+	}
+	if err := ctrl.SetControllerReference(proxydef, desired, r.Scheme); err != nil {
+		return err
+	}
+
+	if !found {
+		if wasInSync {
+			r.Recorder.Eventf(proxydef, corev1.EventTypeWarning, "SecretRecreated", "Secret %s was deleted and has been recreated", desired.Name)
+		}
+		if err := r.Create(ctx, desired); err != nil {
+			return err
+		}
+		log.Info("Secret created successfully")
+		return nil
+	}
+
+	if !secretNeedsUpdate(secret, desired) {
+		return nil
+	}
+	// Unlike the ConfigMap, the Secret also changes when the referenced credentials
+	// are rotated, so an update is not necessarily a correction of drift
+	if wasInSync {
+		r.Recorder.Eventf(proxydef, corev1.EventTypeNormal, "SecretUpdated", "Secret %s has been updated to match the ProxyDef and its credentials", desired.Name)
+	}
+	secret.Type = desired.Type
+	secret.Data = desired.Data
+	secret.Labels = desired.Labels
+	secret.Annotations = desired.Annotations
+	secret.OwnerReferences = desired.OwnerReferences
+	if err := r.Update(ctx, secret); err != nil {
+		return err
+	}
+	log.Info("Secret updated successfully")
+	return nil
+}
+
+// reconcileMountedConfigMap creates or updates one of the ConfigMaps that Pods mount, such as
+// the one holding the trusted CA bundle, or deletes it when the ProxyDef no longer needs it.
+// When wasInSync is set, a deleted ConfigMap is reported as recreated.
+func (r *ProxyDefReconciler) reconcileMountedConfigMap(ctx context.Context, proxydef *v1alpha1.ProxyDef, name string, data map[string]string, wasInSync bool) error {
+	log := log.FromContext(ctx)
+
+	configMap := &corev1.ConfigMap{}
+	err := getGenerated(ctx, r.Client, r.APIReader, client.ObjectKey{Namespace: proxydef.Namespace, Name: name}, configMap)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	found := err == nil
+
+	if data == nil {
+		if !found || !metav1.IsControlledBy(configMap, proxydef) {
+			return nil
+		}
+		if err := r.Delete(ctx, configMap); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		log.Info("ConfigMap deleted since the ProxyDef no longer needs it", "name", name)
+		return nil
+	}
+
+	desired := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   proxydef.Namespace,
+			Labels:      proxyDefLabels(proxydef),
+			Annotations: proxydef.Annotations,
 		},
+		Data: data,
+	}
+	if err := ctrl.SetControllerReference(proxydef, desired, r.Scheme); err != nil {
+		return err
+	}
+
+	if !found {
+		if wasInSync {
+			r.Recorder.Eventf(proxydef, corev1.EventTypeWarning, "ConfigMapRecreated", "ConfigMap %s was deleted and has been recreated", desired.Name)
+		}
+		if err := r.Create(ctx, desired); err != nil {
+			return err
+		}
+		log.Info("ConfigMap created successfully", "name", name)
+		return nil
+	}
+
+	if !configMapNeedsUpdate(configMap, desired) {
+		return nil
+	}
+	// The data also changes with the objects and cluster networking it is rendered from,
+	// e.g. when the referenced CA is rotated, so an update is not necessarily a correction of drift
+	if wasInSync {
+		r.Recorder.Eventf(proxydef, corev1.EventTypeNormal, "ConfigMapUpdated", "ConfigMap %s has been updated to match the ProxyDef and the objects it is rendered from", desired.Name)
+	}
+	configMap.Data = desired.Data
+	configMap.Labels = desired.Labels
+	configMap.Annotations = desired.Annotations
+	configMap.OwnerReferences = desired.OwnerReferences
+	if err := r.Update(ctx, configMap); err != nil {
+		return err
 	}
+	log.Info("ConfigMap updated successfully", "name", name)
+	return nil
+}
+
+func (r *ProxyDefReconciler) createConfigMap(ctx context.Context, proxydef *v1alpha1.ProxyDef, configMap *corev1.ConfigMap, configHash string, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	// Let's create a ConfigMap in the same namespace based on the contents of the ProxyDef
 	if err := r.Create(ctx, configMap); err != nil {
 		log.Error(err, "Failed to create ConfigMap")
-		meta.SetStatusCondition(&proxydef.Status.Conditions, metav1.Condition{Type: typeDegradedProxyDef, Status: metav1.ConditionFalse, Reason: "ConfigMapCreationFailed", Message: "Failed to create ConfigMap"})
-		if err := r.Status().Update(ctx, proxydef); err != nil {
-			log.Error(err, "Failed to update proxydef status (to Degraded)")
-			return ctrl.Result{}, err
-		}
-		return ctrl.Result{}, err
+		return r.setDegradedCondition(ctx, proxydef, "ConfigMapCreationFailed", "Failed to create ConfigMap", err)
 	}
+
+	log.Info("ConfigMap created successfully")
+
 	// Let's set the status as Ready when the ConfigMap is created
-	meta.SetStatusCondition(&proxydef.Status.Conditions, metav1.Condition{Type: typeReadyProxyDef, Status: metav1.ConditionTrue, Reason: "ConfigMapCreated", Message: "ConfigMap created successfully"})
+	return r.setReadyCondition(ctx, proxydef, configMap.Name, configHash, "ConfigMapCreated", "ConfigMap created successfully", req)
+}
+
+func (r *ProxyDefReconciler) updateConfigMap(ctx context.Context, proxydef *v1alpha1.ProxyDef, existing, desired *corev1.ConfigMap, configHash string, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	// Let's signal that the ConfigMap is being brought in line with the spec
+	meta.SetStatusCondition(&proxydef.Status.Conditions, metav1.Condition{Type: typeSyncingProxyDef, Status: metav1.ConditionTrue, Reason: "ConfigMapUpdating", Message: "Updating ConfigMap to match the ProxyDef spec", ObservedGeneration: proxydef.Generation})
+	meta.SetStatusCondition(&proxydef.Status.Conditions, metav1.Condition{Type: typeReadyProxyDef, Status: metav1.ConditionFalse, Reason: "ConfigMapOutOfSync", Message: "ConfigMap does not match the ProxyDef spec", ObservedGeneration: proxydef.Generation})
+	if err := r.Status().Update(ctx, proxydef); err != nil {
+		log.Error(err, "Failed to update ProxyDef status (to Syncing)")
+		return ctrl.Result{}, err
+	}
+
+	// Only the fields owned by the controller are overwritten,
+	// everything else (e.g. resourceVersion) is kept from the live object
+	existing.Data = desired.Data
+	existing.Labels = desired.Labels
+	existing.Annotations = desired.Annotations
+	existing.OwnerReferences = desired.OwnerReferences
+	if err := r.Update(ctx, existing); err != nil {
+		log.Error(err, "Failed to update ConfigMap")
+		return r.setDegradedCondition(ctx, proxydef, "ConfigMapUpdateFailed", "Failed to update ConfigMap", err)
+	}
+
+	log.Info("ConfigMap updated successfully")
+
+	return r.setReadyCondition(ctx, proxydef, existing.Name, configHash, "ConfigMapUpdated", "ConfigMap updated successfully", req)
+}
+
+// setReadyCondition marks the ProxyDef as Ready and no longer Syncing or Degraded,
+// publishing the names of the generated ConfigMap and Secret along with the configuration hash,
+// and only writing the status
+// when something actually changed
+func (r *ProxyDefReconciler) setReadyCondition(ctx context.Context, proxydef *v1alpha1.ProxyDef, generatedName, configHash, reason, message string, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	previous := proxydef.Status.DeepCopy()
+	proxydef.Status.ConfigMapName = generatedName
+	proxydef.Status.ConfigHash = configHash
+	proxydef.Status.PACURL = pacURL(&proxydef.Spec, r.PACBaseURL, v1alpha1.ProxyDefPACPath(proxydef.Namespace, proxydef.Name))
+	proxydef.Status.SecretName = ""
+	if proxydef.Spec.CredentialsSecretRef != nil {
+		proxydef.Status.SecretName = secretName(proxydef)
+	}
+	proxydef.Status.TrustedCAConfigMapName = ""
+	if proxydef.Spec.TrustedCA != nil {
+		proxydef.Status.TrustedCAConfigMapName = trustedCAConfigMapName(proxydef)
+	}
+	proxydef.Status.ConfigFilesConfigMapName = ""
+	if len(proxydef.Spec.ConfigFiles) > 0 {
+		proxydef.Status.ConfigFilesConfigMapName = configFilesConfigMapName(proxydef)
+	}
+	proxydef.Status.VariantsConfigMapName = ""
+	if hasVariants(&proxydef.Spec) {
+		proxydef.Status.VariantsConfigMapName = variantsConfigMapName(proxydef)
+	}
+	meta.SetStatusCondition(&proxydef.Status.Conditions, metav1.Condition{Type: typeReadyProxyDef, Status: metav1.ConditionTrue, Reason: reason, Message: message, ObservedGeneration: proxydef.Generation})
+	meta.SetStatusCondition(&proxydef.Status.Conditions, metav1.Condition{Type: typeSyncingProxyDef, Status: metav1.ConditionFalse, Reason: reason, Message: message, ObservedGeneration: proxydef.Generation})
+	meta.SetStatusCondition(&proxydef.Status.Conditions, metav1.Condition{Type: typeDegradedProxyDef, Status: metav1.ConditionFalse, Reason: reason, Message: message, ObservedGeneration: proxydef.Generation})
+	if equality.Semantic.DeepEqual(previous, &proxydef.Status) {
+		return ctrl.Result{}, nil
+	}
 	if err := r.Status().Update(ctx, proxydef); err != nil {
 		log.Error(err, "Failed to update ProxyDef status (to Ready)")
 		return ctrl.Result{}, err
@@ -163,11 +622,23 @@ func (r *ProxyDefReconciler) createConfigMap(ctx context.Context, proxydef *v1al
 		return ctrl.Result{}, err
 	}
 
-	log.Info("ConfigMap created successfully")
-
 	return ctrl.Result{}, nil
 }
 
+// setDegradedCondition records a failure on the ProxyDef status and returns the original error
+// so that the request is requeued
+func (r *ProxyDefReconciler) setDegradedCondition(ctx context.Context, proxydef *v1alpha1.ProxyDef, reason, message string, cause error) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	meta.SetStatusCondition(&proxydef.Status.Conditions, metav1.Condition{Type: typeDegradedProxyDef, Status: metav1.ConditionTrue, Reason: reason, Message: message, ObservedGeneration: proxydef.Generation})
+	meta.SetStatusCondition(&proxydef.Status.Conditions, metav1.Condition{Type: typeReadyProxyDef, Status: metav1.ConditionFalse, Reason: reason, Message: message, ObservedGeneration: proxydef.Generation})
+	if err := r.Status().Update(ctx, proxydef); err != nil {
+		log.Error(err, "Failed to update ProxyDef status (to Degraded)")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, cause
+}
+
 // Definitions to manage status conditions
 const (
 	// typeReadyProxyDef represents that the ProxyDef has already generated the respective ConfigMap
@@ -178,9 +649,53 @@ const (
 	typeDegradedProxyDef = "Degraded"
 )
 
+// requestsForNode enqueues the ProxyDefs discovering the cluster networking,
+// since a node joining or leaving changes their NO_PROXY entries
+func (r *ProxyDefReconciler) requestsForNode(ctx context.Context, _ client.Object) []reconcile.Request {
+	proxydefs := &v1alpha1.ProxyDefList{}
+	if err := r.List(ctx, proxydefs); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list ProxyDefs")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, proxydef := range proxydefs.Items {
+		if proxydef.Spec.DiscoverNoProxy {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&proxydef)})
+		}
+	}
+	return requests
+}
+
+// requestsForOpenShiftProxy enqueues the ProxyDefs mirroring a Proxy whenever it changes
+func (r *ProxyDefReconciler) requestsForOpenShiftProxy(ctx context.Context, object client.Object) []reconcile.Request {
+	proxydefs := &v1alpha1.ProxyDefList{}
+	if err := r.List(ctx, proxydefs); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list ProxyDefs")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, proxydef := range proxydefs.Items {
+		if source := proxydef.Spec.OpenShiftProxy; source != nil && source.NameOrDefault() == object.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&proxydef)})
+		}
+	}
+	return requests
+}
+
 // SetupWithManager sets up the controller with the Manager.
+// Generated objects are owned by their ProxyDef, so any change to them
+// triggers a reconciliation of the owner. The objects referenced by the spec
+// are not watched, since that would take caching every ConfigMap and Secret
+// of the cluster, and are read again periodically instead.
 func (r *ProxyDefReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	b := ctrl.NewControllerManagedBy(mgr).
 		For(&proxyv1alpha1.ProxyDef{}).
-		Complete(r)
+		Owns(&corev1.ConfigMap{}).
+		Owns(&corev1.Secret{}).
+		Watches(&corev1.Node{}, handler.EnqueueRequestsFromMapFunc(r.requestsForNode), builder.WithPredicates(nodeNoProxyChanged))
+	// The Proxy of OpenShift can only be watched on clusters serving it
+	if openShiftProxyServed(mgr.GetRESTMapper()) {
+		b = b.Watches(newOpenShiftProxyObject(), handler.EnqueueRequestsFromMapFunc(r.requestsForOpenShiftProxy))
+	}
+	return b.Complete(r)
 }
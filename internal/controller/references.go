@@ -0,0 +1,41 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"time"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/igordcard/proxius/api/v1alpha1"
+)
+
+// referencesResyncInterval is how often the ConfigMaps and Secrets referenced by a spec are read again
+const referencesResyncInterval = 5 * time.Minute
+
+// requeueForReferences schedules the next read of the objects referenced by a spec, which are not watched
+func requeueForReferences(spec *v1alpha1.ProxyDefSpec, result ctrl.Result) ctrl.Result {
+	referenced := spec.CredentialsSecretRef != nil || spec.TrustedCA != nil || spec.OpenShiftProxy != nil ||
+		spec.PACSource != nil && spec.PACSource.ConfigMapRef != nil
+	if !referenced || (result.Requeue && result.RequeueAfter == 0) {
+		return result
+	}
+	if result.RequeueAfter == 0 || result.RequeueAfter > referencesResyncInterval {
+		result.RequeueAfter = referencesResyncInterval
+	}
+	return result
+}
@@ -0,0 +1,221 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/igordcard/proxius/api/v1alpha1"
+)
+
+// rolloutRequeueInterval is how often a rollout in progress is checked upon
+const rolloutRequeueInterval = 15 * time.Second
+
+// workload is a Deployment, StatefulSet or DaemonSet that can be restarted by a rollout
+type workload struct {
+	// key identifies the workload as <kind> <namespace>/<name>
+	key    string
+	object client.Object
+	// template points into object, so that changes to it are patched along with it
+	template *corev1.PodTemplateSpec
+	// rolledOut reports whether all the Pods of the workload match its current template
+	rolledOut bool
+}
+
+// rolloutWorkloads restarts the workloads of the Pods injected from sourceID with another
+// configuration than hash, a few at a time, by stamping hash onto their Pod templates
+func rolloutWorkloads(ctx context.Context, c client.Client, recorder record.EventRecorder, owner client.Object, policy *v1alpha1.RolloutPolicy, namespaces []string, sourceID, hash string) (ctrl.Result, error) {
+	if policy == nil || !policy.Enabled || hash == "" {
+		return ctrl.Result{}, nil
+	}
+	log := log.FromContext(ctx)
+
+	workloads, err := staleWorkloads(ctx, c, namespaces, sourceID, hash)
+	if err != nil {
+		log.Error(err, "Failed to find the workloads to roll out")
+		return ctrl.Result{}, err
+	}
+
+	inProgress := 0
+	pending := []*workload{}
+	for _, w := range workloads {
+		if w.template.Annotations[v1alpha1.ConfigHashAnnotation] == hash {
+			// Already restarted for this configuration, its old Pods are still being replaced
+			if !w.rolledOut {
+				inProgress++
+			}
+			continue
+		}
+		pending = append(pending, w)
+	}
+
+	for _, w := range pending {
+		if inProgress >= policy.MaxConcurrentRollouts() {
+			break
+		}
+		patch := client.MergeFrom(w.object.DeepCopyObject().(client.Object))
+		if w.template.Annotations == nil {
+			w.template.Annotations = map[string]string{}
+		}
+		w.template.Annotations[v1alpha1.ConfigHashAnnotation] = hash
+		if err := c.Patch(ctx, w.object, patch); err != nil {
+			log.Error(err, "Failed to restart workload", "workload", w.key)
+			return ctrl.Result{}, err
+		}
+		log.Info("Workload restarted to apply the new proxy configuration", "workload", w.key)
+		recorder.Eventf(owner, corev1.EventTypeNormal, "RolloutTriggered", "Restarting %s to apply the new proxy configuration", w.key)
+		inProgress++
+	}
+
+	if inProgress > 0 {
+		return ctrl.Result{RequeueAfter: rolloutRequeueInterval}, nil
+	}
+	return ctrl.Result{}, nil
+}
+
+// staleWorkloads returns the workloads of the Pods injected from sourceID with another configuration than hash
+func staleWorkloads(ctx context.Context, c client.Client, namespaces []string, sourceID, hash string) ([]*workload, error) {
+	seen := map[string]bool{}
+	workloads := []*workload{}
+	for _, namespace := range namespaces {
+		pods := &corev1.PodList{}
+		if err := c.List(ctx, pods, client.InNamespace(namespace)); err != nil {
+			return nil, err
+		}
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			if pod.DeletionTimestamp != nil || !strings.HasPrefix(pod.Annotations[v1alpha1.InjectedFromAnnotation], sourceID+"@") {
+				continue
+			}
+			// Pods injected before configuration hashes were recorded are left alone
+			podHash := pod.Annotations[v1alpha1.ConfigHashAnnotation]
+			if podHash == "" || podHash == hash {
+				continue
+			}
+			w, err := workloadOf(ctx, c, pod)
+			if err != nil {
+				return nil, err
+			}
+			if w == nil || seen[w.key] {
+				continue
+			}
+			seen[w.key] = true
+			workloads = append(workloads, w)
+		}
+	}
+	sort.Slice(workloads, func(i, j int) bool { return workloads[i].key < workloads[j].key })
+	return workloads, nil
+}
+
+// workloadOf returns the Deployment, StatefulSet or DaemonSet controlling a Pod, if any
+func workloadOf(ctx context.Context, c client.Client, pod *corev1.Pod) (*workload, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil || owner.APIVersion != appsv1.SchemeGroupVersion.String() {
+		return nil, nil
+	}
+	key := client.ObjectKey{Namespace: pod.Namespace, Name: owner.Name}
+
+	switch owner.Kind {
+	case "ReplicaSet":
+		replicaSet := &appsv1.ReplicaSet{}
+		if err := c.Get(ctx, key, replicaSet); err != nil {
+			return nil, client.IgnoreNotFound(err)
+		}
+		owner = metav1.GetControllerOf(replicaSet)
+		if owner == nil || owner.APIVersion != appsv1.SchemeGroupVersion.String() || owner.Kind != "Deployment" {
+			return nil, nil
+		}
+		deployment := &appsv1.Deployment{}
+		if err := c.Get(ctx, client.ObjectKey{Namespace: pod.Namespace, Name: owner.Name}, deployment); err != nil {
+			return nil, client.IgnoreNotFound(err)
+		}
+		return &workload{
+			key:       "Deployment " + pod.Namespace + "/" + deployment.Name,
+			object:    deployment,
+			template:  &deployment.Spec.Template,
+			rolledOut: deploymentRolledOut(deployment),
+		}, nil
+	case "StatefulSet":
+		statefulSet := &appsv1.StatefulSet{}
+		if err := c.Get(ctx, key, statefulSet); err != nil {
+			return nil, client.IgnoreNotFound(err)
+		}
+		return &workload{
+			key:       "StatefulSet " + pod.Namespace + "/" + statefulSet.Name,
+			object:    statefulSet,
+			template:  &statefulSet.Spec.Template,
+			rolledOut: statefulSetRolledOut(statefulSet),
+		}, nil
+	case "DaemonSet":
+		daemonSet := &appsv1.DaemonSet{}
+		if err := c.Get(ctx, key, daemonSet); err != nil {
+			return nil, client.IgnoreNotFound(err)
+		}
+		return &workload{
+			key:       "DaemonSet " + pod.Namespace + "/" + daemonSet.Name,
+			object:    daemonSet,
+			template:  &daemonSet.Spec.Template,
+			rolledOut: daemonSetRolledOut(daemonSet),
+		}, nil
+	}
+	return nil, nil
+}
+
+// deploymentRolledOut reports whether all the replicas of a Deployment are updated and available
+func deploymentRolledOut(deployment *appsv1.Deployment) bool {
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	status := deployment.Status
+	return status.ObservedGeneration >= deployment.Generation &&
+		status.UpdatedReplicas == replicas &&
+		status.Replicas == replicas &&
+		status.AvailableReplicas == replicas
+}
+
+// statefulSetRolledOut reports whether all the replicas of a StatefulSet are updated and ready
+func statefulSetRolledOut(statefulSet *appsv1.StatefulSet) bool {
+	replicas := int32(1)
+	if statefulSet.Spec.Replicas != nil {
+		replicas = *statefulSet.Spec.Replicas
+	}
+	status := statefulSet.Status
+	return status.ObservedGeneration >= statefulSet.Generation &&
+		status.UpdatedReplicas == replicas &&
+		status.ReadyReplicas == replicas &&
+		status.CurrentRevision == status.UpdateRevision
+}
+
+// daemonSetRolledOut reports whether the Pods of a DaemonSet are updated and available on every node
+func daemonSetRolledOut(daemonSet *appsv1.DaemonSet) bool {
+	status := daemonSet.Status
+	return status.ObservedGeneration >= daemonSet.Generation &&
+		status.UpdatedNumberScheduled == status.DesiredNumberScheduled &&
+		status.NumberAvailable == status.DesiredNumberScheduled
+}
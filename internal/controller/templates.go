@@ -0,0 +1,126 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/igordcard/proxius/api/v1alpha1"
+)
+
+// syncWorkloadTemplates stamps the current revision onto the workloads injected from an older one,
+// and onto the selected workloads not injected yet of the offered namespaces, for the workload
+// webhook to inject their Pod templates again. Jobs are left alone, as their templates are immutable.
+func syncWorkloadTemplates(ctx context.Context, c client.Client, recorder record.EventRecorder, owner client.Object, spec *v1alpha1.ProxyDefSpec, namespaces []string, offered map[string]bool, sourceID string, generation int64) error {
+	log := log.FromContext(ctx)
+	revision := fmt.Sprintf("%s@%d", sourceID, generation)
+
+	for _, namespace := range namespaces {
+		for _, kind := range []struct {
+			name string
+			list client.ObjectList
+		}{
+			{"Deployment", &appsv1.DeploymentList{}},
+			{"StatefulSet", &appsv1.StatefulSetList{}},
+			{"DaemonSet", &appsv1.DaemonSetList{}},
+			{"CronJob", &batchv1.CronJobList{}},
+		} {
+			if err := c.List(ctx, kind.list, client.InNamespace(namespace)); err != nil {
+				return err
+			}
+			err := meta.EachListItem(kind.list, func(item runtime.Object) error {
+				object := item.(client.Object)
+				injected := object.GetAnnotations()[v1alpha1.InjectedFromAnnotation]
+				switch {
+				case injected == "":
+					if !offered[namespace] || !templateSelected(spec, object) {
+						return nil
+					}
+				case !strings.HasPrefix(injected, sourceID+"@") || injected == revision:
+					return nil
+				}
+				key := kind.name + " " + namespace + "/" + object.GetName()
+				patch := client.MergeFrom(object.DeepCopyObject().(client.Object))
+				annotations := object.GetAnnotations()
+				if annotations == nil {
+					annotations = map[string]string{}
+				}
+				annotations[v1alpha1.InjectedFromAnnotation] = revision
+				object.SetAnnotations(annotations)
+				if err := c.Patch(ctx, object, patch); err != nil {
+					log.Error(err, "Failed to sync the Pod template of workload", "workload", key)
+					return err
+				}
+				log.Info("Pod template of workload synced with the current proxy configuration", "workload", key)
+				message := "Injecting the Pod template of %s again with the current proxy configuration"
+				if injected == "" {
+					message = "Injecting the Pod template of %s with the current proxy configuration"
+				}
+				recorder.Eventf(owner, corev1.EventTypeNormal, "TemplateSynced", message, key)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// templateSelected reports whether a source injecting workloads selects the Pod template of one
+func templateSelected(spec *v1alpha1.ProxyDefSpec, object client.Object) bool {
+	var template *corev1.PodTemplateSpec
+	switch workload := object.(type) {
+	case *appsv1.Deployment:
+		template = &workload.Spec.Template
+	case *appsv1.StatefulSet:
+		template = &workload.Spec.Template
+	case *appsv1.DaemonSet:
+		template = &workload.Spec.Template
+	case *batchv1.CronJob:
+		template = &workload.Spec.JobTemplate.Spec.Template
+	default:
+		return false
+	}
+	if spec.InjectionModeOrDefault() != v1alpha1.InjectionModeWorkload {
+		return false
+	}
+	for _, annotations := range []map[string]string{object.GetAnnotations(), template.Annotations} {
+		if inject, err := strconv.ParseBool(annotations[v1alpha1.InjectAnnotation]); err == nil && !inject {
+			return false
+		}
+	}
+	if spec.PodSelector == nil {
+		return true
+	}
+	selector, err := metav1.LabelSelectorAsSelector(spec.PodSelector)
+	return err == nil && selector.Matches(labels.Set(template.Labels))
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2024 Igor DC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/igordcard/proxius/api/v1alpha1"
+)
+
+// trustedCAError reports a referenced CA bundle that cannot be used.
+// Only a change to the referenced object or to the spec can fix it, so it is not requeued.
+type trustedCAError struct {
+	reason  string
+	message string
+}
+
+func (e *trustedCAError) Error() string {
+	return e.message
+}
+
+// loadTrustedCA reads the CA bundle referenced by a TrustedCA from the given namespace.
+// Only the certificates are kept from it, re-encoded as PEM, so that a Secret also holding
+// a private key, such as one of type kubernetes.io/tls, cannot leak it into a ConfigMap.
+// The returned error is a *trustedCAError when the bundle is missing or holds no certificate.
+func loadTrustedCA(ctx context.Context, c client.Reader, namespace string, ca *v1alpha1.TrustedCA) (string, error) {
+	ref, key, secret := ca.Reference()
+	kind := "ConfigMap"
+	var raw []byte
+	if secret {
+		kind = "Secret"
+		object := &corev1.Secret{}
+		if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: ref.Name}, object); err != nil {
+			if apierrors.IsNotFound(err) {
+				return "", &trustedCAError{reason: "TrustedCANotFound", message: fmt.Sprintf("Trusted CA Secret %s/%s not found", namespace, ref.Name)}
+			}
+			return "", err
+		}
+		raw = object.Data[key]
+	} else {
+		object := &corev1.ConfigMap{}
+		if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: ref.Name}, object); err != nil {
+			if apierrors.IsNotFound(err) {
+				return "", &trustedCAError{reason: "TrustedCANotFound", message: fmt.Sprintf("Trusted CA ConfigMap %s/%s not found", namespace, ref.Name)}
+			}
+			return "", err
+		}
+		raw = []byte(object.Data[key])
+		if value, ok := object.BinaryData[key]; ok {
+			raw = value
+		}
+	}
+	if len(raw) == 0 {
+		return "", &trustedCAError{reason: "TrustedCANotFound", message: fmt.Sprintf("Trusted CA %s %s/%s has no %q key", kind, namespace, ref.Name, key)}
+	}
+
+	var bundle bytes.Buffer
+	for block, rest := pem.Decode(raw); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return "", &trustedCAError{reason: "TrustedCAInvalid", message: fmt.Sprintf("Trusted CA %s %s/%s holds an invalid certificate: %v", kind, namespace, ref.Name, err)}
+		}
+		if err := pem.Encode(&bundle, &pem.Block{Type: block.Type, Bytes: block.Bytes}); err != nil {
+			return "", err
+		}
+	}
+	if bundle.Len() == 0 {
+		return "", &trustedCAError{reason: "TrustedCAInvalid", message: fmt.Sprintf("Trusted CA %s %s/%s has no PEM-encoded certificate under %q", kind, namespace, ref.Name, key)}
+	}
+	return bundle.String(), nil
+}
+
+// trustedCAData returns the data of the ConfigMap holding a CA bundle, or nil without a bundle
+func trustedCAData(bundle string) map[string]string {
+	if bundle == "" {
+		return nil
+	}
+	return map[string]string{v1alpha1.TrustedCAKey: bundle}
+}
+
+// trustedCAReference returns the reference of a TrustedCA when it reads its bundle from
+// a Secret, when secret is set, or from a ConfigMap otherwise
+func trustedCAReference(ca *v1alpha1.TrustedCA, secret bool) *v1alpha1.CABundleReference {
+	if ca == nil {
+		return nil
+	}
+	if ref, _, isSecret := ca.Reference(); ref != nil && isSecret == secret {
+		return ref
+	}
+	return nil
+}